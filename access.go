@@ -0,0 +1,279 @@
+package keystore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+type readOnly struct {
+	store Store
+}
+
+// ReadOnly wraps a Store so that all modifying methods return ErrReadOnly.
+func ReadOnly(store Store) Store {
+	if r, ok := store.(readOnly); ok {
+		return r
+	}
+
+	return readOnly{store: store}
+}
+
+func (r readOnly) Get(key string, rf io.ReaderFrom) error {
+	return r.store.Get(key, rf)
+}
+
+func (readOnly) Set(string, io.WriterTo) error {
+	return ErrReadOnly
+}
+
+func (readOnly) Remove(string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Keys() []string {
+	return r.store.Keys()
+}
+
+func (r readOnly) KeysErr() ([]string, error) {
+	return KeysErr(r.store)
+}
+
+func (readOnly) Rename(string, string) error {
+	return ErrReadOnly
+}
+
+// Operation is a bitmask of Store methods that a Rule applies to.
+type Operation uint8
+
+// Operations.
+const (
+	OpGet Operation = 1 << iota
+	OpSet
+	OpRemove
+	OpRename
+	OpKeys
+
+	OpRead  = OpGet | OpKeys
+	OpWrite = OpSet | OpRemove | OpRename
+	OpAll   = OpRead | OpWrite
+)
+
+var operationNames = [...]string{"get", "set", "remove", "rename", "keys"}
+
+func (o Operation) String() string {
+	var names []string
+
+	for n, name := range operationNames {
+		if o&(1<<n) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, "|")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (o Operation) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (o *Operation) UnmarshalText(text []byte) error {
+	*o = 0
+
+	if string(text) == "none" {
+		return nil
+	}
+
+	for _, name := range strings.Split(string(text), "|") {
+		n := 0
+
+		for n < len(operationNames) && operationNames[n] != name {
+			n++
+		}
+
+		if n == len(operationNames) {
+			return fmt.Errorf("unknown operation: %q", name)
+		}
+
+		*o |= 1 << n
+	}
+
+	return nil
+}
+
+// Rule is a single allow or deny entry in a Policy.
+type Rule struct {
+	// Principals lists the principals the rule applies to. An empty list
+	// applies to all principals, including when no principal is given.
+	Principals []string
+	// Pattern is matched against keys using path.Match, so '*' and '?' do not
+	// match the '/' separator; "a/*" matches "a/b", but not "a/b/c". An empty
+	// pattern matches all keys.
+	//
+	// A malformed pattern never matches for an allow rule, and always matches
+	// for a deny rule.
+	Pattern string
+	// Ops are the operations the rule applies to.
+	Ops Operation
+	// Allow determines whether a matching operation is allowed or denied.
+	Allow bool
+}
+
+func (r *Rule) matches(principal string, hasPrincipal bool, op Operation, key string) bool {
+	if r.Ops&op == 0 {
+		return false
+	}
+
+	if len(r.Principals) > 0 {
+		if !hasPrincipal {
+			return false
+		}
+
+		found := false
+
+		for _, p := range r.Principals {
+			if p == principal {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if r.Pattern == "" {
+		return true
+	}
+
+	ok, err := path.Match(r.Pattern, key)
+	if err != nil {
+		return !r.Allow
+	}
+
+	return ok
+}
+
+// Validate checks that the Pattern of each Rule is well formed.
+func (p Policy) Validate() error {
+	for n := range p {
+		if _, err := path.Match(p[n].Pattern, ""); err != nil {
+			return fmt.Errorf("error in rule %d: %w", n, err)
+		}
+	}
+
+	return nil
+}
+
+// Policy is an ordered list of Rules. The first matching Rule determines
+// whether an operation is allowed; when no Rule matches, it is denied.
+type Policy []Rule
+
+// Allowed determines whether the principal in the context may perform the
+// operation on the key.
+func (p Policy) Allowed(ctx context.Context, op Operation, key string) bool {
+	principal, ok := PrincipalFromContext(ctx)
+
+	for n := range p {
+		if p[n].matches(principal, ok, op, key) {
+			return p[n].Allow
+		}
+	}
+
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a new context carrying the given principal.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext retrieves the principal set with WithPrincipal.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+
+	return principal, ok
+}
+
+type restricted struct {
+	store  Store
+	policy Policy
+	ctx    context.Context
+}
+
+// Restrict wraps a Store so that each call is authorised against the Policy,
+// using the principal carried in the given context. Unauthorised calls return
+// ErrDenied, and Keys only returns those keys that the principal may list.
+//
+// The Policy should be checked with Validate before use.
+func Restrict(ctx context.Context, store Store, policy Policy) Store {
+	return &restricted{
+		store:  store,
+		policy: policy,
+		ctx:    ctx,
+	}
+}
+
+func (r *restricted) Get(key string, rf io.ReaderFrom) error {
+	if !r.policy.Allowed(r.ctx, OpGet, key) {
+		return ErrDenied
+	}
+
+	return r.store.Get(key, rf)
+}
+
+func (r *restricted) Set(key string, w io.WriterTo) error {
+	if !r.policy.Allowed(r.ctx, OpSet, key) {
+		return ErrDenied
+	}
+
+	return r.store.Set(key, w)
+}
+
+func (r *restricted) Remove(key string) error {
+	if !r.policy.Allowed(r.ctx, OpRemove, key) {
+		return ErrDenied
+	}
+
+	return r.store.Remove(key)
+}
+
+func (r *restricted) Keys() []string {
+	keys, _ := r.KeysErr()
+
+	return keys
+}
+
+func (r *restricted) KeysErr() ([]string, error) {
+	var keys []string
+
+	all, err := KeysErr(r.store)
+
+	for _, key := range all {
+		if r.policy.Allowed(r.ctx, OpKeys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, err
+}
+
+func (r *restricted) Rename(oldkey, newkey string) error {
+	if !r.policy.Allowed(r.ctx, OpRename, oldkey) || !r.policy.Allowed(r.ctx, OpRename, newkey) {
+		return ErrDenied
+	}
+
+	return r.store.Rename(oldkey, newkey)
+}
@@ -0,0 +1,100 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"path"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestReadOnly(t *testing.T) {
+	m := NewMemStore()
+	m.Set("key", data("data"))
+	r := ReadOnly(m)
+	var buf memio.Buffer
+	if err := r.Get("key", &buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf) != "data" {
+		t.Errorf("test 1: expecting value %q, got %q", "data", buf)
+	} else if err = r.Set("key", data("other")); err != ErrReadOnly {
+		t.Errorf("test 2: expecting ErrReadOnly, got %v", err)
+	} else if err = r.Remove("key"); err != ErrReadOnly {
+		t.Errorf("test 3: expecting ErrReadOnly, got %v", err)
+	} else if err = r.Rename("key", "newKey"); err != ErrReadOnly {
+		t.Errorf("test 4: expecting ErrReadOnly, got %v", err)
+	} else if keys := r.Keys(); !reflect.DeepEqual(keys, []string{"key"}) {
+		t.Errorf("test 5: expecting keys [key], got %v", keys)
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	m := NewMemStore()
+	m.Set("public/a", data("a"))
+	m.Set("private/b", data("b"))
+	policy := Policy{
+		{Principals: []string{"admin"}, Ops: OpAll, Allow: true},
+		{Pattern: "private/*", Ops: OpAll, Allow: false},
+		{Principals: []string{"plugin"}, Pattern: "public/*", Ops: OpAll, Allow: true},
+		{Ops: OpRead, Allow: true},
+	}
+	admin := Restrict(WithPrincipal(context.Background(), "admin"), m, policy)
+	plugin := Restrict(WithPrincipal(context.Background(), "plugin"), m, policy)
+	anon := Restrict(context.Background(), m, policy)
+	var buf memio.Buffer
+	if keys := admin.Keys(); !reflect.DeepEqual(keys, []string{"private/b", "public/a"}) {
+		t.Errorf("test 1: expecting keys [private/b public/a], got %v", keys)
+	} else if keys = plugin.Keys(); !reflect.DeepEqual(keys, []string{"public/a"}) {
+		t.Errorf("test 2: expecting keys [public/a], got %v", keys)
+	} else if err := plugin.Get("private/b", &buf); err != ErrDenied {
+		t.Errorf("test 3: expecting ErrDenied, got %v", err)
+	} else if err = plugin.Set("public/c", data("c")); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if err = plugin.Rename("public/c", "private/c"); err != ErrDenied {
+		t.Errorf("test 5: expecting ErrDenied, got %v", err)
+	} else if err = anon.Get("public/c", &buf); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if err = anon.Remove("public/c"); err != ErrDenied {
+		t.Errorf("test 7: expecting ErrDenied, got %v", err)
+	} else if err = admin.Remove("private/b"); err != nil {
+		t.Errorf("test 8: unexpected error: %s", err)
+	}
+	policy = Policy{
+		{Pattern: "private/[", Ops: OpAll, Allow: false},
+		{Pattern: "public/[", Ops: OpAll, Allow: true},
+		{Ops: OpRead, Allow: true},
+	}
+	anon = Restrict(context.Background(), m, policy)
+	if err := policy.Validate(); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("test 9: expecting ErrBadPattern, got %v", err)
+	} else if err = anon.Get("public/a", &buf); err != ErrDenied {
+		t.Errorf("test 10: expecting ErrDenied, got %v", err)
+	} else if err = policy[1:].Validate(); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("test 11: expecting ErrBadPattern, got %v", err)
+	} else if err = policy[2:].Validate(); err != nil {
+		t.Errorf("test 12: unexpected error: %s", err)
+	} else if !policy[1:].Allowed(context.Background(), OpGet, "public/a") {
+		t.Errorf("test 13: expecting malformed allow rule to be skipped")
+	} else if (Policy{{Pattern: "a/*", Ops: OpGet, Allow: true}}).Allowed(context.Background(), OpGet, "a/b/c") {
+		t.Errorf("test 14: expecting * not to match /")
+	}
+}
+
+func TestOperationText(t *testing.T) {
+	for n, op := range [...]Operation{0, OpGet, OpRename, OpWrite, OpAll} {
+		var got Operation
+		if text, err := op.MarshalText(); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if err = got.UnmarshalText(text); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if got != op {
+			t.Errorf("test %d: expecting %s, got %s", n+1, op, got)
+		}
+	}
+	var op Operation
+	if err := op.UnmarshalText([]byte("get|bad")); err == nil {
+		t.Errorf("test 6: expecting error")
+	}
+}
@@ -0,0 +1,280 @@
+package keystore
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+// Format is an archive format used by Export and Import.
+type Format uint8
+
+// Formats.
+const (
+	// FormatNative is the format used by MemStore.WriteTo.
+	FormatNative Format = iota
+	// FormatTar is a tar archive, with one regular file per key.
+	FormatTar
+	// FormatJSONLines is a stream of JSON objects, one per line, each with a
+	// 'key' field and a base64 encoded 'value' field.
+	FormatJSONLines
+)
+
+// ConflictPolicy determines how Import handles keys that already exist in the
+// Store.
+type ConflictPolicy uint8
+
+// Conflict Policies.
+const (
+	// ConflictOverwrite replaces existing keys.
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip leaves existing keys unchanged.
+	ConflictSkip
+	// ConflictError stops the import, returning ErrKeyExists.
+	ConflictError
+)
+
+// ErrUnknownFormat is returned when an unknown Format is given.
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+// MaxImportKeyLength is the longest key, in bytes, that Import will read from
+// a FormatNative archive.
+const MaxImportKeyLength = 1 << 16
+
+type jsonRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export writes all of the keys in the Store to the Writer in the given
+// format. Values are retrieved one at a time.
+func Export(store Store, w io.Writer, format Format) error {
+	var (
+		write  func(string, memio.Buffer) error
+		finish = func() error { return nil }
+	)
+
+	bw := bufio.NewWriter(w)
+
+	switch format {
+	case FormatNative:
+		lw := byteio.StickyLittleEndianWriter{Writer: bw}
+
+		write = func(key string, value memio.Buffer) error {
+			lw.WriteStringX(key)
+			lw.WriteUintX(uint64(len(value)))
+			lw.Write(value)
+
+			return lw.Err
+		}
+	case FormatTar:
+		tw := tar.NewWriter(bw)
+		now := time.Now()
+		finish = tw.Close
+
+		write = func(key string, value memio.Buffer) error {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     key,
+				Size:     int64(len(value)),
+				Mode:     0o600,
+				ModTime:  now,
+			}); err != nil {
+				return err
+			}
+
+			_, err := tw.Write(value)
+
+			return err
+		}
+	case FormatJSONLines:
+		je := json.NewEncoder(bw)
+
+		write = func(key string, value memio.Buffer) error {
+			return je.Encode(jsonRecord{Key: key, Value: base64.StdEncoding.EncodeToString(value)})
+		}
+	default:
+		return ErrUnknownFormat
+	}
+
+	keys, err := KeysErr(store)
+
+	var undecodable *UndecodableError
+
+	if err != nil && !errors.As(err, &undecodable) {
+		return err
+	}
+
+	var buf memio.Buffer
+
+	for _, key := range keys {
+		buf = buf[:0]
+
+		if err := store.Get(key, &buf); errors.Is(err, ErrUnknownKey) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading key %q: %w", key, err)
+		}
+
+		if err := write(key, buf); err != nil {
+			return fmt.Errorf("error writing key %q: %w", key, err)
+		}
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+type readerWriterTo struct {
+	io.Reader
+}
+
+func (r readerWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, r.Reader)
+}
+
+func exists(store Store, key string) bool {
+	if e, ok := store.(interface{ Exists(string) bool }); ok {
+		return e.Exists(key)
+	}
+
+	return store.Get(key, discard{}) == nil
+}
+
+type discard struct{}
+
+func (discard) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(io.Discard, r)
+}
+
+// Import reads keys from the Reader, in the given format, and stores them in
+// the Store, handling existing keys according to the ConflictPolicy.
+func Import(store Store, r io.Reader, format Format, policy ConflictPolicy) error {
+	var next func() (string, io.Reader, error)
+
+	br := bufio.NewReader(r)
+
+	switch format {
+	case FormatNative:
+		lr := byteio.StickyLittleEndianReader{Reader: br}
+
+		next = func() (string, io.Reader, error) {
+			ksize := lr.ReadUintX()
+
+			if errors.Is(lr.Err, io.EOF) {
+				return "", nil, io.EOF
+			} else if lr.Err == nil && ksize > MaxImportKeyLength {
+				return "", nil, fmt.Errorf("%w: invalid key length %d", ErrCorrupt, ksize)
+			}
+
+			key := string(readBuffer(&lr, ksize))
+			usize := lr.ReadUintX()
+
+			if lr.Err != nil {
+				if errors.Is(lr.Err, io.EOF) {
+					lr.Err = io.ErrUnexpectedEOF
+				}
+
+				return "", nil, lr.Err
+			} else if usize > math.MaxInt64 {
+				return "", nil, fmt.Errorf("%w: invalid size for key %q", ErrCorrupt, key)
+			}
+
+			size := int64(usize)
+
+			return key, &exactReader{io.LimitReader(br, size), size}, nil
+		}
+	case FormatTar:
+		tr := tar.NewReader(br)
+
+		next = func() (string, io.Reader, error) {
+			for {
+				h, err := tr.Next()
+				if err != nil {
+					return "", nil, err
+				}
+
+				if h.Typeflag == tar.TypeReg {
+					return h.Name, tr, nil
+				}
+			}
+		}
+	case FormatJSONLines:
+		jd := json.NewDecoder(br)
+
+		next = func() (string, io.Reader, error) {
+			var record jsonRecord
+
+			if err := jd.Decode(&record); err != nil {
+				return "", nil, err
+			}
+
+			value, err := base64.StdEncoding.DecodeString(record.Value)
+			if err != nil {
+				return "", nil, err
+			}
+
+			buf := memio.Buffer(value)
+
+			return record.Key, &buf, nil
+		}
+	default:
+		return ErrUnknownFormat
+	}
+
+	for {
+		key, value, err := next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading archive: %w", err)
+		}
+
+		if policy != ConflictOverwrite && exists(store, key) {
+			if policy == ConflictError {
+				return fmt.Errorf("error importing key %q: %w", key, ErrKeyExists)
+			}
+
+			if _, err = io.Copy(io.Discard, value); err != nil {
+				return fmt.Errorf("error reading archive: %w", err)
+			}
+
+			continue
+		}
+
+		if err = store.Set(key, readerWriterTo{value}); err != nil {
+			return fmt.Errorf("error importing key %q: %w", key, err)
+		} else if _, err = io.Copy(io.Discard, value); err != nil {
+			return fmt.Errorf("error reading archive: %w", err)
+		}
+	}
+}
+
+type exactReader struct {
+	io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	n, err := e.Reader.Read(p)
+
+	e.remaining -= int64(n)
+
+	if errors.Is(err, io.EOF) && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,85 @@
+package keystore
+
+import (
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+func TestExportImport(t *testing.T) {
+	m := NewMemStore()
+	m.Set("key1", data("data1"))
+	m.Set("dir/key2", data("data2"))
+	m.Set("empty", data(""))
+	for n, format := range [...]Format{FormatNative, FormatTar, FormatJSONLines} {
+		var buf memio.Buffer
+		if err := Export(m, &buf, format); err != nil {
+			t.Errorf("test %d: unexpected error exporting: %s", n+1, err)
+			continue
+		}
+		i := NewMemStore()
+		i.Set("key1", data("other"))
+		archive := append(memio.Buffer{}, buf...)
+		if err := Import(i, &buf, format, ConflictError); !errors.Is(err, ErrKeyExists) {
+			t.Errorf("test %d: expecting ErrKeyExists, got %v", n+1, err)
+		}
+		buf = append(buf[:0], archive...)
+		if err := Import(i, &buf, format, ConflictSkip); err != nil {
+			t.Errorf("test %d: unexpected error importing: %s", n+1, err)
+		} else if keys := i.Keys(); !reflect.DeepEqual(keys, m.Keys()) {
+			t.Errorf("test %d: expecting keys %v, got %v", n+1, m.Keys(), keys)
+		} else if i.Get("key1", &buf); string(buf) != "other" {
+			t.Errorf("test %d: expecting value %q, got %q", n+1, "other", buf)
+		}
+		buf = append(buf[:0], archive...)
+		if err := Import(i, &buf, format, ConflictOverwrite); err != nil {
+			t.Errorf("test %d: unexpected error importing: %s", n+1, err)
+			continue
+		}
+		for _, key := range m.Keys() {
+			var a, b memio.Buffer
+			m.Get(key, &a)
+			if err := i.Get(key, &b); err != nil {
+				t.Errorf("test %d: unexpected error getting %q: %s", n+1, key, err)
+			} else if string(a) != string(b) {
+				t.Errorf("test %d: expecting value %q for key %q, got %q", n+1, a, key, b)
+			}
+		}
+	}
+}
+
+func TestExportNative(t *testing.T) {
+	m := NewMemStore()
+	m.Set("key1", data("data1"))
+	m.Set("key2", data("data2"))
+	var buf memio.Buffer
+	Export(m, &buf, FormatNative)
+	n := NewMemStore()
+	if _, err := n.ReadFrom(&buf); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if keys := n.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key2"}) {
+		t.Errorf("expecting keys [key1 key2], got %v", keys)
+	}
+	lw := byteio.StickyLittleEndianWriter{Writer: &buf}
+	lw.WriteStringX("key3")
+	lw.WriteUintX(math.MaxUint64)
+	if err := Import(n, &buf, FormatNative, ConflictOverwrite); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expecting ErrCorrupt, got %v", err)
+	}
+	buf = buf[:0]
+	lw.WriteUintX(1 << 62)
+	if err := Import(n, &buf, FormatNative, ConflictOverwrite); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expecting ErrCorrupt for key length, got %v", err)
+	}
+	buf = buf[:0]
+	lw.WriteUintX(10)
+	lw.Write([]byte("key"))
+	if err := Import(n, &buf, FormatNative, ConflictOverwrite); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expecting io.ErrUnexpectedEOF, got %v", err)
+	}
+}
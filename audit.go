@@ -0,0 +1,336 @@
+package keystore
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a single entry in an audit log, describing one Set, Remove or
+// Rename call.
+//
+// Each call is recorded twice: a Pending record is written before the Store is
+// changed, and a completion record, with Intent set to the Seq of the Pending
+// record, is written once the call returns. A Pending record without a
+// completion record is a call that may, or may not, have been applied.
+//
+// Each record contains the Digest of the record before it, forming a chain
+// that is checked by an AuditReader.
+type AuditRecord struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal,omitempty"`
+	Op        Operation `json:"op"`
+	Key       string    `json:"key"`
+	NewKey    string    `json:"newKey,omitempty"`
+	Pending   bool      `json:"pending,omitempty"`
+	Intent    uint64    `json:"intent,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Prev      string    `json:"prev"`
+	Digest    string    `json:"digest"`
+}
+
+func (a AuditRecord) digest() (string, error) {
+	a.Digest = ""
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog writes a hash-chained log of records, one JSON object per line.
+//
+// An AuditLog can be shared between many Audited Stores, but an Audited Store
+// must not wrap another Store using the same AuditLog.
+type AuditLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	seq    uint64
+	prev   string
+	err    error
+	closer io.Closer
+}
+
+// NewAuditLog creates an AuditLog that starts a new chain on the given Writer.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog opens the audit log file at the given path, creating it if
+// necessary. Any existing records are verified before new records are appended
+// to the chain.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+
+	ar := NewAuditReader(bufio.NewReader(f))
+
+	for {
+		if _, err := ar.Next(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			f.Close()
+
+			return nil, fmt.Errorf("error verifying audit log: %w", err)
+		}
+	}
+
+	return &AuditLog{
+		w:      f,
+		seq:    ar.seq,
+		prev:   ar.prev,
+		closer: f,
+	}, nil
+}
+
+// Digest returns the digest of the last record written to the log.
+//
+// As the chain cannot show that records have been removed from the end of the
+// log, this can be kept elsewhere to be checked against later.
+func (a *AuditLog) Digest() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.prev
+}
+
+// Close closes the log file, if it was opened with OpenAuditLog.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err == nil {
+		a.err = fmt.Errorf("error writing audit log: %w", os.ErrClosed)
+	}
+
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+
+	return nil
+}
+
+func (a *AuditLog) apply(record AuditRecord, fn func(*AuditRecord) error) error {
+	intent := record
+	intent.Pending = true
+
+	seq, err := a.append(intent)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(&record); err != nil {
+		record.Error = err.Error()
+	}
+
+	record.Intent = seq
+
+	if _, lerr := a.append(record); lerr != nil {
+		return lerr
+	}
+
+	return err
+}
+
+func (a *AuditLog) append(record AuditRecord) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err != nil {
+		return 0, a.err
+	}
+
+	if err := a.write(record); err != nil {
+		a.err = fmt.Errorf("error writing audit log: %w", err)
+
+		return 0, a.err
+	}
+
+	return a.seq, nil
+}
+
+func (a *AuditLog) write(record AuditRecord) error {
+	record.Seq = a.seq + 1
+	record.Time = time.Now().UTC()
+	record.Prev = a.prev
+	record.Principal = strings.ToValidUTF8(record.Principal, "\uFFFD")
+	record.Key = strings.ToValidUTF8(record.Key, "\uFFFD")
+	record.NewKey = strings.ToValidUTF8(record.NewKey, "\uFFFD")
+	record.Error = strings.ToValidUTF8(record.Error, "\uFFFD")
+
+	digest, err := record.digest()
+	if err != nil {
+		return err
+	}
+
+	record.Digest = digest
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err = a.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	a.seq = record.Seq
+	a.prev = digest
+
+	return nil
+}
+
+// AuditReader reads records from an audit log, verifying the chain.
+type AuditReader struct {
+	dec  *json.Decoder
+	seq  uint64
+	prev string
+}
+
+// NewAuditReader creates a new AuditReader reading from the start of an audit
+// log.
+func NewAuditReader(r io.Reader) *AuditReader {
+	dec := json.NewDecoder(r)
+
+	dec.DisallowUnknownFields()
+
+	return &AuditReader{dec: dec}
+}
+
+// Next returns the next record in the log, returning io.EOF at the end of the
+// log.
+//
+// A record that has been modified, inserted, removed or reordered results in
+// an error wrapping ErrCorrupt.
+func (a *AuditReader) Next() (*AuditRecord, error) {
+	var record AuditRecord
+
+	if err := a.dec.Decode(&record); errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: audit record %d: %s", ErrCorrupt, a.seq+1, err)
+	}
+
+	if record.Seq != a.seq+1 {
+		return nil, fmt.Errorf("%w: expecting audit record %d, got %d", ErrCorrupt, a.seq+1, record.Seq)
+	} else if record.Prev != a.prev {
+		return nil, fmt.Errorf("%w: audit record %d: chain broken", ErrCorrupt, record.Seq)
+	} else if digest, err := record.digest(); err != nil || digest != record.Digest {
+		return nil, fmt.Errorf("%w: audit record %d: digest mismatch", ErrCorrupt, record.Seq)
+	}
+
+	a.seq = record.Seq
+	a.prev = record.Digest
+
+	return &record, nil
+}
+
+type audited struct {
+	store     Store
+	log       *AuditLog
+	principal string
+}
+
+// Audited wraps a Store so that every Set, Remove and Rename call is recorded
+// in the AuditLog, along with the principal carried in the given context.
+//
+// Calls are recorded whether or not they succeed. The log is only locked while
+// records are written, so calls to the Store can run concurrently. Once the
+// log cannot be written to, all modifying calls fail without reaching the
+// Store.
+func Audited(ctx context.Context, store Store, log *AuditLog) Store {
+	principal, _ := PrincipalFromContext(ctx)
+
+	return &audited{
+		store:     store,
+		log:       log,
+		principal: principal,
+	}
+}
+
+func (a *audited) Get(key string, r io.ReaderFrom) error {
+	return a.store.Get(key, r)
+}
+
+type hashingWriter struct {
+	io.Writer
+	hash  hash.Hash
+	count int64
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.Writer.Write(p)
+
+	h.hash.Write(p[:n])
+	h.count += int64(n)
+
+	return n, err
+}
+
+type hashingWriterTo struct {
+	io.WriterTo
+	hash  hash.Hash
+	count int64
+}
+
+func (h *hashingWriterTo) WriteTo(w io.Writer) (int64, error) {
+	hw := hashingWriter{Writer: w, hash: h.hash}
+
+	n, err := h.WriterTo.WriteTo(&hw)
+
+	h.count += hw.count
+
+	return n, err
+}
+
+func (a *audited) Set(key string, w io.WriterTo) error {
+	return a.log.apply(AuditRecord{Principal: a.principal, Op: OpSet, Key: key}, func(record *AuditRecord) error {
+		hw := hashingWriterTo{WriterTo: w, hash: sha256.New()}
+
+		err := a.store.Set(key, &hw)
+
+		record.Size = hw.count
+		record.Hash = hex.EncodeToString(hw.hash.Sum(nil))
+
+		return err
+	})
+}
+
+func (a *audited) Remove(key string) error {
+	return a.log.apply(AuditRecord{Principal: a.principal, Op: OpRemove, Key: key}, func(*AuditRecord) error {
+		return a.store.Remove(key)
+	})
+}
+
+func (a *audited) Keys() []string {
+	return a.store.Keys()
+}
+
+func (a *audited) KeysErr() ([]string, error) {
+	return KeysErr(a.store)
+}
+
+func (a *audited) Rename(oldkey, newkey string) error {
+	return a.log.apply(AuditRecord{Principal: a.principal, Op: OpRename, Key: oldkey, NewKey: newkey}, func(*AuditRecord) error {
+		return a.store.Rename(oldkey, newkey)
+	})
+}
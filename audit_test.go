@@ -0,0 +1,182 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func readAudit(r io.Reader) ([]*AuditRecord, error) {
+	var records []*AuditRecord
+
+	ar := NewAuditReader(r)
+
+	for {
+		record, err := ar.Next()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+
+		records = append(records, record)
+	}
+}
+
+func TestAudited(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewAuditLog(&buf)
+	m := NewMemStore()
+	s := Audited(WithPrincipal(context.Background(), "alice"), m, log)
+	b := Audited(context.Background(), m, log)
+	var val memio.Buffer
+	s.Set("key", data("Hello"))
+	s.Get("key", &val)
+	s.Rename("key", "other")
+	b.Remove("key")
+	s.Keys()
+	records, err := readAudit(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	sum := sha256.Sum256([]byte("Hello"))
+	type entry struct {
+		Principal   string
+		Op          Operation
+		Key, NewKey string
+		Size        int64
+		Hash        string
+		Failed      bool
+		Pending     bool
+		Intent      uint64
+	}
+	expected := []entry{
+		{"alice", OpSet, "key", "", 0, "", false, true, 0},
+		{"alice", OpSet, "key", "", 5, hex.EncodeToString(sum[:]), false, false, 1},
+		{"alice", OpRename, "key", "other", 0, "", false, true, 0},
+		{"alice", OpRename, "key", "other", 0, "", false, false, 3},
+		{"", OpRemove, "key", "", 0, "", false, true, 0},
+		{"", OpRemove, "key", "", 0, "", true, false, 5},
+	}
+	got := make([]entry, len(records))
+	for n, r := range records {
+		got[n] = entry{r.Principal, r.Op, r.Key, r.NewKey, r.Size, r.Hash, r.Error != "", r.Pending, r.Intent}
+		if r.Seq != uint64(n+1) {
+			t.Errorf("test 2: expecting seq %d, got %d", n+1, r.Seq)
+		} else if r.Time.IsZero() {
+			t.Errorf("test 2: expecting time to be set on record %d", n+1)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("test 2: expecting records %v, got %v", expected, got)
+	} else if d := log.Digest(); d != records[5].Digest {
+		t.Errorf("test 3: expecting digest %q, got %q", records[5].Digest, d)
+	}
+	lines := bytes.SplitAfter(buf.Bytes(), []byte{'\n'})[:3]
+	for n, tampered := range [...][]byte{
+		bytes.Replace(buf.Bytes(), []byte("alice"), []byte("bobby"), 1),
+		bytes.Join([][]byte{lines[0], lines[2]}, nil),
+		bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil),
+		bytes.Replace(buf.Bytes(), []byte(`"seq":2`), []byte(`"seq":2,"extra":1`), 1),
+		buf.Bytes()[:buf.Len()-10],
+	} {
+		if _, err := readAudit(bytes.NewReader(tampered)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("test %d: expecting ErrCorrupt, got %v", n+4, err)
+		}
+	}
+}
+
+type failWriter struct {
+	io.Writer
+	writes int
+}
+
+func (f *failWriter) Write(p []byte) (int, error) {
+	if f.writes == 0 {
+		return 0, errors.New("write failed")
+	}
+
+	f.writes--
+
+	return f.Writer.Write(p)
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	m := NewMemStore()
+	s := Audited(context.Background(), m, NewAuditLog(&failWriter{}))
+	if err := s.Set("a", data("1")); err == nil {
+		t.Errorf("test 1: expecting error")
+	} else if m.Exists("a") {
+		t.Errorf("test 1: expecting Set to not reach the store without an intent record")
+	} else if err = s.Set("b", data("2")); err == nil {
+		t.Errorf("test 2: expecting error")
+	} else if m.Exists("b") {
+		t.Errorf("test 3: expecting Set to not reach the store after a log failure")
+	}
+	var buf bytes.Buffer
+	s = Audited(context.Background(), m, NewAuditLog(&failWriter{Writer: &buf, writes: 1}))
+	if err := s.Set("c", data("3")); err == nil {
+		t.Errorf("test 4: expecting error")
+	} else if !m.Exists("c") {
+		t.Errorf("test 4: expecting key to be set")
+	} else if records, err := readAudit(&buf); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if len(records) != 1 || !records[0].Pending || records[0].Key != "c" {
+		t.Errorf("test 5: expecting single pending record, got %v", records)
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for n := 0; n < 3; n++ {
+		log, err := OpenAuditLog(path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+			return
+		}
+		s := Audited(WithPrincipal(context.Background(), "bob"), NewMemStore(), log)
+		s.Set("key", data("value"))
+		s.Remove("key")
+		if err = log.Close(); err != nil {
+			t.Errorf("test %d: unexpected error closing log: %s", n+1, err)
+		} else if err = s.Set("key", data("value")); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("test %d: expecting os.ErrClosed, got %v", n+1, err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+		return
+	}
+	defer f.Close()
+	if records, err := readAudit(f); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if len(records) != 12 {
+		t.Errorf("test 4: expecting 12 records, got %d", len(records))
+	}
+	os.WriteFile(path, []byte("{}\n"), 0o600)
+	if _, err = OpenAuditLog(path); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 5: expecting ErrCorrupt, got %v", err)
+	}
+}
+
+func TestAuditInvalidUTF8(t *testing.T) {
+	var buf bytes.Buffer
+	s := Audited(context.Background(), NewMemStore(), NewAuditLog(&buf))
+	s.Set("\xff", data("value"))
+	if records, err := readAudit(&buf); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if len(records) != 2 {
+		t.Errorf("expecting 2 records, got %d", len(records))
+	}
+}
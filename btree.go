@@ -0,0 +1,1083 @@
+package keystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+const (
+	btreePageSize   = 4096
+	btreeMetaPages  = 2
+	btreeHeaderSize = 3
+	btreeMagic      = "KSBTREE1"
+	btreeMetaSize   = len(btreeMagic) + 8 + 8 + 8 + 4
+
+	btreeLeaf   uint8 = 1
+	btreeBranch uint8 = 2
+
+	btreeInline   uint8 = 0
+	btreeOverflow uint8 = 1
+
+	// MaxBTreeKeyLength is the longest key, in bytes, that can be stored in a
+	// BTreeStore.
+	MaxBTreeKeyLength = 512
+
+	// btreeMaxInline is the largest value stored within a leaf page; larger
+	// values are stored in a run of overflow pages.
+	btreeMaxInline = 512
+)
+
+var (
+	btreeKeyLength = MaxKeyLength(MaxBTreeKeyLength)
+	errBTreeNode   = fmt.Errorf("%w: invalid btree node", ErrCorrupt)
+	errBTreeMeta   = fmt.Errorf("%w: no valid btree meta page", ErrCorrupt)
+)
+
+type btreeEntry struct {
+	key   string
+	value []byte
+	page  uint64
+	size  uint64
+}
+
+// btreeNode is a decoded page. For leaves, each entry holds either an inline
+// value or the first page and size of an overflow run. For branches, each
+// entry holds a child page and the lowest key that can be stored within it,
+// except for the first entry, which holds any key lower than the second and
+// so is stored with an empty key.
+type btreeNode struct {
+	leaf    bool
+	entries []btreeEntry
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+
+	return binary.PutUvarint(buf[:], v)
+}
+
+func uvarint(p *[]byte) (uint64, bool) {
+	v, n := binary.Uvarint(*p)
+	if n <= 0 {
+		return 0, false
+	}
+
+	*p = (*p)[n:]
+
+	return v, true
+}
+
+func btreePages(size uint64) uint64 {
+	return (size + btreePageSize - 1) / btreePageSize
+}
+
+func (n *btreeNode) entrySize(e btreeEntry) int {
+	size := uvarintLen(uint64(len(e.key))) + len(e.key)
+
+	if !n.leaf {
+		return size + uvarintLen(e.page)
+	} else if e.page != 0 {
+		return size + 1 + uvarintLen(e.page) + uvarintLen(e.size)
+	}
+
+	return size + 1 + uvarintLen(uint64(len(e.value))) + len(e.value)
+}
+
+func (n *btreeNode) size() int {
+	size := btreeHeaderSize
+
+	for _, e := range n.entries {
+		size += n.entrySize(e)
+	}
+
+	return size
+}
+
+func (n *btreeNode) encode() []byte {
+	buf := make([]byte, btreePageSize)
+
+	if n.leaf {
+		buf[0] = btreeLeaf
+	} else {
+		buf[0] = btreeBranch
+	}
+
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(n.entries)))
+
+	p := btreeHeaderSize
+
+	for i, e := range n.entries {
+		key := e.key
+
+		if !n.leaf && i == 0 {
+			key = ""
+		}
+
+		p += binary.PutUvarint(buf[p:], uint64(len(key)))
+		p += copy(buf[p:], key)
+
+		if !n.leaf {
+			p += binary.PutUvarint(buf[p:], e.page)
+		} else if e.page != 0 {
+			buf[p] = btreeOverflow
+			p++
+			p += binary.PutUvarint(buf[p:], e.page)
+			p += binary.PutUvarint(buf[p:], e.size)
+		} else {
+			buf[p] = btreeInline
+			p++
+			p += binary.PutUvarint(buf[p:], uint64(len(e.value)))
+			p += copy(buf[p:], e.value)
+		}
+	}
+
+	return buf
+}
+
+func decodeNode(buf []byte) (*btreeNode, error) {
+	count := int(binary.LittleEndian.Uint16(buf[1:]))
+
+	if buf[0] != btreeLeaf && buf[0] != btreeBranch || count == 0 {
+		return nil, errBTreeNode
+	}
+
+	n := &btreeNode{
+		leaf:    buf[0] == btreeLeaf,
+		entries: make([]btreeEntry, count),
+	}
+	p := buf[btreeHeaderSize:]
+
+	for i := range n.entries {
+		e := &n.entries[i]
+
+		l, ok := uvarint(&p)
+		if !ok || l > uint64(len(p)) {
+			return nil, errBTreeNode
+		}
+
+		e.key = string(p[:l])
+		p = p[l:]
+
+		if i > 0 && e.key <= n.entries[i-1].key {
+			return nil, errBTreeNode
+		} else if !n.leaf {
+			if e.page, ok = uvarint(&p); !ok {
+				return nil, errBTreeNode
+			}
+
+			continue
+		} else if len(p) == 0 {
+			return nil, errBTreeNode
+		}
+
+		flag := p[0]
+		p = p[1:]
+
+		switch flag {
+		case btreeInline:
+			if l, ok = uvarint(&p); !ok || l > uint64(len(p)) {
+				return nil, errBTreeNode
+			}
+
+			e.value = p[:l:l]
+			p = p[l:]
+		case btreeOverflow:
+			if e.page, ok = uvarint(&p); !ok || e.page == 0 {
+				return nil, errBTreeNode
+			} else if e.size, ok = uvarint(&p); !ok {
+				return nil, errBTreeNode
+			}
+		default:
+			return nil, errBTreeNode
+		}
+	}
+
+	return n, nil
+}
+
+// search returns the position of the key in a leaf, and whether it is
+// present.
+func (n *btreeNode) search(key string) (int, bool) {
+	i := sort.Search(len(n.entries), func(i int) bool { return n.entries[i].key >= key })
+
+	return i, i < len(n.entries) && n.entries[i].key == key
+}
+
+// child returns the position of the branch entry whose subtree would hold the
+// key.
+func (n *btreeNode) child(key string) int {
+	if i := sort.Search(len(n.entries), func(i int) bool { return n.entries[i].key > key }) - 1; i > 0 {
+		return i
+	}
+
+	return 0
+}
+
+// split divides the entries of an oversized node between two nodes, each of
+// which fits within a page.
+func (n *btreeNode) split() (*btreeNode, *btreeNode) {
+	half := (n.size() - btreeHeaderSize) / 2
+
+	var size, i int
+
+	for ; i < len(n.entries)-1; i++ {
+		s := n.entrySize(n.entries[i])
+		if i > 0 && size+s > half {
+			break
+		}
+
+		size += s
+	}
+
+	return &btreeNode{leaf: n.leaf, entries: n.entries[:i:i]}, &btreeNode{leaf: n.leaf, entries: n.entries[i:]}
+}
+
+func encodeMeta(txid, root, pages uint64) []byte {
+	buf := make([]byte, btreeMetaSize)
+
+	copy(buf, btreeMagic)
+	binary.LittleEndian.PutUint64(buf[8:], txid)
+	binary.LittleEndian.PutUint64(buf[16:], root)
+	binary.LittleEndian.PutUint64(buf[24:], pages)
+	binary.LittleEndian.PutUint32(buf[32:], crc32.ChecksumIEEE(buf[:32]))
+
+	return buf
+}
+
+func decodeMeta(buf []byte) (txid, root, pages uint64, ok bool) {
+	if string(buf[:8]) != btreeMagic || binary.LittleEndian.Uint32(buf[32:]) != crc32.ChecksumIEEE(buf[:32]) {
+		return 0, 0, 0, false
+	}
+
+	return binary.LittleEndian.Uint64(buf[8:]), binary.LittleEndian.Uint64(buf[16:]), binary.LittleEndian.Uint64(buf[24:]), true
+}
+
+// BTreeStore implements the Store interface with a copy-on-write B+tree held
+// in a single file, keeping the keys in order.
+//
+// Changes never overwrite the pages of the last committed tree. Instead, the
+// modified pages are written to unused pages and then one of two alternating
+// meta pages is updated to point to the new root, so that after a crash the
+// file holds either the old or the new tree.
+//
+// Keys are limited to MaxBTreeKeyLength bytes.
+type BTreeStore struct {
+	mu        sync.RWMutex
+	f         *os.File
+	policy    SyncPolicy
+	txid      uint64
+	root      uint64
+	pages     uint64
+	free      []uint64
+	pending   []uint64
+	fresh     map[uint64]struct{}
+	dirty     bool
+	validator KeyValidator
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewBTreeStore opens, or creates, a BTreeStore in the given file.
+//
+// Under the SyncAlways policy, every change is committed to stable storage
+// before returning. Under the SyncPeriodic policy, changes are committed once
+// every WALSyncInterval, and on Close, with a crash losing any changes since
+// the last commit. The SyncNever policy leaves flushing to the operating
+// system, and so a crash may leave the file corrupt.
+//
+// Opening the file walks the entire tree in order to find the unused pages.
+func NewBTreeStore(path string, policy SyncPolicy) (*BTreeStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening btree file: %w", err)
+	}
+
+	bs := &BTreeStore{
+		f:      f,
+		policy: policy,
+		fresh:  make(map[uint64]struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := bs.load(); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	if policy == SyncPeriodic {
+		bs.wg.Add(1)
+
+		go bs.background()
+	}
+
+	return bs, nil
+}
+
+func (bs *BTreeStore) load() error {
+	fi, err := bs.f.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading btree file: %w", err)
+	}
+
+	if fi.Size() == 0 {
+		for n := 0; n < btreeMetaPages; n++ {
+			if err := bs.writeMeta(0, btreeMetaPages); err != nil {
+				return err
+			}
+		}
+
+		bs.pages = btreeMetaPages
+
+		return nil
+	}
+
+	var found bool
+
+	for n := int64(0); n < btreeMetaPages; n++ {
+		buf := make([]byte, btreeMetaSize)
+
+		if _, err := bs.f.ReadAt(buf, n*btreePageSize); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading meta page: %w", err)
+		}
+
+		if txid, root, pages, ok := decodeMeta(buf); ok && (!found || txid > bs.txid) {
+			bs.txid, bs.root, bs.pages, found = txid, root, pages, true
+		}
+	}
+
+	if !found || bs.pages < btreeMetaPages || bs.pages > btreePages(uint64(fi.Size())) {
+		return errBTreeMeta
+	}
+
+	used := make([]bool, bs.pages)
+
+	if bs.root != 0 {
+		if err := bs.mark(used, bs.root); err != nil {
+			return err
+		}
+	}
+
+	for page := uint64(btreeMetaPages); page < bs.pages; page++ {
+		if !used[page] {
+			bs.free = append(bs.free, page)
+		}
+	}
+
+	return nil
+}
+
+func (bs *BTreeStore) use(used []bool, page, count uint64) error {
+	if page < btreeMetaPages || page+count > bs.pages || page+count < page {
+		return fmt.Errorf("%w: invalid page reference %d", ErrCorrupt, page)
+	}
+
+	for ; count > 0; count-- {
+		if used[page] {
+			return fmt.Errorf("%w: page %d referenced twice", ErrCorrupt, page)
+		}
+
+		used[page] = true
+		page++
+	}
+
+	return nil
+}
+
+// mark records the pages used by the subtree.
+func (bs *BTreeStore) mark(used []bool, page uint64) error {
+	if err := bs.use(used, page, 1); err != nil {
+		return err
+	}
+
+	n, err := bs.readNode(page)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range n.entries {
+		if !n.leaf {
+			err = bs.mark(used, e.page)
+		} else if e.page != 0 {
+			err = bs.use(used, e.page, btreePages(e.size))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bs *BTreeStore) readNode(page uint64) (*btreeNode, error) {
+	buf := make([]byte, btreePageSize)
+
+	if _, err := bs.f.ReadAt(buf, int64(page)*btreePageSize); err != nil {
+		return nil, fmt.Errorf("error reading page %d: %w", page, err)
+	}
+
+	n, err := decodeNode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading page %d: %w", page, err)
+	}
+
+	return n, nil
+}
+
+func (bs *BTreeStore) lookup(key string) (btreeEntry, error) {
+	for page := bs.root; page != 0; {
+		n, err := bs.readNode(page)
+		if err != nil {
+			return btreeEntry{}, err
+		} else if !n.leaf {
+			page = n.entries[n.child(key)].page
+
+			continue
+		}
+
+		if i, ok := n.search(key); ok {
+			return n.entries[i], nil
+		}
+
+		break
+	}
+
+	return btreeEntry{}, ErrUnknownKey
+}
+
+func (bs *BTreeStore) reader(e btreeEntry) io.Reader {
+	if e.page == 0 {
+		buf := memio.Buffer(e.value)
+
+		return &buf
+	}
+
+	return io.NewSectionReader(bs.f, int64(e.page)*btreePageSize, int64(e.size))
+}
+
+// writeMeta commits the tree with the given root, syncing the tree pages
+// before writing the meta page.
+func (bs *BTreeStore) writeMeta(root, pages uint64) error {
+	if bs.policy != SyncNever {
+		if err := bs.f.Sync(); err != nil {
+			return fmt.Errorf("error syncing btree file: %w", err)
+		}
+	}
+
+	txid := bs.txid + 1
+
+	if _, err := bs.f.WriteAt(encodeMeta(txid, root, pages), int64(txid%btreeMetaPages)*btreePageSize); err != nil {
+		return fmt.Errorf("error writing meta page: %w", err)
+	}
+
+	if bs.policy != SyncNever {
+		if err := bs.f.Sync(); err != nil {
+			return fmt.Errorf("error syncing meta page: %w", err)
+		}
+	}
+
+	bs.txid = txid
+
+	return nil
+}
+
+func (bs *BTreeStore) addFree(page uint64) {
+	i := sort.Search(len(bs.free), func(i int) bool { return bs.free[i] >= page })
+
+	bs.free = append(bs.free, 0)
+
+	copy(bs.free[i+1:], bs.free[i:])
+
+	bs.free[i] = page
+}
+
+// flush commits any changes made under the SyncPeriodic policy.
+func (bs *BTreeStore) flush() error {
+	if !bs.dirty {
+		return nil
+	}
+
+	if err := bs.writeMeta(bs.root, bs.pages); err != nil {
+		return err
+	}
+
+	for _, page := range bs.pending {
+		bs.addFree(page)
+	}
+
+	bs.pending = nil
+	bs.fresh = make(map[uint64]struct{})
+	bs.dirty = false
+
+	return nil
+}
+
+func (bs *BTreeStore) background() {
+	defer bs.wg.Done()
+
+	t := time.NewTicker(WALSyncInterval)
+
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			bs.mu.Lock()
+			bs.flush()
+			bs.mu.Unlock()
+		case <-bs.done:
+			return
+		}
+	}
+}
+
+// btreeTx is a set of changes to the tree, which are either all committed or
+// all discarded.
+type btreeTx struct {
+	bs          *BTreeStore
+	root, pages uint64
+	alloc       map[uint64]struct{}
+	freed       []uint64
+}
+
+func (bs *BTreeStore) begin() *btreeTx {
+	return &btreeTx{
+		bs:    bs,
+		root:  bs.root,
+		pages: bs.pages,
+		alloc: make(map[uint64]struct{}),
+	}
+}
+
+// allocate finds a run of count unused pages, extending the file when there
+// is no such run in the free list.
+func (tx *btreeTx) allocate(count uint64) uint64 {
+	free := tx.bs.free
+	page, found := tx.pages, false
+
+	for i, c := 0, int(count); i+c <= len(free); i++ {
+		if free[i+c-1] == free[i]+count-1 {
+			page, found = free[i], true
+			tx.bs.free = append(free[:i], free[i+c:]...)
+
+			break
+		}
+	}
+
+	if !found {
+		tx.pages += count
+	}
+
+	for p := page; p < page+count; p++ {
+		tx.alloc[p] = struct{}{}
+	}
+
+	return page
+}
+
+// release marks pages as no longer used by the tree. Pages allocated within
+// the transaction are immediately reusable, while others only become reusable
+// once the transaction has been committed.
+func (tx *btreeTx) release(page, count uint64) {
+	for p := page; p < page+count; p++ {
+		if _, ok := tx.alloc[p]; ok {
+			delete(tx.alloc, p)
+			tx.bs.addFree(p)
+		} else {
+			tx.freed = append(tx.freed, p)
+		}
+	}
+}
+
+func (tx *btreeTx) releaseValue(e btreeEntry) {
+	if e.page != 0 {
+		tx.release(e.page, btreePages(e.size))
+	}
+}
+
+func (tx *btreeTx) writeValue(key string, value []byte) (btreeEntry, error) {
+	if len(value) <= btreeMaxInline {
+		return btreeEntry{key: key, value: value}, nil
+	}
+
+	size := uint64(len(value))
+	page := tx.allocate(btreePages(size))
+
+	if _, err := tx.bs.f.WriteAt(value, int64(page)*btreePageSize); err != nil {
+		return btreeEntry{}, fmt.Errorf("error writing overflow pages: %w", err)
+	}
+
+	return btreeEntry{key: key, page: page, size: size}, nil
+}
+
+// write stores the node in newly allocated pages, splitting it as necessary,
+// and returns the branch entries that point to it.
+func (tx *btreeTx) write(n *btreeNode) ([]btreeEntry, error) {
+	if n.size() > btreePageSize {
+		left, right := n.split()
+
+		l, err := tx.write(left)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := tx.write(right)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(l, r...), nil
+	}
+
+	page := tx.allocate(1)
+
+	if _, err := tx.bs.f.WriteAt(n.encode(), int64(page)*btreePageSize); err != nil {
+		return nil, fmt.Errorf("error writing page %d: %w", page, err)
+	}
+
+	return []btreeEntry{{key: n.entries[0].key, page: page}}, nil
+}
+
+// setRoot makes the given entries the root of the tree, adding branch levels
+// as necessary.
+func (tx *btreeTx) setRoot(entries []btreeEntry) error {
+	for len(entries) > 1 {
+		var err error
+
+		if entries, err = tx.write(&btreeNode{entries: entries}); err != nil {
+			return err
+		}
+	}
+
+	tx.root = 0
+
+	if len(entries) == 1 {
+		tx.root = entries[0].page
+	}
+
+	return nil
+}
+
+// insert sets the entry in the tree, releasing any value it replaces.
+func (tx *btreeTx) insert(e btreeEntry) error {
+	if tx.root == 0 {
+		entries, err := tx.write(&btreeNode{leaf: true, entries: []btreeEntry{e}})
+		if err != nil {
+			return err
+		}
+
+		return tx.setRoot(entries)
+	}
+
+	entries, err := tx.put(tx.root, e)
+	if err != nil {
+		return err
+	}
+
+	return tx.setRoot(entries)
+}
+
+// put sets the entry in the subtree, returning the branch entries that
+// replace it.
+func (tx *btreeTx) put(page uint64, e btreeEntry) ([]btreeEntry, error) {
+	n, err := tx.bs.readNode(page)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.leaf {
+		if i, ok := n.search(e.key); ok {
+			tx.releaseValue(n.entries[i])
+
+			n.entries[i] = e
+		} else {
+			n.entries = append(n.entries[:i], append([]btreeEntry{e}, n.entries[i:]...)...)
+		}
+	} else {
+		i := n.child(e.key)
+
+		children, err := tx.put(n.entries[i].page, e)
+		if err != nil {
+			return nil, err
+		}
+
+		n.replace(i, children)
+	}
+
+	tx.release(page, 1)
+
+	return tx.write(n)
+}
+
+// replace swaps the branch entry at the given position for the entries that
+// replace its subtree, which keep its lower bound.
+func (n *btreeNode) replace(i int, children []btreeEntry) {
+	if len(children) > 0 {
+		children[0].key = n.entries[i].key
+	}
+
+	n.entries = append(n.entries[:i], append(children, n.entries[i+1:]...)...)
+}
+
+// delete removes the key from the tree, returning its entry without
+// releasing the value.
+func (tx *btreeTx) delete(key string) (btreeEntry, error) {
+	if tx.root == 0 {
+		return btreeEntry{}, ErrUnknownKey
+	}
+
+	entries, e, err := tx.remove(tx.root, key)
+	if err != nil {
+		return btreeEntry{}, err
+	}
+
+	return e, tx.setRoot(entries)
+}
+
+// remove deletes the key from the subtree, returning the branch entries that
+// replace it, which are empty when the subtree is now empty.
+//
+// While removing an entry shrinks a node, the new child page numbers may take
+// more space to encode, and so a branch may still need to be split.
+func (tx *btreeTx) remove(page uint64, key string) ([]btreeEntry, btreeEntry, error) {
+	n, err := tx.bs.readNode(page)
+	if err != nil {
+		return nil, btreeEntry{}, err
+	}
+
+	var e btreeEntry
+
+	if n.leaf {
+		i, ok := n.search(key)
+		if !ok {
+			return nil, btreeEntry{}, ErrUnknownKey
+		}
+
+		e = n.entries[i]
+		n.entries = append(n.entries[:i], n.entries[i+1:]...)
+	} else {
+		i := n.child(key)
+
+		var children []btreeEntry
+
+		if children, e, err = tx.remove(n.entries[i].page, key); err != nil {
+			return nil, btreeEntry{}, err
+		}
+
+		n.replace(i, children)
+	}
+
+	tx.release(page, 1)
+
+	if len(n.entries) == 0 {
+		return nil, e, nil
+	} else if !n.leaf && len(n.entries) == 1 {
+		return n.entries, e, nil
+	}
+
+	entries, err := tx.write(n)
+
+	return entries, e, err
+}
+
+// commit makes the changes visible, and, unless using the SyncPeriodic
+// policy, writes the new meta page.
+//
+// Under the SyncPeriodic policy, pages freed by the transaction that are used
+// by the last written tree are held back until the next flush.
+func (tx *btreeTx) commit() error {
+	bs := tx.bs
+
+	if bs.policy != SyncPeriodic {
+		if err := bs.writeMeta(tx.root, tx.pages); err != nil {
+			tx.rollback()
+
+			return err
+		}
+	}
+
+	bs.root, bs.pages = tx.root, tx.pages
+
+	if bs.policy != SyncPeriodic {
+		for _, page := range tx.freed {
+			bs.addFree(page)
+		}
+
+		return nil
+	}
+
+	for page := range tx.alloc {
+		bs.fresh[page] = struct{}{}
+	}
+
+	for _, page := range tx.freed {
+		if _, ok := bs.fresh[page]; ok {
+			delete(bs.fresh, page)
+			bs.addFree(page)
+		} else {
+			bs.pending = append(bs.pending, page)
+		}
+	}
+
+	bs.dirty = true
+
+	return nil
+}
+
+// rollback returns the pages allocated by the transaction to the free list.
+func (tx *btreeTx) rollback() {
+	bs := tx.bs
+
+	for page := range tx.alloc {
+		if page < bs.pages {
+			bs.addFree(page)
+		}
+	}
+
+	bs.free = bs.free[:sort.Search(len(bs.free), func(i int) bool { return bs.free[i] >= bs.pages })]
+}
+
+// Get retrieves the key data from the tree.
+func (bs *BTreeStore) Get(key string, r io.ReaderFrom) error {
+	if err := bs.validateKeys(key); err != nil {
+		return err
+	}
+
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	e, err := bs.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.ReadFrom(bs.reader(e))
+
+	return err
+}
+
+// Set stores the key data in the tree.
+func (bs *BTreeStore) Set(key string, w io.WriterTo) error {
+	if err := bs.validateKeys(key); err != nil {
+		return err
+	}
+
+	var buf memio.Buffer
+
+	if _, err := w.WriteTo(&buf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	tx := bs.begin()
+
+	e, err := tx.writeValue(key, buf)
+	if err == nil {
+		err = tx.insert(e)
+	}
+
+	if err != nil {
+		tx.rollback()
+
+		return err
+	}
+
+	return tx.commit()
+}
+
+// Remove deletes the key from the tree.
+func (bs *BTreeStore) Remove(key string) error {
+	if err := bs.validateKeys(key); err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	tx := bs.begin()
+
+	e, err := tx.delete(key)
+	if err != nil {
+		tx.rollback()
+
+		return err
+	}
+
+	tx.releaseValue(e)
+
+	return tx.commit()
+}
+
+// Keys returns a sorted slice of all of the keys.
+func (bs *BTreeStore) Keys() []string {
+	keys, _ := bs.KeysErr()
+
+	return keys
+}
+
+// KeysErr returns a sorted slice of all of the keys, along with any error
+// encountered reading the tree.
+func (bs *BTreeStore) KeysErr() ([]string, error) {
+	keys := make([]string, 0)
+
+	err := bs.scan("", "", func(e btreeEntry) (bool, error) {
+		keys = append(keys, e.key)
+
+		return true, nil
+	})
+
+	return keys, err
+}
+
+// Exists returns true when the key exists within the store.
+func (bs *BTreeStore) Exists(key string) bool {
+	if bs.validateKeys(key) != nil {
+		return false
+	}
+
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	_, err := bs.lookup(key)
+
+	return err == nil
+}
+
+// Rename moves data from an existing key to a new, unused key.
+func (bs *BTreeStore) Rename(oldkey, newkey string) error {
+	if err := bs.validateKeys(oldkey, newkey); err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if _, err := bs.lookup(oldkey); err != nil {
+		return err
+	} else if _, err = bs.lookup(newkey); err == nil {
+		return ErrKeyExists
+	} else if !errors.Is(err, ErrUnknownKey) {
+		return err
+	}
+
+	tx := bs.begin()
+
+	e, err := tx.delete(oldkey)
+	if err == nil {
+		e.key = newkey
+		err = tx.insert(e)
+	}
+
+	if err != nil {
+		tx.rollback()
+
+		return err
+	}
+
+	return tx.commit()
+}
+
+// Scan calls fn, in key order, for each key that is no less than start and,
+// when end is not empty, less than end. Scanning stops when fn returns false.
+//
+// The value is only valid until fn returns, and fn must not call any methods
+// of the BTreeStore.
+func (bs *BTreeStore) Scan(start, end string, fn func(key string, value []byte) bool) error {
+	var buf memio.Buffer
+
+	return bs.scan(start, end, func(e btreeEntry) (bool, error) {
+		if e.page != 0 {
+			buf = buf[:0]
+
+			if _, err := buf.ReadFrom(bs.reader(e)); err != nil {
+				return false, fmt.Errorf("error reading value for key %q: %w", e.key, err)
+			}
+
+			return fn(e.key, buf), nil
+		}
+
+		return fn(e.key, e.value), nil
+	})
+}
+
+func (bs *BTreeStore) scan(start, end string, fn func(btreeEntry) (bool, error)) error {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	if bs.root == 0 {
+		return nil
+	}
+
+	_, err := bs.walk(bs.root, start, end, fn)
+
+	return err
+}
+
+func (bs *BTreeStore) walk(page uint64, start, end string, fn func(btreeEntry) (bool, error)) (bool, error) {
+	n, err := bs.readNode(page)
+	if err != nil {
+		return false, err
+	}
+
+	for i, e := range n.entries {
+		if n.leaf {
+			if e.key < start {
+				continue
+			} else if end != "" && e.key >= end {
+				return false, nil
+			}
+		} else if i+1 < len(n.entries) && n.entries[i+1].key <= start {
+			continue
+		} else if i > 0 && end != "" && e.key >= end {
+			return false, nil
+		}
+
+		var cont bool
+
+		if n.leaf {
+			cont, err = fn(e)
+		} else {
+			cont, err = bs.walk(e.page, start, end, fn)
+		}
+
+		if !cont || err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Close commits any outstanding changes and closes the file. Subsequent calls
+// return the result of the first.
+func (bs *BTreeStore) Close() error {
+	bs.closeOnce.Do(func() {
+		close(bs.done)
+		bs.wg.Wait()
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+
+		bs.closeErr = bs.flush()
+
+		if err := bs.f.Close(); bs.closeErr == nil {
+			bs.closeErr = err
+		}
+	})
+
+	return bs.closeErr
+}
@@ -0,0 +1,317 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestBTreeStore(t *testing.T) {
+	s, err := NewBTreeStore(filepath.Join(t.TempDir(), "btree"), SyncAlways)
+	if err != nil {
+		t.Errorf("received unexpected error creating BTreeStore: %s", err)
+		return
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func btreeValue(n int) string {
+	if n%50 == 0 {
+		return strings.Repeat(fmt.Sprintf("large%d;", n), 1000)
+	}
+	return fmt.Sprintf("value%d", n)
+}
+
+func checkBTree(t *testing.T, test int, s *BTreeStore, keys []string, values map[string]string) {
+	t.Helper()
+	if got, err := s.KeysErr(); err != nil {
+		t.Errorf("test %d: unexpected error: %s", test, err)
+	} else if !reflect.DeepEqual(got, keys) {
+		t.Errorf("test %d: expecting %d keys, got %d", test, len(keys), len(got))
+	}
+	for key, val := range values {
+		var buf memio.Buffer
+		if err := s.Get(key, &buf); err != nil {
+			t.Errorf("test %d: unexpected error getting %q: %s", test, key, err)
+		} else if string(buf) != val {
+			t.Errorf("test %d: incorrect value for key %q", test, key)
+		}
+	}
+}
+
+func TestBTreeStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btree")
+	s, err := NewBTreeStore(path, SyncNever)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	var keys []string
+	values := make(map[string]string)
+	for n := 0; n < 5000; n++ {
+		key := fmt.Sprintf("key%05d", n)
+		if n%100 == 0 {
+			key += strings.Repeat("k", MaxBTreeKeyLength-len(key))
+		}
+		keys = append(keys, key)
+		values[key] = btreeValue(n)
+	}
+	for n := range keys {
+		key := keys[(n*7919)%len(keys)]
+		if err = s.Set(key, data(values[key])); err != nil {
+			t.Errorf("test 1: unexpected error setting %q: %s", key, err)
+			return
+		}
+	}
+	checkBTree(t, 2, s, keys, values)
+	s.Close()
+	if s, err = NewBTreeStore(path, SyncNever); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+		return
+	}
+	checkBTree(t, 3, s, keys, values)
+	var remaining []string
+	for n, key := range keys {
+		if n%3 == 0 {
+			remaining = append(remaining, key)
+		} else if err = s.Remove(key); err != nil {
+			t.Errorf("test 4: unexpected error removing %q: %s", key, err)
+		} else {
+			delete(values, key)
+		}
+	}
+	checkBTree(t, 4, s, remaining, values)
+	fi, _ := os.Stat(path)
+	for _, key := range keys {
+		values[key] = btreeValue(len(key))
+		s.Set(key, data(values[key]))
+	}
+	s.Close()
+	if s, err = NewBTreeStore(path, SyncNever); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+		return
+	}
+	defer s.Close()
+	checkBTree(t, 5, s, keys, values)
+	if nfi, _ := os.Stat(path); nfi.Size() > fi.Size()*2 {
+		t.Errorf("test 6: expecting pages to be reused, file grew from %d to %d bytes", fi.Size(), nfi.Size())
+	}
+	for _, key := range keys {
+		s.Remove(key)
+	}
+	if got := s.Keys(); len(got) != 0 {
+		t.Errorf("test 7: expecting no keys, got %d", len(got))
+	} else if len(s.free) != int(s.pages-btreeMetaPages) {
+		t.Errorf("test 8: expecting all %d pages to be free, got %d", s.pages-btreeMetaPages, len(s.free))
+	}
+}
+
+func TestBTreeStoreScan(t *testing.T) {
+	s, err := NewBTreeStore(filepath.Join(t.TempDir(), "btree"), SyncNever)
+	if err != nil {
+		t.Errorf("received unexpected error creating BTreeStore: %s", err)
+		return
+	}
+	defer s.Close()
+	for n := 0; n < 1000; n++ {
+		s.Set(fmt.Sprintf("key%03d", n), data(btreeValue(n)))
+	}
+	for n, test := range [...]struct {
+		Start, End  string
+		Limit       int
+		First, Last int
+	}{
+		{"", "", -1, 0, 999},
+		{"key100", "key200", -1, 100, 199},
+		{"key0995", "", -1, 100, 999},
+		{"key500", "", 10, 500, 509},
+		{"a", "key000", -1, 0, -1},
+		{"key999", "", -1, 999, 999},
+		{"key9990", "", -1, 0, -1},
+	} {
+		var keys []string
+		err := s.Scan(test.Start, test.End, func(key string, value []byte) bool {
+			if string(value) != btreeValue(len(keys)+test.First) {
+				t.Errorf("test %d: incorrect value for key %q", n+1, key)
+			}
+			keys = append(keys, key)
+			return len(keys) != test.Limit
+		})
+		var expected []string
+		for i := test.First; i <= test.Last; i++ {
+			expected = append(expected, fmt.Sprintf("key%03d", i))
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("test %d: expecting keys %v, got %v", n+1, expected, keys)
+		}
+	}
+}
+
+func TestBTreeStoreRename(t *testing.T) {
+	s, err := NewBTreeStore(filepath.Join(t.TempDir(), "btree"), SyncAlways)
+	if err != nil {
+		t.Errorf("received unexpected error creating BTreeStore: %s", err)
+		return
+	}
+	defer s.Close()
+	large := btreeValue(0)
+	s.Set("a", data("small"))
+	s.Set("b", data(large))
+	var buf memio.Buffer
+	if err = s.Rename("a", "b"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("test 1: expecting ErrKeyExists, got %v", err)
+	} else if err = s.Rename("c", "d"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 2: expecting ErrUnknownKey, got %v", err)
+	} else if err = s.Rename("b", "c"); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if err = s.Get("c", &buf); err != nil || string(buf) != large {
+		t.Errorf("test 4: expecting large value, got %d bytes (%v)", len(buf), err)
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("test 5: expecting keys [a c], got %v", keys)
+	} else if err = s.Set(strings.Repeat("k", MaxBTreeKeyLength+1), data("")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("test 6: expecting ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestBTreeStoreMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btree")
+	s, err := NewBTreeStore(path, SyncAlways)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	s.Set("key1", data("value1"))
+	s.Set("key2", data("value2"))
+	latest := int64(s.txid % btreeMetaPages)
+	s.Close()
+	f, _ := os.OpenFile(path, os.O_RDWR, 0)
+	f.WriteAt([]byte("torn"), latest*btreePageSize+10)
+	f.Close()
+	if s, err = NewBTreeStore(path, SyncAlways); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+		return
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("test 3: expecting keys [key1], got %v", keys)
+	}
+	s.Set("key3", data("value3"))
+	s.Close()
+	if s, err = NewBTreeStore(path, SyncAlways); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+		return
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key3"}) {
+		t.Errorf("test 5: expecting keys [key1 key3], got %v", keys)
+	}
+	s.Close()
+	f, _ = os.OpenFile(path, os.O_RDWR, 0)
+	f.WriteAt([]byte("torn"), 10)
+	f.WriteAt([]byte("torn"), btreePageSize+10)
+	f.Close()
+	if _, err = NewBTreeStore(path, SyncAlways); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 6: expecting ErrCorrupt, got %v", err)
+	}
+}
+
+func TestBTreeStorePeriodic(t *testing.T) {
+	defer func(d time.Duration) { WALSyncInterval = d }(WALSyncInterval)
+	WALSyncInterval = time.Hour
+	path := filepath.Join(t.TempDir(), "btree")
+	s, err := NewBTreeStore(path, SyncPeriodic)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	txid := s.txid
+	for n := 0; n < 100; n++ {
+		s.Set(fmt.Sprintf("key%d", n), data(btreeValue(n)))
+	}
+	for n := 0; n < 100; n += 2 {
+		s.Remove(fmt.Sprintf("key%d", n))
+	}
+	if s.txid != txid {
+		t.Errorf("test 2: expecting no meta writes before flush")
+	} else if err = s.Close(); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if s, err = NewBTreeStore(path, SyncPeriodic); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+		return
+	}
+	defer s.Close()
+	if keys := s.Keys(); len(keys) != 50 {
+		t.Errorf("test 5: expecting 50 keys, got %d", len(keys))
+	}
+	for n := 1; n < 100; n += 2 {
+		var buf memio.Buffer
+		if err = s.Get(fmt.Sprintf("key%d", n), &buf); err != nil || string(buf) != btreeValue(n) {
+			t.Errorf("test 6: incorrect value for key%d (%v)", n, err)
+		}
+	}
+}
+
+func TestBTreeStoreRandom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btree")
+	s, err := NewBTreeStore(path, SyncNever)
+	if err != nil {
+		t.Errorf("received unexpected error creating BTreeStore: %s", err)
+		return
+	}
+	ms := NewMemStore()
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 20000; n++ {
+		key, newkey := fmt.Sprintf("key%d", r.Intn(2000)), fmt.Sprintf("key%d", r.Intn(2000))
+		if r.Intn(10) == 0 {
+			key += strings.Repeat("k", r.Intn(MaxBTreeKeyLength-len(key)))
+		}
+		var errA, errB error
+		switch r.Intn(4) {
+		case 0, 1:
+			value := strings.Repeat("v", r.Intn(2000))
+			errA, errB = s.Set(key, data(value)), ms.Set(key, data(value))
+		case 2:
+			errA, errB = s.Remove(key), ms.Remove(key)
+		case 3:
+			errA, errB = s.Rename(key, newkey), ms.Rename(key, newkey)
+		}
+		if errA != errB {
+			t.Errorf("test 1: operation %d: expecting error %v, got %v", n, errB, errA)
+			return
+		}
+	}
+	s.Close()
+	if s, err = NewBTreeStore(path, SyncNever); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+		return
+	}
+	defer s.Close()
+	values := make(map[string]string)
+	for _, key := range ms.Keys() {
+		var buf memio.Buffer
+		ms.Get(key, &buf)
+		values[key] = string(buf)
+	}
+	checkBTree(t, 3, s, ms.Keys(), values)
+}
+
+func TestBTreeStoreClose(t *testing.T) {
+	s, err := NewBTreeStore(filepath.Join(t.TempDir(), "btree"), SyncPeriodic)
+	if err != nil {
+		t.Errorf("received unexpected error creating BTreeStore: %s", err)
+		return
+	}
+	s.Set("key", data("value"))
+	if err = s.Close(); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = s.Close(); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	}
+}
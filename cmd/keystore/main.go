@@ -0,0 +1,529 @@
+// Command keystore inspects and edits keystore FileStore directories and
+// MemStore snapshots.
+package main // import "vimagination.zapto.org/keystore/cmd/keystore"
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"vimagination.zapto.org/keystore"
+	"vimagination.zapto.org/memio"
+)
+
+const usage = `usage: keystore (-dir path | -snapshot file) [options] command [arguments]
+
+Commands:
+  ls [prefix]          list keys, optionally only those with the given prefix
+  get key              write the value of key to stdout
+  put key [file]       set the value of key from file, or stdin
+  rm key...            remove keys
+  mv oldkey newkey     rename a key
+  stat key             show information about a key
+  export [file]        write all keys to file, or stdout, in the archive format
+  import [file]        read keys from file, or stdin, in the archive format
+  verify               check the store for problems, optionally repairing them
+
+Options:
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid usage")
+
+type store interface {
+	keystore.Store
+	Exists(string) bool
+}
+
+type options struct {
+	dir, tmp, snapshot, mangler, encoding string
+	format, conflict                      string
+	checksums, repair                     bool
+	m                                     keystore.Mangler
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	var o options
+
+	fs := flag.NewFlagSet("keystore", flag.ContinueOnError)
+
+	fs.SetOutput(stdout)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.dir, "dir", "", "FileStore base directory")
+	fs.StringVar(&o.tmp, "tmp", "", "FileStore temporary directory")
+	fs.StringVar(&o.snapshot, "snapshot", "", "MemStore snapshot file")
+	fs.StringVar(&o.mangler, "mangler", "base64", "FileStore key mangler (base64, none)")
+	fs.BoolVar(&o.checksums, "checksums", false, "write and verify FileStore value checksums")
+	fs.BoolVar(&o.repair, "repair", false, "repair problems found by verify")
+	fs.StringVar(&o.format, "format", "native", "archive format for export and import (native, tar, jsonl)")
+	fs.StringVar(&o.conflict, "conflict", "overwrite", "import policy for existing keys (overwrite, skip, error)")
+	fs.StringVar(&o.encoding, "encoding", "raw", "value encoding (raw, hex, string, uint8, uint16, uint32, uint64, uint, int8, int16, int32, int64, int, float32, float64)")
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	args = fs.Args()
+
+	if len(args) == 0 || (o.dir == "") == (o.snapshot == "") {
+		fs.Usage()
+
+		return errUsage
+	}
+
+	if _, ok := encodings[o.encoding]; !ok {
+		return fmt.Errorf("%w: unknown encoding %q", errUsage, o.encoding)
+	} else if _, ok = formats[o.format]; !ok {
+		return fmt.Errorf("%w: unknown format %q", errUsage, o.format)
+	} else if _, ok = conflictPolicies[o.conflict]; !ok {
+		return fmt.Errorf("%w: unknown conflict policy %q", errUsage, o.conflict)
+	}
+
+	s, save, err := o.open()
+	if err != nil {
+		return err
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok || len(args)-1 < cmd.min || cmd.max >= 0 && len(args)-1 > cmd.max {
+		fs.Usage()
+
+		return errUsage
+	}
+
+	if err = cmd.fn(&o, s, args[1:], stdin, stdout); err != nil {
+		return err
+	}
+
+	if cmd.modifies && save != nil {
+		return save()
+	}
+
+	return nil
+}
+
+func (o *options) open() (store, func() error, error) {
+	if o.snapshot != "" {
+		ms := keystore.NewMemStore()
+
+		f, err := os.Open(o.snapshot)
+		if err == nil {
+			_, err = ms.ReadFrom(bufio.NewReader(f))
+
+			f.Close()
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("error reading snapshot: %w", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("error opening snapshot: %w", err)
+		}
+
+		return ms, func() error { return saveSnapshot(o.snapshot, ms) }, nil
+	}
+
+	switch o.mangler {
+	case "base64":
+		o.m = keystore.Base64Mangler
+	case "none":
+		o.m = keystore.NoMangle
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown mangler %q", errUsage, o.mangler)
+	}
+
+	fs, err := keystore.NewFileStore(o.dir, o.tmp, o.m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fs.SetChecksums(o.checksums)
+
+	return fs, nil, nil
+}
+
+func saveSnapshot(path string, ms *keystore.MemStore) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".keystore")
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+
+	bw := bufio.NewWriter(f)
+
+	if _, err = ms.WriteTo(bw); err == nil {
+		err = bw.Flush()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+
+	return nil
+}
+
+type command struct {
+	fn       func(*options, store, []string, io.Reader, io.Writer) error
+	min, max int
+	modifies bool
+}
+
+var commands = map[string]command{
+	"ls":     {fn: ls, max: 1},
+	"get":    {fn: get, min: 1, max: 1},
+	"put":    {fn: put, min: 1, max: 2, modifies: true},
+	"rm":     {fn: rm, min: 1, max: -1, modifies: true},
+	"mv":     {fn: mv, min: 2, max: 2, modifies: true},
+	"stat":   {fn: stat, min: 1, max: 1},
+	"export": {fn: export, max: 1},
+	"import": {fn: importStore, max: 1, modifies: true},
+	"verify": {fn: verify},
+}
+
+func ls(_ *options, s store, args []string, _ io.Reader, stdout io.Writer) error {
+	var prefix string
+
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+
+	keys, err := keystore.KeysErr(s)
+
+	var undecodable *keystore.UndecodableError
+
+	if err != nil && !errors.As(err, &undecodable) {
+		return err
+	}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			fmt.Fprintln(stdout, key)
+		}
+	}
+
+	return nil
+}
+
+func get(o *options, s store, args []string, _ io.Reader, stdout io.Writer) error {
+	var buf memio.Buffer
+
+	if err := s.Get(args[0], &buf); err != nil {
+		return fmt.Errorf("error getting %q: %w", args[0], err)
+	}
+
+	return encodings[o.encoding].encode(stdout, buf)
+}
+
+func put(o *options, s store, args []string, stdin io.Reader, _ io.Writer) error {
+	r := stdin
+
+	if len(args) > 1 && args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return fmt.Errorf("error opening input: %w", err)
+		}
+
+		defer f.Close()
+
+		r = f
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading input: %w", err)
+	}
+
+	w, err := encodings[o.encoding].decode(data)
+	if err != nil {
+		return fmt.Errorf("error decoding input: %w", err)
+	}
+
+	if err = s.Set(args[0], w); err != nil {
+		return fmt.Errorf("error setting %q: %w", args[0], err)
+	}
+
+	return nil
+}
+
+func rm(_ *options, s store, args []string, _ io.Reader, _ io.Writer) error {
+	for _, key := range args {
+		if err := s.Remove(key); err != nil {
+			return fmt.Errorf("error removing %q: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func mv(_ *options, s store, args []string, _ io.Reader, _ io.Writer) error {
+	if !s.Exists(args[0]) {
+		return fmt.Errorf("error renaming %q: %w", args[0], keystore.ErrUnknownKey)
+	} else if s.Exists(args[1]) {
+		return fmt.Errorf("error renaming %q: %w", args[0], keystore.ErrKeyExists)
+	} else if err := s.Rename(args[0], args[1]); err != nil {
+		return fmt.Errorf("error renaming %q: %w", args[0], err)
+	}
+
+	return nil
+}
+
+func stat(_ *options, s store, args []string, _ io.Reader, stdout io.Writer) error {
+	if fs, ok := s.(*keystore.FileStore); ok {
+		fi, err := fs.Stat(args[0])
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = keystore.ErrUnknownKey
+			}
+
+			return fmt.Errorf("error getting %q: %w", args[0], err)
+		}
+
+		fmt.Fprintf(stdout, "Key: %s\nFile: %s\nSize: %d\nMode: %s\nModified: %s\n", args[0], fi.Name(), fi.Size(), fi.Mode(), fi.ModTime())
+
+		return nil
+	}
+
+	var buf memio.Buffer
+
+	if err := s.Get(args[0], &buf); err != nil {
+		return fmt.Errorf("error getting %q: %w", args[0], err)
+	}
+
+	fmt.Fprintf(stdout, "Key: %s\nSize: %d\n", args[0], len(buf))
+
+	return nil
+}
+
+var formats = map[string]keystore.Format{
+	"native": keystore.FormatNative,
+	"tar":    keystore.FormatTar,
+	"jsonl":  keystore.FormatJSONLines,
+}
+
+var conflictPolicies = map[string]keystore.ConflictPolicy{
+	"overwrite": keystore.ConflictOverwrite,
+	"skip":      keystore.ConflictSkip,
+	"error":     keystore.ConflictError,
+}
+
+func export(o *options, s store, args []string, _ io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] == "-" {
+		return keystore.Export(s, stdout, formats[o.format])
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(args[0]), ".keystore")
+	if err != nil {
+		return fmt.Errorf("error creating output: %w", err)
+	}
+
+	err = keystore.Export(s, f, formats[o.format])
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), args[0])
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+
+		return fmt.Errorf("error writing output: %w", err)
+	}
+
+	return nil
+}
+
+func importStore(o *options, s store, args []string, stdin io.Reader, _ io.Writer) error {
+	r := stdin
+
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("error opening input: %w", err)
+		}
+
+		defer f.Close()
+
+		r = f
+	}
+
+	return keystore.Import(s, r, formats[o.format], conflictPolicies[o.conflict])
+}
+
+func verify(o *options, s store, _ []string, _ io.Reader, stdout io.Writer) error {
+	var problems int
+
+	if fs, ok := s.(*keystore.FileStore); ok {
+		found, err := fs.Fsck(o.repair)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range found {
+			if p.Repaired {
+				fmt.Fprintf(stdout, "%s (repaired)\n", p)
+			} else {
+				problems++
+
+				fmt.Fprintln(stdout, p)
+			}
+		}
+	}
+
+	keys, err := keystore.KeysErr(s)
+
+	var undecodable *keystore.UndecodableError
+
+	if err != nil && !errors.As(err, &undecodable) {
+		return err
+	}
+
+	for _, key := range keys {
+		var buf memio.Buffer
+
+		if err := s.Get(key, &buf); err != nil {
+			problems++
+
+			fmt.Fprintf(stdout, "%q: %s\n", key, err)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problem(s)", problems)
+	}
+
+	return nil
+}
+
+type encoding struct {
+	encode func(io.Writer, memio.Buffer) error
+	decode func([]byte) (io.WriterTo, error)
+}
+
+func typed(prototype io.ReaderFrom) encoding {
+	t := reflect.TypeOf(prototype).Elem()
+
+	return encoding{
+		encode: func(w io.Writer, buf memio.Buffer) error {
+			v := reflect.New(t)
+
+			if _, err := v.Interface().(io.ReaderFrom).ReadFrom(&buf); err != nil {
+				return err
+			}
+
+			_, err := fmt.Fprintln(w, v.Elem().Interface())
+
+			return err
+		},
+		decode: func(data []byte) (io.WriterTo, error) {
+			s := strings.TrimSpace(string(data))
+			v := reflect.New(t)
+			e := v.Elem()
+
+			switch e.Kind() {
+			case reflect.String:
+				e.SetString(s)
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				n, err := strconv.ParseUint(s, 0, t.Bits())
+				if err != nil {
+					return nil, err
+				}
+
+				e.SetUint(n)
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				n, err := strconv.ParseInt(s, 0, t.Bits())
+				if err != nil {
+					return nil, err
+				}
+
+				e.SetInt(n)
+			case reflect.Float32, reflect.Float64:
+				n, err := strconv.ParseFloat(s, t.Bits())
+				if err != nil {
+					return nil, err
+				}
+
+				e.SetFloat(n)
+			}
+
+			return v.Interface().(io.WriterTo), nil
+		},
+	}
+}
+
+var encodings = map[string]encoding{
+	"raw": {
+		encode: func(w io.Writer, buf memio.Buffer) error {
+			_, err := w.Write(buf)
+
+			return err
+		},
+		decode: func(data []byte) (io.WriterTo, error) {
+			buf := memio.Buffer(data)
+
+			return &buf, nil
+		},
+	},
+	"hex": {
+		encode: func(w io.Writer, buf memio.Buffer) error {
+			_, err := fmt.Fprintln(w, hex.EncodeToString(buf))
+
+			return err
+		},
+		decode: func(data []byte) (io.WriterTo, error) {
+			b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil {
+				return nil, err
+			}
+
+			buf := memio.Buffer(b)
+
+			return &buf, nil
+		},
+	},
+	"string":  typed(new(keystore.String)),
+	"uint8":   typed(new(keystore.Uint8)),
+	"uint16":  typed(new(keystore.Uint16)),
+	"uint32":  typed(new(keystore.Uint32)),
+	"uint64":  typed(new(keystore.Uint64)),
+	"uint":    typed(new(keystore.Uint)),
+	"int8":    typed(new(keystore.Int8)),
+	"int16":   typed(new(keystore.Int16)),
+	"int32":   typed(new(keystore.Int32)),
+	"int64":   typed(new(keystore.Int64)),
+	"int":     typed(new(keystore.Int)),
+	"float32": typed(new(keystore.Float32)),
+	"float64": typed(new(keystore.Float64)),
+}
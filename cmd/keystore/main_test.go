@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runString(args []string, stdin string) (string, error) {
+	var out strings.Builder
+	err := run(args, strings.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	for n, test := range [...]struct {
+		Args          []string
+		Stdin, Output string
+		Err           bool
+	}{
+		{Args: []string{"-dir", dir, "put", "a", "-"}, Stdin: "hello"},
+		{Args: []string{"-dir", dir, "-encoding", "uint16", "put", "b"}, Stdin: "513\n"},
+		{Args: []string{"-dir", dir, "-encoding", "string", "put", "c/d"}, Stdin: "Hello, World!"},
+		{Args: []string{"-dir", dir, "ls"}, Output: "a\nb\nc/d\n"},
+		{Args: []string{"-dir", dir, "ls", "c"}, Output: "c/d\n"},
+		{Args: []string{"-dir", dir, "get", "a"}, Output: "hello"},
+		{Args: []string{"-dir", dir, "-encoding", "hex", "get", "b"}, Output: "0102\n"},
+		{Args: []string{"-dir", dir, "-encoding", "uint16", "get", "b"}, Output: "513\n"},
+		{Args: []string{"-dir", dir, "-encoding", "string", "get", "c/d"}, Output: "Hello, World!\n"},
+		{Args: []string{"-dir", dir, "mv", "a", "b"}, Err: true},
+		{Args: []string{"-dir", dir, "mv", "a", "e"}},
+		{Args: []string{"-dir", dir, "rm", "b"}},
+		{Args: []string{"-dir", dir, "get", "b"}, Err: true},
+		{Args: []string{"-dir", dir, "export", snapshot}},
+		{Args: []string{"-snapshot", snapshot, "ls"}, Output: "c/d\ne\n"},
+		{Args: []string{"-snapshot", snapshot, "stat", "e"}, Output: "Key: e\nSize: 5\n"},
+		{Args: []string{"-snapshot", snapshot, "rm", "e"}},
+		{Args: []string{"-snapshot", snapshot, "ls"}, Output: "c/d\n"},
+		{Args: []string{"-dir", dir, "-format", "jsonl", "export"}, Output: "{\"key\":\"c/d\",\"value\":\"DUhlbGxvLCBXb3JsZCE=\"}\n{\"key\":\"e\",\"value\":\"aGVsbG8=\"}\n"},
+		{Args: []string{"-snapshot", snapshot, "-format", "jsonl", "-conflict", "skip", "import"}, Stdin: "{\"key\":\"c/d\",\"value\":\"\"}\n{\"key\":\"f\",\"value\":\"aGVsbG8=\"}\n"},
+		{Args: []string{"-snapshot", snapshot, "ls"}, Output: "c/d\nf\n"},
+		{Args: []string{"-snapshot", snapshot, "-encoding", "string", "get", "c/d"}, Output: "Hello, World!\n"},
+		{Args: []string{"-dir", dir, "verify"}},
+		{Args: []string{"-dir", dir, "get"}, Err: true},
+		{Args: []string{"ls"}, Err: true},
+	} {
+		out, err := runString(test.Args, test.Stdin)
+		if test.Err {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got none", n+1)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if out != test.Output {
+			t.Errorf("test %d: expecting output %q, got %q", n+1, test.Output, out)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "!!!"), nil, 0o600)
+	if _, err := runString([]string{"-dir", dir, "verify"}, ""); err == nil {
+		t.Errorf("expecting verify error, got none")
+	}
+}
@@ -0,0 +1,276 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"vimagination.zapto.org/memio"
+)
+
+// DedupStore is a Store that keeps each distinct value only once, in a
+// content-addressed Store keyed by its SHA-256 hash, with each key referring
+// to the hash of its value.
+//
+// Values are reference counted, and removed once no key refers to them.
+type DedupStore struct {
+	mu     sync.RWMutex
+	refs   Store
+	blobs  Store
+	hashes map[string]string
+	counts map[string]int
+}
+
+// NewDedupStore creates a DedupStore that keeps the hash for each key in the
+// refs Store, and the values in the blobs Store. Neither Store should be used
+// for anything else.
+//
+// Any existing references are loaded from the refs Store.
+func NewDedupStore(refs, blobs Store) (*DedupStore, error) {
+	keys, err := KeysErr(refs)
+	if err != nil {
+		return nil, fmt.Errorf("error reading references: %w", err)
+	}
+
+	ds := &DedupStore{
+		refs:   refs,
+		blobs:  blobs,
+		hashes: make(map[string]string, len(keys)),
+		counts: make(map[string]int),
+	}
+
+	for _, key := range keys {
+		buf := make(memio.Buffer, 0, sha256.Size*2)
+
+		if err := refs.Get(key, &buf); err != nil {
+			return nil, fmt.Errorf("error reading reference: %w", err)
+		} else if _, err := hex.DecodeString(string(buf)); err != nil || len(buf) != sha256.Size*2 {
+			return nil, fmt.Errorf("%w: invalid reference for key %q", ErrCorrupt, key)
+		}
+
+		ds.hashes[key] = string(buf)
+		ds.counts[string(buf)]++
+	}
+
+	return ds, nil
+}
+
+func blobKey(hash string) string {
+	return hash[:2] + "/" + hash[2:]
+}
+
+// Get retrieves the value for the key.
+func (ds *DedupStore) Get(key string, r io.ReaderFrom) error {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	hash, ok := ds.hashes[key]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	if err := ds.blobs.Get(blobKey(hash), r); errors.Is(err, ErrUnknownKey) {
+		return fmt.Errorf("%w: missing value for key %q", ErrCorrupt, key)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Set stores the value for the key, only storing the data if no other key
+// has the same value.
+func (ds *DedupStore) Set(key string, w io.WriterTo) error {
+	buf := make(memio.Buffer, 0)
+
+	if _, err := w.WriteTo(&buf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	sum := sha256.Sum256(buf)
+	hash := hex.EncodeToString(sum[:])
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.counts[hash] == 0 {
+		if err := ds.blobs.Set(blobKey(hash), &buf); err != nil {
+			return fmt.Errorf("error storing value: %w", err)
+		}
+	}
+
+	return ds.setRef(key, hash)
+}
+
+func (ds *DedupStore) setRef(key, hash string) error {
+	old, ok := ds.hashes[key]
+	if ok && old == hash {
+		return nil
+	}
+
+	ref := memio.Buffer(hash)
+
+	if err := ds.refs.Set(key, &ref); err != nil {
+		if ds.counts[hash] == 0 {
+			ds.blobs.Remove(blobKey(hash))
+		}
+
+		return err
+	}
+
+	ds.hashes[key] = hash
+	ds.counts[hash]++
+
+	if ok {
+		return ds.release(old)
+	}
+
+	return nil
+}
+
+func (ds *DedupStore) release(hash string) error {
+	if ds.counts[hash]--; ds.counts[hash] > 0 {
+		return nil
+	}
+
+	delete(ds.counts, hash)
+
+	if err := ds.blobs.Remove(blobKey(hash)); err != nil && !errors.Is(err, ErrUnknownKey) {
+		return fmt.Errorf("error removing value: %w", err)
+	}
+
+	return nil
+}
+
+// Remove deletes the key, removing its value if no other key refers to it.
+func (ds *DedupStore) Remove(key string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	hash, ok := ds.hashes[key]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	if err := ds.refs.Remove(key); err != nil {
+		return err
+	}
+
+	delete(ds.hashes, key)
+
+	return ds.release(hash)
+}
+
+// Keys returns a sorted slice of all of the keys in the store.
+func (ds *DedupStore) Keys() []string {
+	keys, _ := ds.KeysErr()
+
+	return keys
+}
+
+// KeysErr returns a sorted slice of all of the keys in the store, along with
+// any error encountered retrieving them.
+func (ds *DedupStore) KeysErr() ([]string, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	return KeysErr(ds.refs)
+}
+
+// Exists returns true when the key exists within the store.
+func (ds *DedupStore) Exists(key string) bool {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	_, ok := ds.hashes[key]
+
+	return ok
+}
+
+// Rename moves the value from an existing key to a new key, replacing any
+// value at the new key.
+func (ds *DedupStore) Rename(oldkey, newkey string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	hash, ok := ds.hashes[oldkey]
+	if !ok {
+		return ErrUnknownKey
+	} else if oldkey == newkey {
+		return nil
+	}
+
+	replaced, exists := ds.hashes[newkey]
+
+	if err := ds.refs.Rename(oldkey, newkey); err != nil {
+		return err
+	}
+
+	delete(ds.hashes, oldkey)
+
+	ds.hashes[newkey] = hash
+
+	if !exists {
+		return nil
+	} else if replaced == hash {
+		ds.counts[hash]--
+
+		return nil
+	}
+
+	return ds.release(replaced)
+}
+
+// Copy sets the new key to the same value as the existing key, without
+// copying the data.
+func (ds *DedupStore) Copy(oldkey, newkey string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	hash, ok := ds.hashes[oldkey]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	return ds.setRef(newkey, hash)
+}
+
+// Hash returns the hex encoded SHA-256 hash of the value of the key.
+func (ds *DedupStore) Hash(key string) (string, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	hash, ok := ds.hashes[key]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	return hash, nil
+}
+
+// GC removes any stored values that are not referred to by any key, such as
+// those left behind by an interrupted Set or Remove.
+func (ds *DedupStore) GC() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	keys, err := KeysErr(ds.blobs)
+	if err != nil {
+		return fmt.Errorf("error reading values: %w", err)
+	}
+
+	for _, key := range keys {
+		if len(key) == sha256.Size*2+1 && key[2] == '/' && ds.counts[key[:2]+key[3:]] > 0 {
+			continue
+		}
+
+		if err := ds.blobs.Remove(key); err != nil && !errors.Is(err, ErrUnknownKey) {
+			return fmt.Errorf("error removing value: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package keystore
+
+import (
+	"errors"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestDedupStore(t *testing.T) {
+	ds, err := NewDedupStore(NewMemStore(), NewMemStore())
+	if err != nil {
+		t.Errorf("received unexpected error creating DedupStore: %s", err)
+		return
+	}
+	testStore(t, ds)
+}
+
+func TestDedupStoreRefCount(t *testing.T) {
+	refs, err := NewFileStore(t.TempDir(), "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	blobs, err := NewFileStore(t.TempDir(), "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	ds, err := NewDedupStore(refs, blobs)
+	if err != nil {
+		t.Errorf("received unexpected error creating DedupStore: %s", err)
+		return
+	}
+	var buf memio.Buffer
+	ds.Set("a", data("shared"))
+	ds.Set("b", data("shared"))
+	ds.Set("c", data("unique"))
+	if n := len(blobs.Keys()); n != 2 {
+		t.Errorf("test 1: expecting 2 values, got %d", n)
+	} else if err = ds.Copy("c", "d"); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if err = ds.Get("d", &buf); err != nil || string(buf) != "unique" {
+		t.Errorf("test 3: expecting value %q, got %q (%v)", "unique", buf, err)
+	} else if err = ds.Copy("missing", "e"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 4: expecting ErrUnknownKey, got %v", err)
+	} else if ha, _ := ds.Hash("a"); ha == "" {
+		t.Errorf("test 5: expecting hash for key")
+	} else if hb, _ := ds.Hash("b"); ha != hb {
+		t.Errorf("test 5: expecting equal hashes, got %q and %q", ha, hb)
+	} else if ds.Remove("a"); len(blobs.Keys()) != 2 {
+		t.Errorf("test 6: expecting 2 values, got %d", len(blobs.Keys()))
+	} else if ds.Set("b", data("unique")); len(blobs.Keys()) != 1 {
+		t.Errorf("test 7: expecting 1 value, got %d", len(blobs.Keys()))
+	} else if ds.Rename("b", "c"); len(blobs.Keys()) != 1 {
+		t.Errorf("test 8: expecting 1 value, got %d", len(blobs.Keys()))
+	}
+	blobs.Set("00/orphan", data("orphan"))
+	reopened, err := NewDedupStore(refs, blobs)
+	if err != nil {
+		t.Errorf("test 9: unexpected error: %s", err)
+		return
+	} else if keys := reopened.Keys(); len(keys) != 2 || keys[0] != "c" || keys[1] != "d" {
+		t.Errorf("test 9: expecting keys [c d], got %v", keys)
+	} else if err = reopened.GC(); err != nil {
+		t.Errorf("test 10: unexpected error: %s", err)
+	} else if n := len(blobs.Keys()); n != 1 {
+		t.Errorf("test 10: expecting 1 value, got %d", n)
+	} else if reopened.Remove("c"); len(blobs.Keys()) != 1 {
+		t.Errorf("test 11: expecting 1 value, got %d", len(blobs.Keys()))
+	} else if reopened.Remove("d"); len(blobs.Keys()) != 0 {
+		t.Errorf("test 12: expecting no values, got %d", len(blobs.Keys()))
+	}
+	buf = buf[:0]
+	if reopened.Set("e", data("value")); reopened.Rename("e", "e") != nil {
+		t.Errorf("test 13: unexpected error renaming key to itself")
+	} else if n := len(blobs.Keys()); n != 1 {
+		t.Errorf("test 13: expecting 1 value, got %d", n)
+	} else if err = reopened.Get("e", &buf); err != nil || string(buf) != "value" {
+		t.Errorf("test 13: expecting value %q, got %q (%v)", "value", buf, err)
+	} else if reopened.Remove("e"); len(blobs.Keys()) != 0 {
+		t.Errorf("test 13: expecting no values, got %d", len(blobs.Keys()))
+	}
+	refs.Set("bad", data("not a hash"))
+	if _, err = NewDedupStore(refs, blobs); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 14: expecting ErrCorrupt, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package keystore
+
+import (
+	"expvar"
+	"time"
+)
+
+// ExpvarRecorder is a Recorder that adds its measurements to an expvar.Map.
+type ExpvarRecorder struct {
+	m *expvar.Map
+}
+
+// NewExpvarRecorder creates a Recorder that adds its measurements to the given
+// expvar.Map, which will usually be created with expvar.NewMap.
+//
+// For each operation, such as get, the following values are recorded:
+//
+//	get.count
+//	get.bytes
+//	get.nanoseconds
+//	get.errors
+//	get.errors.<kind>
+//
+// ...where <kind> is the result of ErrorKind.
+func NewExpvarRecorder(m *expvar.Map) *ExpvarRecorder {
+	return &ExpvarRecorder{m: m}
+}
+
+// Record implements the Recorder interface.
+func (e *ExpvarRecorder) Record(op Operation, duration time.Duration, bytes int64, err error) {
+	name := op.String()
+
+	e.m.Add(name+".count", 1)
+	e.m.Add(name+".bytes", bytes)
+	e.m.Add(name+".nanoseconds", int64(duration))
+
+	if err != nil {
+		e.m.Add(name+".errors", 1)
+		e.m.Add(name+".errors."+ErrorKind(err), 1)
+	}
+}
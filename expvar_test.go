@@ -0,0 +1,39 @@
+package keystore
+
+import (
+	"expvar"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestExpvarRecorder(t *testing.T) {
+	m := new(expvar.Map).Init()
+	s := Instrumented(NewMemStore(), NewExpvarRecorder(m))
+	var buf memio.Buffer
+	s.Set("key", data("Hello"))
+	s.Get("key", &buf)
+	s.Get("missing", &buf)
+	for n, test := range [...]struct {
+		Name  string
+		Value string
+	}{
+		{"set.count", "1"},
+		{"set.bytes", "5"},
+		{"get.count", "2"},
+		{"get.bytes", "5"},
+		{"get.errors", "1"},
+		{"get.errors.unknown_key", "1"},
+	} {
+		if v := m.Get(test.Name); v == nil {
+			t.Errorf("test %d: expecting value for %q", n+1, test.Name)
+		} else if v.String() != test.Value {
+			t.Errorf("test %d: expecting %q to be %s, got %s", n+1, test.Name, test.Value, v)
+		}
+	}
+	if m.Get("set.errors") != nil {
+		t.Errorf("expecting no set errors")
+	} else if m.Get("get.nanoseconds") == nil {
+		t.Errorf("expecting get latency")
+	}
+}
@@ -3,16 +3,33 @@ package keystore
 import (
 	"errors"
 	"io"
+	"sync/atomic"
 
 	"vimagination.zapto.org/memio"
 )
 
 // FileBackedMemStore combines both a FileStore and a MemStore.
 type FileBackedMemStore struct {
+	hits, misses uint64
+
 	FileStore
 	memStore MemStore
 }
 
+// CacheStats contains the number of Gets on a FileBackedMemStore that were
+// served from memory, and the number that went to the filesystem.
+type CacheStats struct {
+	Hits, Misses uint64
+}
+
+// CacheStats returns the cache hit and miss counts of the store.
+func (fs *FileBackedMemStore) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&fs.hits),
+		Misses: atomic.LoadUint64(&fs.misses),
+	}
+}
+
 // NewFileBackedMemStore create a new Store which uses the filesystem for
 // permanent storage, but uses memory for caching.
 func NewFileBackedMemStore(baseDir, tmpDir string, mangler Mangler) (*FileBackedMemStore, error) {
@@ -44,6 +61,8 @@ func NewFileBackedMemStoreFromFileStore(filestore *FileStore) *FileBackedMemStor
 func (fs *FileBackedMemStore) Get(key string, r io.ReaderFrom) error {
 	err := fs.memStore.Get(key, r)
 	if errors.Is(err, ErrUnknownKey) {
+		atomic.AddUint64(&fs.misses, 1)
+
 		var buf memio.Buffer
 
 		if err = fs.FileStore.Get(key, &buf); err == nil {
@@ -51,6 +70,8 @@ func (fs *FileBackedMemStore) Get(key string, r io.ReaderFrom) error {
 
 			_, err = r.ReadFrom(&buf)
 		}
+	} else {
+		atomic.AddUint64(&fs.hits, 1)
 	}
 
 	return err
@@ -60,7 +81,9 @@ func (fs *FileBackedMemStore) Get(key string, r io.ReaderFrom) error {
 func (fs *FileBackedMemStore) Set(key string, w io.WriterTo) error {
 	var buf memio.Buffer
 
-	_, err := w.WriteTo(&buf)
+	res := reservation{limit: fs.quota.valueLimit()}
+
+	_, err := w.WriteTo(fs.quota.writer(&buf, res))
 	if err != nil && !errors.Is(err, io.EOF) {
 		return err
 	}
@@ -103,7 +126,8 @@ func (fs *FileBackedMemStore) Clear(keys ...string) {
 	fs.memStore.mu.Unlock()
 }
 
-// Rename moves data from an existing key to a new, unused key.
+// Rename moves data from an existing key to a new key, replacing any existing
+// data at the new key.
 func (fs *FileBackedMemStore) Rename(oldkey, newkey string) error {
 	fs.memStore.mu.Lock()
 
@@ -114,6 +138,7 @@ func (fs *FileBackedMemStore) Rename(oldkey, newkey string) error {
 	}
 
 	delete(fs.memStore.data, oldkey)
+	delete(fs.memStore.data, newkey)
 	fs.memStore.mu.Unlock()
 
 	return nil
@@ -21,3 +21,21 @@ func TestFileMemStoreWithTmp(t *testing.T) {
 	}
 	testStore(t, s)
 }
+
+func TestFileMemStoreCacheStats(t *testing.T) {
+	s, err := NewFileBackedMemStore(t.TempDir(), "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	var str String
+	s.Set("key", String("value"))
+	s.Get("key", &str)
+	s.Clear()
+	s.Get("key", &str)
+	s.Get("key", &str)
+	s.Get("missing", &str)
+	if stats := s.CacheStats(); stats != (CacheStats{Hits: 2, Misses: 2}) {
+		t.Errorf("expecting 2 hits and 2 misses, got %+v", stats)
+	}
+}
@@ -9,12 +9,21 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+
+	"vimagination.zapto.org/memio"
 )
 
 // FileStore implements the Store interface and provides a file backed keystore.
 type FileStore struct {
 	baseDir, tmpDir string
+	rootDir         string
 	mangler         Mangler
+	quota           *quota
+	mu, dirMu       *sync.RWMutex
+	checksums       bool
+	mmapThreshold   int64
+	validator       KeyValidator
 }
 
 // NewFileStore creates a file backed key-value store.
@@ -43,18 +52,24 @@ func (fs *FileStore) init(baseDir, tmpDir string, mangler Mangler) error {
 		}
 	}
 
-	fs.baseDir = baseDir
+	fs.baseDir = filepath.Clean(baseDir)
+	fs.rootDir = fs.baseDir
 	fs.tmpDir = tmpDir
 	fs.mangler = mangler
+	fs.quota = new(quota)
+	fs.mu = new(sync.RWMutex)
+	fs.dirMu = new(sync.RWMutex)
 
 	return nil
 }
 
 // Get retrieves the key data from the filesystem.
 func (fs *FileStore) Get(key string, r io.ReaderFrom) error {
-	key = fs.mangleKey(key, false)
+	if err := fs.validateKeys(key); err != nil {
+		return err
+	}
 
-	f, err := os.Open(filepath.Join(fs.baseDir, key))
+	f, err := os.Open(filepath.Join(fs.baseDir, fs.mangleKey(key)))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return ErrUnknownKey
@@ -63,130 +78,370 @@ func (fs *FileStore) Get(key string, r io.ReaderFrom) error {
 		return fmt.Errorf("error opening key file: %w", err)
 	}
 
-	_, err = r.ReadFrom(f)
+	defer f.Close()
 
-	f.Close()
+	if data, ok := fs.mmap(f); ok {
+		defer munmapFile(data)
+
+		return readMapped(data, func(data []byte) error {
+			if fs.checksums {
+				if data, err = checksumData(data); err != nil {
+					return err
+				}
+			}
+
+			buf := memio.Buffer(data)
+
+			_, err = r.ReadFrom(&buf)
+
+			return err
+		})
+	}
+
+	if fs.checksums {
+		if err = verifyChecksum(f); err != nil {
+			return err
+		}
+	}
+
+	_, err = r.ReadFrom(f)
 
 	return err
 }
 
 // Set stores the key data on the filesystem.
 func (fs *FileStore) Set(key string, w io.WriterTo) error {
-	key = fs.mangleKey(key, true)
+	if err := fs.validateKeys(key); err != nil {
+		return err
+	}
 
-	var (
-		f   *os.File
-		err error
-	)
+	defer fs.lock()()
+
+	res, err := fs.reserve(key)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(fs.baseDir, fs.mangleKey(key))
+
+	var f *os.File
 
 	if fs.tmpDir != "" {
 		f, err = os.CreateTemp(fs.tmpDir, "keystore")
 	} else {
-		f, err = os.Create(filepath.Join(fs.baseDir, key))
+		err = fs.withDir(path, func() error {
+			f, err = os.Create(path)
+
+			return err
+		})
 	}
 
 	if err != nil {
+		fs.prune(path)
+		fs.quota.cancel(res, false)
+
 		return fmt.Errorf("error opening file for writing: %w", err)
 	}
 
-	if _, err = w.WriteTo(f); err != nil && !errors.Is(err, io.EOF) {
+	lw := fs.quota.writer(f, res)
+
+	if err = fs.write(f, lw, w); err != nil {
 		f.Close()
+		os.Remove(f.Name())
+		fs.prune(path)
+		fs.quota.cancel(res, fs.tmpDir == "")
 
 		return fmt.Errorf("error writing to file: %w", err)
 	} else if err = f.Close(); err != nil {
+		fs.quota.cancel(res, false)
+
 		return fmt.Errorf("error closing file: %w", err)
 	}
 
 	if fs.tmpDir != "" {
 		fp := f.Name()
 
-		if err = os.Rename(fp, filepath.Join(fs.baseDir, key)); err != nil {
+		if err = fs.withDir(path, func() error { return os.Rename(fp, path) }); err != nil {
 			os.Remove(fp)
+			fs.prune(path)
+			fs.quota.cancel(res, false)
 
 			return fmt.Errorf("error moving tmp file: %w", err)
 		}
 	}
 
+	fs.quota.commit(res, !res.newKey, res.oldSize, lw.count+fs.overhead())
+
 	return nil
 }
 
+func (fs *FileStore) write(f *os.File, lw *limitWriter, w io.WriterTo) error {
+	if !fs.checksums {
+		if _, err := w.WriteTo(lw); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		return nil
+	}
+
+	if _, err := f.Write(pendingHeader()); err != nil {
+		return err
+	}
+
+	cw := newChecksumWriter(lw)
+
+	if _, err := w.WriteTo(cw); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	_, err := f.WriteAt(cw.header(), 0)
+
+	return err
+}
+
+// lock locks the FileStore for a modifying operation.
+//
+// When quotas are enforced the lock is exclusive, so that whether a key is new,
+// and the size of the data it replaces, cannot change before the quota is
+// updated.
+func (fs *FileStore) lock() func() {
+	for {
+		if fs.quota.enabled() {
+			fs.mu.Lock()
+
+			return fs.mu.Unlock
+		}
+
+		fs.mu.RLock()
+
+		if !fs.quota.enabled() {
+			return fs.mu.RUnlock
+		}
+
+		fs.mu.RUnlock()
+	}
+}
+
+func (fs *FileStore) reserve(key string) (reservation, error) {
+	if fs.quota.enabled() {
+		if fi, err := fs.Stat(key); err == nil {
+			return fs.quota.reserve(key, true, fi.Size(), fs.overhead())
+		}
+	}
+
+	return fs.quota.reserve(key, false, 0, fs.overhead())
+}
+
+// overhead returns the size of the data stored with each value, which is
+// counted towards the quota along with the value.
+func (fs *FileStore) overhead() int64 {
+	if fs.checksums {
+		return int64(checksumHeaderSize)
+	}
+
+	return 0
+}
+
 // Remove deletes the key data from the filesystem.
 func (fs *FileStore) Remove(key string) error {
-	key = fs.mangleKey(key, false)
+	if err := fs.validateKeys(key); err != nil {
+		return err
+	}
+
+	defer fs.lock()()
 
-	if os.IsNotExist((os.Remove(filepath.Join(fs.baseDir, key)))) {
+	var size int64
+
+	if fs.quota.enabled() {
+		if fi, err := fs.Stat(key); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	path := filepath.Join(fs.baseDir, fs.mangleKey(key))
+
+	if os.IsNotExist((os.Remove(path))) {
 		return ErrUnknownKey
 	}
 
+	fs.prune(path)
+	fs.quota.remove(size)
+
 	return nil
 }
 
 // Keys returns a sorted slice of all of the keys.
+//
+// Any errors reading the base directory are ignored; use KeysErr to retrieve
+// them.
 func (fs *FileStore) Keys() []string {
-	s := fs.getDirContents("")
+	keys, _ := fs.KeysErr()
+
+	return keys
+}
 
-	sort.Strings(s)
+// KeysErr returns a sorted slice of all of the keys, along with the first
+// error encountered reading the base directory. Unreadable directories are
+// skipped, so the keys returned are those that could be read.
+//
+// When there are no other errors, but some entries cannot be decoded to keys,
+// an *UndecodableError listing their paths is returned with the keys.
+func (fs *FileStore) KeysErr() ([]string, error) {
+	var keys, undecodable []string
 
-	return s
+	err := fs.getDirContents("", &keys, &undecodable)
+
+	sort.Strings(keys)
+
+	if err != nil {
+		return keys, fmt.Errorf("error reading keys: %w", err)
+	} else if len(undecodable) > 0 {
+		return keys, &UndecodableError{Paths: undecodable}
+	}
+
+	return keys, nil
 }
 
 // Stat returns the FileInfo of the file relating to the given key.
 func (fs *FileStore) Stat(key string) (os.FileInfo, error) {
-	return os.Stat(filepath.Join(fs.baseDir, fs.mangleKey(key, false)))
+	if err := fs.validateKeys(key); err != nil {
+		return nil, err
+	}
+
+	return os.Stat(filepath.Join(fs.baseDir, fs.mangleKey(key)))
 }
 
 // Exists returns true when the key exists within the store.
 func (fs *FileStore) Exists(key string) bool {
-	_, err := os.Stat(filepath.Join(fs.baseDir, fs.mangleKey(key, false)))
+	_, err := fs.Stat(key)
 
 	return err == nil
 }
 
-// Rename moves data from an existing key to a new, unused key.
+// Rename moves data from an existing key to a new key, replacing any existing
+// data at the new key.
 func (fs *FileStore) Rename(oldkey, newkey string) error {
-	return os.Rename(filepath.Join(fs.baseDir, fs.mangleKey(oldkey, false)), filepath.Join(fs.baseDir, fs.mangleKey(newkey, true)))
+	if err := fs.validateKeys(oldkey, newkey); err != nil {
+		return err
+	}
+
+	defer fs.lock()()
+
+	if err := fs.quota.checkKey(newkey); err != nil {
+		return err
+	}
+
+	oldpath := filepath.Join(fs.baseDir, fs.mangleKey(oldkey))
+	newpath := filepath.Join(fs.baseDir, fs.mangleKey(newkey))
+
+	if _, err := os.Lstat(oldpath); os.IsNotExist(err) {
+		return ErrUnknownKey
+	} else if oldkey == newkey {
+		return nil
+	}
+
+	var replaced os.FileInfo
+
+	if fs.quota.enabled() {
+		replaced, _ = fs.Stat(newkey)
+	}
+
+	if err := fs.withDir(newpath, func() error { return os.Rename(oldpath, newpath) }); err != nil {
+		fs.prune(newpath)
+
+		if _, serr := os.Lstat(oldpath); os.IsNotExist(serr) {
+			return ErrUnknownKey
+		}
+
+		return err
+	}
+
+	fs.prune(oldpath)
+
+	if replaced != nil {
+		fs.quota.remove(replaced.Size())
+	}
+
+	return nil
 }
 
-func (fs *FileStore) mangleKey(key string, prepare bool) string {
+func (fs *FileStore) mangleKey(key string) string {
 	parts := fs.mangler.Encode(key)
 	if len(parts) == 0 {
 		return ""
 	} else if len(parts) == 1 {
 		return parts[0]
-	} else if prepare {
-		os.MkdirAll(filepath.Join(append([]string{fs.baseDir}, parts...)...), 0o700)
 	}
 
 	return filepath.Clean("/" + strings.Join(parts, string(filepath.Separator)))[1:]
 }
 
-func (fs *FileStore) getDirContents(dir string) []string {
-	d, err := os.Open(filepath.Join(fs.baseDir, dir))
-	if err != nil {
-		return nil
-	}
+// maxDirRetries is the number of times an operation will be retried when the
+// parent directory of its target is removed by another process.
+const maxDirRetries = 8
 
-	files, err := d.Readdir(-1)
-	if err != nil {
-		return nil
-	}
+// withDir creates the parent directories of the given path and runs fn.
+//
+// Pruning within this FileStore is excluded while fn runs, and failures caused
+// by directories being removed by another process are retried.
+func (fs *FileStore) withDir(path string, fn func() error) error {
+	dir := filepath.Dir(path)
 
-	names := make([]string, 0, len(files))
+	if dir != fs.baseDir {
+		fs.dirMu.RLock()
+		defer fs.dirMu.RUnlock()
+	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			names = append(names, fs.getDirContents(filepath.Join(dir, file.Name()))...)
-		} else {
-			name, err := fs.mangler.Decode(strings.Split(filepath.Join(dir, file.Name()), string(filepath.Separator)))
-			if err != nil {
+	for try := 0; ; try++ {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			if (os.IsNotExist(err) || os.IsExist(err)) && try < maxDirRetries {
 				continue
 			}
 
-			names = append(names, name)
+			return fmt.Errorf("error creating key dir: %w", err)
+		}
+
+		if err := fn(); !os.IsNotExist(err) || try == maxDirRetries {
+			return err
+		}
+	}
+}
+
+// prune removes the empty parent directories of the given path, stopping at
+// the first non-empty directory, or the base directory.
+func (fs *FileStore) prune(path string) {
+	if filepath.Dir(path) == fs.baseDir {
+		return
+	}
+
+	fs.dirMu.Lock()
+	defer fs.dirMu.Unlock()
+
+	for dir := filepath.Dir(path); dir != fs.baseDir && strings.HasPrefix(dir, fs.baseDir); dir = filepath.Dir(dir) {
+		if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() || os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func (fs *FileStore) getDirContents(dir string, keys, undecodable *[]string) error {
+	entries, err := os.ReadDir(filepath.Join(fs.baseDir, dir))
+
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+
+		if entry.IsDir() {
+			if derr := fs.getDirContents(name, keys, undecodable); err == nil {
+				err = derr
+			}
+		} else if key, derr := fs.mangler.Decode(strings.Split(name, string(filepath.Separator))); derr != nil {
+			*undecodable = append(*undecodable, name)
+		} else {
+			*keys = append(*keys, key)
 		}
 	}
 
-	return names
+	return err
 }
 
 // Mangler is an interface for the methods required to un/mangle a key.
@@ -197,6 +452,20 @@ type Mangler interface {
 
 type base64Mangler struct{}
 
+// maxBase64KeyLength is the longest key whose encoding fits within
+// maxFilenameLength.
+const maxBase64KeyLength = maxFilenameLength / 4 * 3
+
+func (base64Mangler) ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	} else if len(key) > maxBase64KeyLength {
+		return fmt.Errorf("%w: key longer than %d bytes", ErrInvalidKey, maxBase64KeyLength)
+	}
+
+	return nil
+}
+
 func (base64Mangler) Encode(name string) []string {
 	return []string{base64.URLEncoding.EncodeToString([]byte(name))}
 }
@@ -216,6 +485,10 @@ func (base64Mangler) Decode(parts []string) (string, error) {
 
 type noMangle struct{}
 
+func (noMangle) ValidateKey(key string) error {
+	return PathKeys.ValidateKey(key)
+}
+
 func (noMangle) Encode(name string) []string {
 	return strings.Split(name, string(filepath.Separator))
 }
@@ -231,4 +504,7 @@ var Base64Mangler Mangler = base64Mangler{}
 // NoMangle is a mangler that performs no mangling. This should only be used
 // when you are certain that there are no filesystem special characters in the
 // key name.
+//
+// Keys used with NoMangle are checked with the PathKeys KeyValidator, so that
+// they cannot escape the base directory or collide with other keys.
 var NoMangle Mangler = noMangle{}
@@ -1,6 +1,10 @@
 package keystore
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -21,3 +25,76 @@ func TestFileStoreWithTmp(t *testing.T) {
 	}
 	testStore(t, s)
 }
+
+func TestFileStorePrune(t *testing.T) {
+	for n, tmp := range [...]string{"", t.TempDir()} {
+		dir := t.TempDir()
+		s, err := NewFileStore(dir, tmp, NoMangle)
+		if err != nil {
+			t.Errorf("test %d: received unexpected error creating FileStore: %s", n+1, err)
+			continue
+		}
+		for _, key := range [...]string{"a/b/c", "a/d"} {
+			if err = s.Set(key, String("value")); err != nil {
+				t.Errorf("test %d: unexpected error setting key %q: %s", n+1, key, err)
+			}
+		}
+		if err = s.Remove("a/b/c"); err != nil {
+			t.Errorf("test %d: unexpected error removing key: %s", n+1, err)
+		} else if _, err = os.Stat(filepath.Join(dir, "a", "b")); !os.IsNotExist(err) {
+			t.Errorf("test %d: expecting dir a/b to be removed, got err %v", n+1, err)
+		} else if _, err = os.Stat(filepath.Join(dir, "a")); err != nil {
+			t.Errorf("test %d: expecting dir a to remain, got err %s", n+1, err)
+		}
+		if err = s.Rename("a/d", "e/f/g"); err != nil {
+			t.Errorf("test %d: unexpected error renaming key: %s", n+1, err)
+		} else if _, err = os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+			t.Errorf("test %d: expecting dir a to be removed, got err %v", n+1, err)
+		} else if keys := s.Keys(); len(keys) != 1 || keys[0] != "e/f/g" {
+			t.Errorf("test %d: expecting keys [e/f/g], got %v", n+1, keys)
+		}
+		if err = s.Rename("missing", "h/i"); err == nil {
+			t.Errorf("test %d: expecting error renaming missing key", n+1)
+		} else if _, err = os.Stat(filepath.Join(dir, "h")); !os.IsNotExist(err) {
+			t.Errorf("test %d: expecting dir h to be removed, got err %v", n+1, err)
+		}
+		if err = s.Remove("e/f/g"); err != nil {
+			t.Errorf("test %d: unexpected error removing key: %s", n+1, err)
+		} else if entries, err := os.ReadDir(dir); err != nil {
+			t.Errorf("test %d: unexpected error reading base dir: %s", n+1, err)
+		} else if len(entries) != 0 {
+			t.Errorf("test %d: expecting empty base dir, got %d entries", n+1, len(entries))
+		}
+		if err = os.WriteFile(filepath.Join(dir, "file"), nil, 0o600); err != nil {
+			t.Errorf("test %d: unexpected error creating file: %s", n+1, err)
+		} else if err = s.Set("file/key", String("value")); err == nil {
+			t.Errorf("test %d: expecting error creating key dir", n+1)
+		}
+	}
+}
+
+func TestFileStorePruneRace(t *testing.T) {
+	s, err := NewFileStore(t.TempDir(), "", NoMangle)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			key := fmt.Sprintf("a/b/%d", n)
+			for i := 0; i < 100; i++ {
+				if err := s.Set(key, String("value")); err != nil {
+					t.Errorf("unexpected error setting key %q: %s", key, err)
+					return
+				} else if err = s.Remove(key); err != nil {
+					t.Errorf("unexpected error removing key %q: %s", key, err)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,294 @@
+package keystore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	checksumMagic      = "\xffKSC"
+	checksumHeaderSize = len(checksumMagic) + 12
+)
+
+type checksumWriter struct {
+	io.Writer
+	hash hash.Hash32
+	size int64
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{Writer: w, hash: crc32.NewIEEE()}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+
+	c.hash.Write(p[:n])
+	c.size += int64(n)
+
+	return n, err
+}
+
+// pendingHeader is written before the value, so that a write that is
+// interrupted leaves a header that fails verification.
+func pendingHeader() []byte {
+	header := make([]byte, checksumHeaderSize)
+
+	copy(header, checksumMagic)
+
+	for n := len(checksumMagic); n < checksumHeaderSize; n++ {
+		header[n] = 0xff
+	}
+
+	return header
+}
+
+func (c *checksumWriter) header() []byte {
+	header := make([]byte, checksumHeaderSize)
+
+	copy(header, checksumMagic)
+	binary.LittleEndian.PutUint64(header[len(checksumMagic):], uint64(c.size))
+	binary.LittleEndian.PutUint32(header[len(checksumMagic)+8:], c.hash.Sum32())
+
+	return header
+}
+
+// verifyChecksum checks the data in the file against its checksum header,
+// leaving the file positioned at the start of the data. Files without a header
+// are reported as corrupt.
+func verifyChecksum(f *os.File) error {
+	header := make([]byte, checksumHeaderSize)
+
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	if n < checksumHeaderSize || string(header[:len(checksumMagic)]) != checksumMagic {
+		return ErrCorrupt
+	}
+
+	cw := newChecksumWriter(io.Discard)
+
+	if _, err = io.Copy(cw, f); err != nil {
+		return err
+	}
+
+	if binary.LittleEndian.Uint64(header[len(checksumMagic):]) != uint64(cw.size) || binary.LittleEndian.Uint32(header[len(checksumMagic)+8:]) != cw.hash.Sum32() {
+		return ErrCorrupt
+	}
+
+	_, err = f.Seek(int64(checksumHeaderSize), io.SeekStart)
+
+	return err
+}
+
+// checksumData checks the data against its checksum header, returning the data
+// without the header. Data without a header is reported as corrupt.
+func checksumData(data []byte) ([]byte, error) {
+	if len(data) < checksumHeaderSize || string(data[:len(checksumMagic)]) != checksumMagic {
+		return nil, ErrCorrupt
+	}
+
+	header, value := data[:checksumHeaderSize], data[checksumHeaderSize:]
+
+	if binary.LittleEndian.Uint64(header[len(checksumMagic):]) != uint64(len(value)) || binary.LittleEndian.Uint32(header[len(checksumMagic)+8:]) != crc32.ChecksumIEEE(value) {
+		return nil, ErrCorrupt
+	}
+
+	return value, nil
+}
+
+// SetChecksums enables, or disables, the writing of a checksum header with
+// each value, which is verified by Get, returning ErrCorrupt on a mismatch.
+//
+// While checksums are enabled, values without a valid header, including those
+// written before checksums were enabled, are reported as ErrCorrupt, so
+// checksums should be enabled for the whole lifetime of a store.
+func (fs *FileStore) SetChecksums(enabled bool) {
+	fs.checksums = enabled
+}
+
+// ProblemKind describes the type of a Problem found by Fsck.
+type ProblemKind uint8
+
+// Problem Kinds.
+const (
+	// ProblemUndecodable is a file whose name cannot be decoded to a key.
+	ProblemUndecodable ProblemKind = iota
+	// ProblemEmptyDir is an empty directory within the base directory.
+	ProblemEmptyDir
+	// ProblemOrphanTemp is a temporary file left by an interrupted write.
+	ProblemOrphanTemp
+	// ProblemCorrupt is a value whose checksum does not match.
+	ProblemCorrupt
+)
+
+func (p ProblemKind) String() string {
+	switch p {
+	case ProblemUndecodable:
+		return "undecodable filename"
+	case ProblemEmptyDir:
+		return "empty directory"
+	case ProblemOrphanTemp:
+		return "orphaned temporary file"
+	case ProblemCorrupt:
+		return "corrupt value"
+	}
+
+	return "unknown problem"
+}
+
+// Problem is an issue found by Fsck.
+type Problem struct {
+	Kind     ProblemKind
+	Path     string
+	Key      string
+	Err      error
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	if p.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", p.Path, p.Kind, p.Err)
+	}
+
+	return fmt.Sprintf("%s: %s", p.Path, p.Kind)
+}
+
+// Fsck scans the base and temporary directories of the FileStore, reporting
+// undecodable filenames, empty directories, orphaned temporary files and,
+// when checksums are enabled, corrupt values.
+//
+// When repair is true, empty directories, orphaned temporary files and
+// corrupt values are removed; undecodable files are only reported.
+func (fs *FileStore) Fsck(repair bool) ([]Problem, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var problems []Problem
+
+	report := func(p Problem, fix func() error) {
+		if repair && fix != nil {
+			if err := fix(); err == nil {
+				p.Repaired = true
+			} else if p.Err == nil {
+				p.Err = err
+			}
+		}
+
+		problems = append(problems, p)
+	}
+
+	if _, err := fs.fsckDir("", report); err != nil {
+		return problems, err
+	}
+
+	if fs.tmpDir != "" {
+		entries, err := os.ReadDir(fs.tmpDir)
+		if err != nil {
+			return problems, fmt.Errorf("error reading temp dir: %w", err)
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasPrefix(e.Name(), "keystore") {
+				path := filepath.Join(fs.tmpDir, e.Name())
+
+				report(Problem{Kind: ProblemOrphanTemp, Path: path}, func() error { return os.Remove(path) })
+			}
+		}
+	}
+
+	if repair && fs.quota.enabled() {
+		keys, size, err := fs.usage()
+		if err != nil {
+			return problems, err
+		}
+
+		fs.quota.reset(keys, size)
+	}
+
+	return problems, nil
+}
+
+func (fs *FileStore) fsckDir(dir string, report func(Problem, func() error)) (bool, error) {
+	path := filepath.Join(fs.baseDir, dir)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return false, fmt.Errorf("error reading dir: %w", err)
+	}
+
+	empty := true
+
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		fpath := filepath.Join(fs.baseDir, name)
+
+		if e.IsDir() {
+			removed, err := fs.fsckDir(name, report)
+			if err != nil {
+				return false, err
+			}
+
+			if !removed {
+				empty = false
+			}
+
+			continue
+		}
+
+		empty = false
+
+		if strings.HasSuffix(e.Name(), restoreExt) {
+			report(Problem{Kind: ProblemOrphanTemp, Path: fpath}, func() error { return os.Remove(fpath) })
+
+			continue
+		}
+
+		key, err := fs.mangler.Decode(strings.Split(name, string(filepath.Separator)))
+		if err != nil {
+			report(Problem{Kind: ProblemUndecodable, Path: fpath, Err: err}, nil)
+
+			continue
+		}
+
+		if fs.checksums {
+			if err = checkFile(fpath); err != nil {
+				report(Problem{Kind: ProblemCorrupt, Path: fpath, Key: key, Err: err}, func() error { return os.Remove(fpath) })
+			}
+		}
+	}
+
+	if !empty || dir == "" {
+		return false, nil
+	}
+
+	removed := false
+
+	report(Problem{Kind: ProblemEmptyDir, Path: path}, func() error {
+		err := os.Remove(path)
+		removed = err == nil
+
+		return err
+	})
+
+	return removed, nil
+}
+
+func checkFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return verifyChecksum(f)
+}
@@ -0,0 +1,140 @@
+package keystore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestChecksums(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir, "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	fs.SetChecksums(true)
+	testStore(t, fs)
+	fs.SetChecksums(false)
+	fs.Set("legacy", data("unchecked"))
+	fs.SetChecksums(true)
+	var buf memio.Buffer
+	fs.Set("key", data("Hello, World!"))
+	if err = fs.Get("key", &buf); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if string(buf) != "Hello, World!" {
+		t.Errorf("test 1: expecting value %q, got %q", "Hello, World!", buf)
+	} else if err = fs.Get("legacy", &buf); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 2: expecting ErrCorrupt, got %v", err)
+	}
+	path := filepath.Join(dir, fs.mangleKey("key"))
+	fi, _ := os.Stat(path)
+	os.Truncate(path, fi.Size()-1)
+	if err = fs.Get("key", &buf); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 3: expecting ErrCorrupt, got %v", err)
+	}
+	os.WriteFile(path, append(make([]byte, checksumHeaderSize), "torn"...), 0o600)
+	if err = fs.Get("key", &buf); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 4: expecting ErrCorrupt, got %v", err)
+	}
+	os.WriteFile(path, append(pendingHeader(), "torn"...), 0o600)
+	if err = fs.Get("key", &buf); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 5: expecting ErrCorrupt, got %v", err)
+	} else if problems, _ := fs.Fsck(false); len(problems) != 2 {
+		t.Errorf("test 6: expecting 2 problems, got %v", problems)
+	}
+}
+
+func TestChecksumsLimits(t *testing.T) {
+	fs, err := NewFileStore(t.TempDir(), "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	fs.SetChecksums(true)
+	fs.Set("key1", data("12345"))
+	if err = fs.SetLimits(Limits{MaxTotalSize: int64(3*checksumHeaderSize + 10)}); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = fs.Set("key1", data("123")); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if err = fs.Set("key2", data("1234")); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if err = fs.Set("key3", data("1234")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 4: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = fs.Set("key3", data("123")); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if err = fs.Remove("key1"); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if keys, size, _ := fs.usage(); keys != fs.quota.keys || size != fs.quota.size {
+		t.Errorf("test 7: expecting usage %d keys, %d bytes, got %d keys, %d bytes", keys, size, fs.quota.keys, fs.quota.size)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dir, tmp := t.TempDir(), t.TempDir()
+	fs, err := NewFileStore(dir, tmp, nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	fs.SetChecksums(true)
+	fs.Set("good", data("data"))
+	fs.Set("bad", data("data"))
+	bad := filepath.Join(dir, fs.mangleKey("bad"))
+	os.WriteFile(bad, append([]byte(checksumMagic), 5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 'd', 'a', 't', 'a', '!'), 0o600)
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0o700)
+	os.WriteFile(filepath.Join(dir, "!!!"), nil, 0o600)
+	os.WriteFile(filepath.Join(tmp, "keystore123"), nil, 0o600)
+	problems, err := fs.Fsck(false)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	kinds := make(map[ProblemKind]int)
+	for _, p := range problems {
+		kinds[p.Kind]++
+		if p.Repaired {
+			t.Errorf("test 1: unexpected repair: %s", p)
+		}
+	}
+	if expected := map[ProblemKind]int{ProblemCorrupt: 1, ProblemEmptyDir: 1, ProblemUndecodable: 1, ProblemOrphanTemp: 1}; !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("test 1: expecting problems %v, got %v", expected, kinds)
+	}
+	if problems, err = fs.Fsck(true); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if problems, err = fs.Fsck(false); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if len(problems) != 1 || problems[0].Kind != ProblemUndecodable {
+		t.Errorf("test 3: expecting only the undecodable file, got %v", problems)
+	} else if keys := fs.Keys(); !reflect.DeepEqual(keys, []string{"good"}) {
+		t.Errorf("test 4: expecting keys [good], got %v", keys)
+	}
+}
+
+func TestFsckLimits(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir, "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	fs.SetChecksums(true)
+	fs.Set("good", data("data"))
+	fs.Set("bad", data("data"))
+	os.WriteFile(filepath.Join(dir, fs.mangleKey("bad")), []byte("data"), 0o600)
+	if err = fs.SetLimits(Limits{MaxKeys: 2}); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = fs.Set("new", data("data")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 2: expecting ErrQuotaExceeded, got %v", err)
+	} else if _, err = fs.Fsck(true); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if keys, size, _ := fs.usage(); keys != fs.quota.keys || size != fs.quota.size {
+		t.Errorf("test 4: expecting usage %d keys, %d bytes, got %d keys, %d bytes", keys, size, fs.quota.keys, fs.quota.size)
+	} else if err = fs.Set("new", data("data")); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	}
+}
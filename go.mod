@@ -1,6 +1,6 @@
 module vimagination.zapto.org/keystore
 
-go 1.16
+go 1.18
 
 require (
 	vimagination.zapto.org/byteio v1.0.0
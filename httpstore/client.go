@@ -0,0 +1,282 @@
+package httpstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"vimagination.zapto.org/keystore"
+	"vimagination.zapto.org/memio"
+)
+
+// Client default values.
+var (
+	DefaultTimeout = 30 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = 100 * time.Millisecond
+)
+
+// Client implements the keystore.Store interface for a Store served by a
+// Handler.
+type Client struct {
+	base   string
+	client *http.Client
+
+	// Retries is the number of times a request is retried after a
+	// connection error or a 502, 503 or 504 response.
+	//
+	// Only the idempotent GET, HEAD and PUT requests are retried, as a
+	// DELETE, MOVE or POST may have been applied before the failure.
+	Retries int
+	// Backoff is the delay before the first retry, which is doubled for each
+	// subsequent retry.
+	Backoff time.Duration
+}
+
+// NewClient creates a new Client for the Handler served at the given URL.
+//
+// When httpClient is nil, a new http.Client is created with DefaultTimeout.
+// The Client should be reused so that connections are reused.
+func NewClient(endpoint string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing endpoint: %w", err)
+	}
+
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	return &Client{
+		base:    strings.TrimSuffix(u.String(), "/") + KeysPrefix,
+		client:  httpClient,
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
+	}, nil
+}
+
+func (c *Client) keyURL(key string) string {
+	return c.base + url.PathEscape(key)
+}
+
+func retryable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+func idempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodPut
+}
+
+func (c *Client) do(method, u string, body []byte, headers ...string) (*http.Response, error) {
+	backoff := c.Backoff
+
+	for try := 0; ; try++ {
+		var r io.Reader
+
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequest(method, u, r)
+		if err != nil {
+			return nil, err
+		}
+
+		for n := 0; n+1 < len(headers); n += 2 {
+			req.Header.Set(headers[n], headers[n+1])
+		}
+
+		resp, err := c.client.Do(req)
+		if err == nil && !retryable(resp.StatusCode) || try >= c.Retries || !idempotent(method) {
+			return resp, err
+		}
+
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+	}
+}
+
+// StatusError is returned when a response has an unexpected status code.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (s StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", s.Code, s.Message)
+}
+
+func statusError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return keystore.ErrUnknownKey
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return keystore.ErrKeyExists
+	case http.StatusBadRequest:
+		return keystore.ErrInvalidKey
+	case http.StatusForbidden:
+		return keystore.ErrDenied
+	case http.StatusRequestEntityTooLarge:
+		return keystore.ErrQuotaExceeded
+	}
+
+	return StatusError{Code: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
+
+func closeResponse(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Get retrieves the key data from the remote store.
+func (c *Client) Get(key string, r io.ReaderFrom) error {
+	resp, err := c.do(http.MethodGet, c.keyURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	_, err = r.ReadFrom(resp.Body)
+
+	return err
+}
+
+// Set stores the key data in the remote store.
+func (c *Client) Set(key string, w io.WriterTo) error {
+	buf := make(memio.Buffer, 0)
+
+	if _, err := w.WriteTo(&buf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	resp, err := c.do(http.MethodPut, c.keyURL(key), buf)
+	if err != nil {
+		return err
+	}
+
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	return nil
+}
+
+// Remove deletes the key data from the remote store.
+func (c *Client) Remove(key string) error {
+	resp, err := c.do(http.MethodDelete, c.keyURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	return nil
+}
+
+// Exists returns true when the key exists within the remote store.
+func (c *Client) Exists(key string) bool {
+	resp, err := c.do(http.MethodHead, c.keyURL(key), nil)
+	if err != nil {
+		return false
+	}
+
+	closeResponse(resp)
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// Keys returns a sorted slice of all of the keys in the remote store.
+func (c *Client) Keys() []string {
+	keys, _ := c.KeysErr()
+
+	return keys
+}
+
+// KeysErr returns a sorted slice of all of the keys in the remote store, along
+// with any error encountered retrieving them.
+func (c *Client) KeysErr() ([]string, error) {
+	return c.List("")
+}
+
+// List returns a sorted slice of all of the keys in the remote store with the
+// given prefix.
+func (c *Client) List(prefix string) ([]string, error) {
+	var (
+		keys []string
+		list List
+	)
+
+	for {
+		q := url.Values{"prefix": {prefix}, "limit": {strconv.Itoa(DefaultListLimit)}}
+
+		if list.Next != "" {
+			q.Set("after", list.Next)
+		}
+
+		resp, err := c.do(http.MethodGet, c.base+"?"+q.Encode(), nil)
+		if err != nil {
+			return keys, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = statusError(resp)
+		} else {
+			list = List{}
+			err = json.NewDecoder(resp.Body).Decode(&list)
+		}
+
+		closeResponse(resp)
+
+		if err != nil {
+			return keys, err
+		}
+
+		keys = append(keys, list.Keys...)
+
+		if list.Next == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Rename moves data from an existing key to a new, unused key.
+func (c *Client) Rename(oldkey, newkey string) error {
+	resp, err := c.do("MOVE", c.keyURL(oldkey), nil, "Destination", c.keyURL(newkey), "Overwrite", "F")
+	if err != nil {
+		return err
+	}
+
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package httpstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"vimagination.zapto.org/keystore"
+	"vimagination.zapto.org/keystore/keystoretest"
+)
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.StripPrefix("/api", New(keystore.NewMemStore())))
+	defer srv.Close()
+	c, err := NewClient(srv.URL+"/api", srv.Client())
+	if err != nil {
+		t.Errorf("received unexpected error creating Client: %s", err)
+		return
+	}
+	var str keystore.String
+	if err = c.Get("a/b", &str); err != keystore.ErrUnknownKey {
+		t.Errorf("test 1: expecting ErrUnknownKey, got %v", err)
+	} else if err = c.Remove("a/b"); err != keystore.ErrUnknownKey {
+		t.Errorf("test 2: expecting ErrUnknownKey, got %v", err)
+	} else if err = c.Set("a/b", keystore.String("Hello, World!")); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if err = c.Set("c d", keystore.String("Beep")); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if keys := c.Keys(); !reflect.DeepEqual(keys, []string{"a/b", "c d"}) {
+		t.Errorf("test 5: expecting keys [a/b c d], got %v", keys)
+	} else if err = c.Get("a/b", &str); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if str != "Hello, World!" {
+		t.Errorf("test 6: expecting value %q, got %q", "Hello, World!", str)
+	} else if err = c.Rename("a/b", "c d"); err != keystore.ErrKeyExists {
+		t.Errorf("test 7: expecting ErrKeyExists, got %v", err)
+	} else if err = c.Rename("a/b", "e"); err != nil {
+		t.Errorf("test 8: unexpected error: %s", err)
+	} else if !c.Exists("e") || c.Exists("a/b") {
+		t.Errorf("test 9: rename failed")
+	} else if err = c.Remove("e"); err != nil {
+		t.Errorf("test 10: unexpected error: %s", err)
+	} else if keys = c.Keys(); !reflect.DeepEqual(keys, []string{"c d"}) {
+		t.Errorf("test 11: expecting keys [c d], got %v", keys)
+	}
+}
+
+func TestClientConformance(t *testing.T) {
+	keystoretest.Run(t, func(t *testing.T) keystore.Store {
+		srv := httptest.NewServer(New(keystore.NewMemStore()))
+		t.Cleanup(srv.Close)
+		c, err := NewClient(srv.URL, srv.Client())
+		if err != nil {
+			t.Fatalf("received unexpected error creating Client: %s", err)
+		}
+		return c
+	})
+}
+
+func TestClientRetry(t *testing.T) {
+	var failures int32 = 2
+	h := New(keystore.NewMemStore())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	c, _ := NewClient(srv.URL, srv.Client())
+	c.Backoff = 0
+	if err := c.Set("a", keystore.String("b")); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	}
+	atomic.StoreInt32(&failures, 5)
+	if err := c.Set("a", keystore.String("b")); err == nil {
+		t.Errorf("test 2: expecting error")
+	} else if se, ok := err.(StatusError); !ok || se.Code != http.StatusServiceUnavailable {
+		t.Errorf("test 2: expecting StatusError 503, got %v", err)
+	}
+	atomic.StoreInt32(&failures, 1)
+	if err := c.Remove("a"); err == nil {
+		t.Errorf("test 3: expecting error")
+	} else if atomic.LoadInt32(&failures) != 0 {
+		t.Errorf("test 3: expecting no retries")
+	} else if err = c.Rename("a", "b"); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,449 @@
+// Package httpstore provides an HTTP interface to, and a client for, a keystore.Store.
+package httpstore // import "vimagination.zapto.org/keystore/httpstore"
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"vimagination.zapto.org/keystore"
+)
+
+// KeysPrefix is the path prefix under which keys are served.
+const KeysPrefix = "/keys/"
+
+// DefaultListLimit is the maximum number of keys returned by a listing when no
+// limit is specified.
+const DefaultListLimit = 1000
+
+// Handler is an http.Handler that serves a keystore.Store.
+//
+// Values are available at /keys/{key} via the GET, HEAD, PUT and DELETE
+// methods. A key can be renamed either with the MOVE method, using the
+// Destination header, or with the POST method, using the 'to' query
+// parameter.
+//
+// A GET request to /keys/ returns a JSON object containing a sorted list of
+// keys, filtered by the 'prefix' parameter. The 'limit' and 'after' parameters
+// can be used to paginate the list, with the 'next' field of the response
+// giving the value of 'after' for the next page.
+//
+// ETags are derived from the value of a key, so they remain valid across
+// Handlers and restarts. To allow values to be streamed, GET and HEAD
+// responses only include an ETag when the request is conditional, or when the
+// Store provides a Hash method, such as that of keystore.DedupStore.
+type Handler struct {
+	store keystore.Store
+
+	writeMu sync.Mutex
+}
+
+// New creates a new Handler to serve the given Store.
+func New(store keystore.Store) *Handler {
+	return &Handler{store: store}
+}
+
+// List is the response to a listing request.
+type List struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, KeysPrefix) {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, KeysPrefix)
+
+	if key == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		} else {
+			h.list(w, r)
+		}
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, key)
+	case http.MethodPut:
+		h.put(w, r, key)
+	case http.MethodDelete:
+		h.remove(w, r, key)
+	case "MOVE":
+		prefix := KeysPrefix
+
+		if orig, err := url.ParseRequestURI(r.RequestURI); err == nil {
+			prefix = strings.TrimSuffix(orig.Path, r.URL.Path) + KeysPrefix
+		}
+
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || !strings.HasPrefix(dest.Path, prefix) || dest.Path == prefix {
+			http.Error(w, "invalid destination", http.StatusBadRequest)
+
+			return
+		}
+
+		h.rename(w, r, key, strings.TrimPrefix(dest.Path, prefix), r.Header.Get("Overwrite") != "F")
+	case http.MethodPost:
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			http.Error(w, "missing destination", http.StatusBadRequest)
+
+			return
+		}
+
+		h.rename(w, r, key, to, true)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, MOVE, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+type hasher struct {
+	hash.Hash
+}
+
+func (h hasher) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(h.Hash, r)
+}
+
+func (h hasher) etag() string {
+	return fmt.Sprintf("\"%x\"", h.Sum(nil)[:16])
+}
+
+func newHasher() hasher {
+	return hasher{Hash: sha256.New()}
+}
+
+// hashStore is implemented by Stores that can cheaply provide the hex encoded
+// SHA-256 hash of a value.
+type hashStore interface {
+	Hash(key string) (string, error)
+}
+
+func (h *Handler) etag(key string) (string, error) {
+	if hs, ok := h.store.(hashStore); ok {
+		hash, err := hs.Hash(key)
+		if err != nil {
+			return "", err
+		} else if len(hash) >= 32 {
+			return "\"" + hash[:32] + "\"", nil
+		}
+	}
+
+	hr := newHasher()
+
+	if err := h.store.Get(key, hr); err != nil {
+		return "", err
+	}
+
+	return hr.etag(), nil
+}
+
+type skip struct{}
+
+func (skip) ReadFrom(io.Reader) (int64, error) {
+	return 0, nil
+}
+
+func (h *Handler) exists(key string) bool {
+	if e, ok := h.store.(interface{ Exists(string) bool }); ok {
+		return e.Exists(key)
+	}
+
+	return h.store.Get(key, skip{}) == nil
+}
+
+// lookup determines whether the key exists and, for conditional requests or
+// when the Store can provide it cheaply, retrieves its ETag.
+func (h *Handler) lookup(r *http.Request, key string) (string, bool, error) {
+	if _, ok := h.store.(hashStore); !ok && r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return "", h.exists(key), nil
+	}
+
+	etag, err := h.etag(key)
+	if errors.Is(err, keystore.ErrUnknownKey) {
+		return "", false, nil
+	}
+
+	return etag, err == nil, err
+}
+
+func matchETag(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkConditions returns the status code for a failed precondition, or zero
+// when the request can proceed.
+func checkConditions(r *http.Request, etag string, exists bool) int {
+	if im := r.Header.Get("If-Match"); im != "" && (!exists || !matchETag(im, etag)) {
+		return http.StatusPreconditionFailed
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && exists && matchETag(inm, etag) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return http.StatusNotModified
+		}
+
+		return http.StatusPreconditionFailed
+	}
+
+	return 0
+}
+
+type responseReaderFrom struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (rw *responseReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	rw.written = true
+
+	return io.Copy(rw.ResponseWriter, r)
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, key string) {
+	etag, exists, err := h.lookup(r, key)
+	if err != nil {
+		writeStoreError(w, err)
+
+		return
+	}
+
+	if code := checkConditions(r, etag, exists); code == http.StatusNotModified {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(code)
+
+		return
+	} else if code != 0 {
+		writeError(w, code)
+
+		return
+	} else if !exists {
+		writeError(w, http.StatusNotFound)
+
+		return
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	rw := responseReaderFrom{ResponseWriter: w}
+
+	if err := h.store.Get(key, &rw); err != nil && !rw.written {
+		w.Header().Del("ETag")
+		w.Header().Del("Content-Type")
+		writeStoreError(w, err)
+	}
+}
+
+type bodyWriterTo struct {
+	io.Reader
+}
+
+func (b bodyWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, b.Reader)
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, key string) {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	etag, exists, err := h.lookup(r, key)
+	if err != nil {
+		writeStoreError(w, err)
+
+		return
+	} else if code := checkConditions(r, etag, exists); code != 0 {
+		writeError(w, code)
+
+		return
+	}
+
+	hr := newHasher()
+
+	if err := h.store.Set(key, bodyWriterTo{io.TeeReader(r.Body, hr)}); err != nil {
+		writeStoreError(w, err)
+
+		return
+	}
+
+	w.Header().Set("ETag", hr.etag())
+
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (h *Handler) remove(w http.ResponseWriter, r *http.Request, key string) {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	etag, exists, err := h.lookup(r, key)
+	if err != nil {
+		writeStoreError(w, err)
+
+		return
+	} else if code := checkConditions(r, etag, exists); code != 0 {
+		writeError(w, code)
+
+		return
+	}
+
+	if err := h.store.Remove(key); err != nil {
+		writeStoreError(w, err)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) rename(w http.ResponseWriter, r *http.Request, oldkey, newkey string, overwrite bool) {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	etag, exists, err := h.lookup(r, oldkey)
+	if err != nil {
+		writeStoreError(w, err)
+
+		return
+	} else if code := checkConditions(r, etag, exists); code != 0 {
+		writeError(w, code)
+
+		return
+	} else if !exists {
+		writeError(w, http.StatusNotFound)
+
+		return
+	} else if !overwrite && h.exists(newkey) {
+		writeError(w, http.StatusPreconditionFailed)
+
+		return
+	}
+
+	if err := h.store.Rename(oldkey, newkey); err != nil {
+		writeStoreError(w, err)
+
+		return
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	after := q.Get("after")
+	limit := DefaultListLimit
+
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+
+			return
+		}
+
+		limit = n
+	}
+
+	keys, err := keystore.KeysErr(h.store)
+
+	var undecodable *keystore.UndecodableError
+
+	if err != nil && !errors.As(err, &undecodable) {
+		writeStoreError(w, err)
+
+		return
+	}
+
+	list := List{Keys: []string{}}
+
+	for n := sort.SearchStrings(keys, prefix); n < len(keys) && strings.HasPrefix(keys[n], prefix); n++ {
+		if keys[n] <= after {
+			continue
+		}
+
+		if len(list.Keys) == limit {
+			list.Next = list.Keys[limit-1]
+
+			break
+		}
+
+		list.Keys = append(list.Keys, keys[n])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func writeError(w http.ResponseWriter, code int) {
+	http.Error(w, http.StatusText(code), code)
+}
+
+// StatusCode returns the HTTP status code used to represent the given error.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, keystore.ErrUnknownKey):
+		return http.StatusNotFound
+	case errors.Is(err, keystore.ErrKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, keystore.ErrInvalidKey):
+		return http.StatusBadRequest
+	case errors.Is(err, keystore.ErrReadOnly), errors.Is(err, keystore.ErrDenied):
+		return http.StatusForbidden
+	case errors.Is(err, keystore.ErrQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusInternalServerError
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	code := StatusCode(err)
+
+	if code == http.StatusInternalServerError {
+		writeError(w, code)
+	} else {
+		http.Error(w, err.Error(), code)
+	}
+}
@@ -0,0 +1,148 @@
+package httpstore
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"vimagination.zapto.org/keystore"
+)
+
+func request(t *testing.T, h http.Handler, method, path, body string, headers ...string) *http.Response {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	for n := 0; n+1 < len(headers); n += 2 {
+		req.Header.Set(headers[n], headers[n+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestHandler(t *testing.T) {
+	h := New(keystore.NewMemStore())
+	if resp := request(t, h, http.MethodGet, "/keys/a", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("test 1: expecting status 404, got %d", resp.StatusCode)
+	}
+	resp := request(t, h, http.MethodPut, "/keys/a", "hello")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("test 2: expecting status 201, got %d", resp.StatusCode)
+	} else if etag == "" {
+		t.Errorf("test 2: expecting ETag")
+	}
+	if resp = request(t, h, http.MethodGet, "/keys/a", "", "If-Match", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("test 3: expecting status 200, got %d", resp.StatusCode)
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+		t.Errorf("test 3: expecting body %q, got %q", "hello", body)
+	} else if e := resp.Header.Get("ETag"); e != etag {
+		t.Errorf("test 3: expecting ETag %s, got %s", etag, e)
+	}
+	if resp = request(t, h, http.MethodGet, "/keys/a", "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("test 4: expecting status 304, got %d", resp.StatusCode)
+	}
+	if resp = request(t, h, http.MethodPut, "/keys/a", "world", "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("test 5: expecting status 412, got %d", resp.StatusCode)
+	}
+	if resp = request(t, h, http.MethodPut, "/keys/a", "world", "If-Match", etag); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("test 6: expecting status 204, got %d", resp.StatusCode)
+	} else if resp.Header.Get("ETag") == etag {
+		t.Errorf("test 6: expecting new ETag")
+	}
+	if resp = request(t, h, http.MethodDelete, "/keys/a", "", "If-Match", etag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("test 7: expecting status 412, got %d", resp.StatusCode)
+	}
+	if resp = request(t, h, "MOVE", "/keys/a", "", "Destination", "http://example.com/keys/b"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("test 8: expecting status 204, got %d", resp.StatusCode)
+	}
+	if resp = request(t, h, http.MethodPost, "/keys/b?to=c", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("test 9: expecting status 204, got %d", resp.StatusCode)
+	}
+	if resp = request(t, h, http.MethodGet, "/keys/c", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("test 10: expecting status 200, got %d", resp.StatusCode)
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != "world" {
+		t.Errorf("test 10: expecting body %q, got %q", "world", body)
+	}
+	if resp = request(t, h, http.MethodDelete, "/keys/c", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("test 11: expecting status 204, got %d", resp.StatusCode)
+	} else if resp = request(t, h, http.MethodDelete, "/keys/c", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("test 12: expecting status 404, got %d", resp.StatusCode)
+	} else if resp = request(t, h, "MOVE", "/keys/c", "", "Destination", "http://example.com/keys/d"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("test 13: expecting status 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerETag(t *testing.T) {
+	m := keystore.NewMemStore()
+	resp := request(t, New(m), http.MethodPut, "/keys/a", "hello")
+	etag := resp.Header.Get("ETag")
+	h := New(m)
+	if resp = request(t, h, http.MethodHead, "/keys/a", "", "If-Match", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("test 1: expecting status 200, got %d", resp.StatusCode)
+	} else if e := resp.Header.Get("ETag"); e != etag {
+		t.Errorf("test 1: expecting ETag %s, got %s", etag, e)
+	} else if resp = request(t, h, http.MethodGet, "/keys/a", "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("test 2: expecting status 304, got %d", resp.StatusCode)
+	}
+	m.Set("a", keystore.String("world"))
+	if resp = request(t, h, http.MethodPut, "/keys/a", "hello", "If-Match", etag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("test 3: expecting status 412, got %d", resp.StatusCode)
+	} else if resp = request(t, h, "MOVE", "/keys/a", "", "Destination", "http://example.com/keys/b", "If-None-Match", etag); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("test 4: expecting status 204, got %d", resp.StatusCode)
+	} else if resp = request(t, h, http.MethodPut, "/keys/c", "hello"); resp.Header.Get("ETag") != etag {
+		t.Errorf("test 5: expecting ETag %s, got %s", etag, resp.Header.Get("ETag"))
+	} else if resp = request(t, h, http.MethodGet, "/keys/c", ""); resp.Header.Get("ETag") != "" {
+		t.Errorf("test 6: expecting no ETag, got %s", resp.Header.Get("ETag"))
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+		t.Errorf("test 6: expecting body %q, got %q", "hello", body)
+	}
+	ds, err := keystore.NewDedupStore(keystore.NewMemStore(), keystore.NewMemStore())
+	if err != nil {
+		t.Errorf("received unexpected error creating DedupStore: %s", err)
+		return
+	}
+	h = New(ds)
+	if resp = request(t, h, http.MethodPut, "/keys/a", "hello"); resp.Header.Get("ETag") != etag {
+		t.Errorf("test 7: expecting ETag %s, got %s", etag, resp.Header.Get("ETag"))
+	} else if resp = request(t, h, http.MethodGet, "/keys/a", ""); resp.Header.Get("ETag") != etag {
+		t.Errorf("test 8: expecting ETag %s, got %s", etag, resp.Header.Get("ETag"))
+	} else if resp = request(t, h, http.MethodHead, "/keys/b", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("test 9: expecting status 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerList(t *testing.T) {
+	m := keystore.NewMemStore()
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1", "c"} {
+		m.Set(key, keystore.String(key))
+	}
+	h := New(m)
+	for n, test := range [...]struct {
+		Query string
+		List
+	}{
+		{"", List{Keys: []string{"a/1", "a/2", "a/3", "b/1", "c"}}},
+		{"?prefix=a/", List{Keys: []string{"a/1", "a/2", "a/3"}}},
+		{"?prefix=a/&limit=2", List{Keys: []string{"a/1", "a/2"}, Next: "a/2"}},
+		{"?prefix=a/&limit=2&after=a/2", List{Keys: []string{"a/3"}}},
+		{"?prefix=d", List{Keys: []string{}}},
+	} {
+		var list List
+		resp := request(t, h, http.MethodGet, "/keys/"+test.Query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("test %d: expecting status 200, got %d", n+1, resp.StatusCode)
+		} else if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !reflect.DeepEqual(list, test.List) {
+			t.Errorf("test %d: expecting list %v, got %v", n+1, test.List, list)
+		}
+	}
+}
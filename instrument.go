@@ -0,0 +1,176 @@
+package keystore
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Recorder receives a measurement for each operation performed on an
+// Instrumented Store.
+//
+// The bytes are the number of value bytes read by a Get, or written by a Set,
+// and the number of keys returned by Keys. Record may be called concurrently.
+type Recorder interface {
+	Record(op Operation, duration time.Duration, bytes int64, err error)
+}
+
+// ErrorKind returns a short name describing the given error, for use as a
+// metric label. A nil error returns an empty string.
+func ErrorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrUnknownKey):
+		return "unknown_key"
+	case errors.Is(err, ErrKeyExists):
+		return "key_exists"
+	case errors.Is(err, ErrInvalidKey):
+		return "invalid_key"
+	case errors.Is(err, ErrReadOnly):
+		return "read_only"
+	case errors.Is(err, ErrDenied):
+		return "denied"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, ErrCorrupt):
+		return "corrupt"
+	case errors.Is(err, ErrUnknownVersion):
+		return "unknown_version"
+	case errors.Is(err, ErrQuorum):
+		return "quorum"
+	case errors.Is(err, ErrUnknownShard):
+		return "unknown_shard"
+	case errors.Is(err, ErrShardExists):
+		return "shard_exists"
+	case errors.Is(err, ErrNoShards):
+		return "no_shards"
+	}
+
+	return "other"
+}
+
+type instrumented struct {
+	store    Store
+	recorder Recorder
+}
+
+// Instrumented wraps a Store so that every operation is measured and passed to
+// the given Recorder.
+func Instrumented(store Store, recorder Recorder) Store {
+	return &instrumented{store: store, recorder: recorder}
+}
+
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+
+	c.count += int64(n)
+
+	return n, err
+}
+
+type countingReaderFrom struct {
+	io.ReaderFrom
+	count int64
+}
+
+func (c *countingReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	cr := countingReader{Reader: r}
+
+	n, err := c.ReaderFrom.ReadFrom(&cr)
+
+	c.count += cr.count
+
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+
+	c.count += int64(n)
+
+	return n, err
+}
+
+type countingWriterTo struct {
+	io.WriterTo
+	count int64
+}
+
+func (c *countingWriterTo) WriteTo(w io.Writer) (int64, error) {
+	cw := countingWriter{Writer: w}
+
+	n, err := c.WriterTo.WriteTo(&cw)
+
+	c.count += cw.count
+
+	return n, err
+}
+
+func (i *instrumented) Get(key string, r io.ReaderFrom) error {
+	start := time.Now()
+	cr := countingReaderFrom{ReaderFrom: r}
+
+	err := i.store.Get(key, &cr)
+
+	i.recorder.Record(OpGet, time.Since(start), cr.count, err)
+
+	return err
+}
+
+func (i *instrumented) Set(key string, w io.WriterTo) error {
+	start := time.Now()
+	cw := countingWriterTo{WriterTo: w}
+
+	err := i.store.Set(key, &cw)
+
+	i.recorder.Record(OpSet, time.Since(start), cw.count, err)
+
+	return err
+}
+
+func (i *instrumented) Remove(key string) error {
+	start := time.Now()
+
+	err := i.store.Remove(key)
+
+	i.recorder.Record(OpRemove, time.Since(start), 0, err)
+
+	return err
+}
+
+func (i *instrumented) Keys() []string {
+	keys, _ := i.KeysErr()
+
+	return keys
+}
+
+func (i *instrumented) KeysErr() ([]string, error) {
+	start := time.Now()
+
+	keys, err := KeysErr(i.store)
+
+	i.recorder.Record(OpKeys, time.Since(start), int64(len(keys)), err)
+
+	return keys, err
+}
+
+func (i *instrumented) Rename(oldkey, newkey string) error {
+	start := time.Now()
+
+	err := i.store.Rename(oldkey, newkey)
+
+	i.recorder.Record(OpRename, time.Since(start), 0, err)
+
+	return err
+}
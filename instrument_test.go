@@ -0,0 +1,73 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+type record struct {
+	Op    Operation
+	Bytes int64
+	Kind  string
+}
+
+type testRecorder struct {
+	mu      sync.Mutex
+	records []record
+}
+
+func (t *testRecorder) Record(op Operation, duration time.Duration, bytes int64, err error) {
+	t.mu.Lock()
+	t.records = append(t.records, record{op, bytes, ErrorKind(err)})
+	t.mu.Unlock()
+}
+
+func TestInstrumented(t *testing.T) {
+	var r testRecorder
+	s := Instrumented(NewMemStore(), &r)
+	testStore(t, s)
+	r.records = r.records[:0]
+	var buf memio.Buffer
+	s.Set("key", data("Hello"))
+	s.Get("key", &buf)
+	s.Get("missing", &buf)
+	s.Rename("key", "other")
+	s.Remove("key")
+	s.Keys()
+	expected := []record{
+		{OpSet, 5, ""},
+		{OpGet, 5, ""},
+		{OpGet, 0, "unknown_key"},
+		{OpRename, 0, ""},
+		{OpRemove, 0, "unknown_key"},
+		{OpKeys, 2, ""},
+	}
+	if !reflect.DeepEqual(r.records, expected) {
+		t.Errorf("expecting records %v, got %v", expected, r.records)
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	for n, test := range [...]struct {
+		Err  error
+		Kind string
+	}{
+		{nil, ""},
+		{ErrUnknownKey, "unknown_key"},
+		{fmt.Errorf("wrapped: %w", ErrQuotaExceeded), "quota_exceeded"},
+		{ErrCorrupt, "corrupt"},
+		{ErrUnknownVersion, "unknown_version"},
+		{ErrQuorum, "quorum"},
+		{errors.New("other"), "other"},
+	} {
+		if kind := ErrorKind(test.Err); kind != test.Kind {
+			t.Errorf("test %d: expecting kind %q, got %q", n+1, test.Kind, kind)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package keystore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UndecodableError is returned by FileStore.KeysErr when entries in the base
+// directory cannot be decoded to keys by the Mangler.
+type UndecodableError struct {
+	Paths []string
+}
+
+func (u *UndecodableError) Error() string {
+	return fmt.Sprintf("%d undecodable entries: %s", len(u.Paths), strings.Join(u.Paths, ", "))
+}
+
+// KeysErr returns a sorted slice of all of the keys in the Store.
+//
+// When the Store has a KeysErr method, it is used to retrieve the keys,
+// returning any error it encounters; otherwise the result of Keys is returned
+// with a nil error.
+func KeysErr(store Store) ([]string, error) {
+	if k, ok := store.(interface{ KeysErr() ([]string, error) }); ok {
+		return k.KeysErr()
+	}
+
+	return store.Keys(), nil
+}
@@ -0,0 +1,50 @@
+package keystore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeysErr(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir, "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	fs.Set("a", data("1"))
+	fs.Set("b", data("2"))
+	var ms MemStore
+	ms.init()
+	ms.Set("ns/c", data("3"))
+	if keys, err := fs.KeysErr(); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("test 1: expecting keys [a b], got %v", keys)
+	}
+	os.WriteFile(filepath.Join(dir, "!!!"), nil, 0o600)
+	var u *UndecodableError
+	if keys, err := KeysErr(ReadOnly(fs)); !errors.As(err, &u) {
+		t.Errorf("test 2: expecting UndecodableError, got %v", err)
+	} else if !reflect.DeepEqual(u.Paths, []string{"!!!"}) {
+		t.Errorf("test 2: expecting paths [!!!], got %v", u.Paths)
+	} else if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("test 2: expecting keys [a b], got %v", keys)
+	}
+	os.RemoveAll(dir)
+	if keys, err := Namespace(fs, "ns/").(interface{ KeysErr() ([]string, error) }).KeysErr(); err == nil || errors.As(err, &u) {
+		t.Errorf("test 3: expecting read error, got %v", err)
+	} else if len(keys) != 0 {
+		t.Errorf("test 3: expecting no keys, got %v", keys)
+	} else if keys = fs.Keys(); len(keys) != 0 {
+		t.Errorf("test 4: expecting no keys, got %v", keys)
+	}
+	if keys, err := KeysErr(Namespace(&ms, "ns/")); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Errorf("test 5: expecting keys [c], got %v", keys)
+	}
+}
@@ -17,7 +17,16 @@ type Store interface {
 
 // Errors.
 var (
-	ErrUnknownKey = errors.New("key not found")
-	ErrKeyExists  = errors.New("key already exists")
-	ErrInvalidKey = errors.New("key contains invalid characters")
+	ErrUnknownKey     = errors.New("key not found")
+	ErrKeyExists      = errors.New("key already exists")
+	ErrInvalidKey     = errors.New("key contains invalid characters")
+	ErrReadOnly       = errors.New("store is read-only")
+	ErrDenied         = errors.New("access denied")
+	ErrQuotaExceeded  = errors.New("quota exceeded")
+	ErrCorrupt        = errors.New("data is corrupt")
+	ErrUnknownVersion = errors.New("version not found")
+	ErrQuorum         = errors.New("write quorum not reached")
+	ErrUnknownShard   = errors.New("shard not found")
+	ErrShardExists    = errors.New("shard already exists")
+	ErrNoShards       = errors.New("at least one shard is required")
 )
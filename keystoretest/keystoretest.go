@@ -0,0 +1,300 @@
+// Package keystoretest provides a conformance suite for implementations of the
+// keystore.Store interface.
+package keystoretest // import "vimagination.zapto.org/keystore/keystoretest"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"vimagination.zapto.org/keystore"
+	"vimagination.zapto.org/memio"
+)
+
+// Factory creates a new, empty Store for a test. Any cleanup required should
+// be registered with t.Cleanup.
+type Factory func(t *testing.T) keystore.Store
+
+// Sequences is the number of randomised operation sequences run by Run, and
+// Operations is the number of operations in each sequence.
+var (
+	Sequences  = 8
+	Operations = 200
+)
+
+// Goroutines is the number of goroutines used by the concurrent stress test,
+// and Iterations is the number of operations performed by each goroutine.
+var (
+	Goroutines = 8
+	Iterations = 100
+)
+
+// Run runs the conformance suite against Stores created by the given Factory.
+//
+// The suite checks the basic behaviour of each method, runs randomised
+// sequences of operations against a model map, and runs concurrent operations
+// that should be run with the race detector enabled.
+//
+// Keys used by the suite consist of lowercase letters and digits, with some
+// containing a single '/'. A Store may either replace an existing key on
+// Rename, or refuse with ErrKeyExists.
+func Run(t *testing.T, factory Factory) {
+	t.Run("Basic", func(t *testing.T) {
+		testBasic(t, factory(t))
+	})
+	t.Run("Random", func(t *testing.T) {
+		for seed := 1; seed <= Sequences; seed++ {
+			testRandom(t, factory(t), int64(seed))
+		}
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		testConcurrent(t, factory(t))
+	})
+}
+
+func get(s keystore.Store, key string) (string, error) {
+	var buf memio.Buffer
+
+	err := s.Get(key, &buf)
+
+	return string(buf), err
+}
+
+func set(s keystore.Store, key, value string) error {
+	buf := memio.Buffer(value)
+
+	return s.Set(key, &buf)
+}
+
+func testBasic(t *testing.T, s keystore.Store) {
+	t.Helper()
+
+	if _, err := get(s, "none"); !errors.Is(err, keystore.ErrUnknownKey) {
+		t.Errorf("test 1: expecting ErrUnknownKey, got %v", err)
+	} else if err = s.Remove("none"); !errors.Is(err, keystore.ErrUnknownKey) {
+		t.Errorf("test 2: expecting ErrUnknownKey, got %v", err)
+	} else if err = s.Rename("none", "other"); !errors.Is(err, keystore.ErrUnknownKey) {
+		t.Errorf("test 3: expecting ErrUnknownKey, got %v", err)
+	} else if keys := s.Keys(); len(keys) != 0 {
+		t.Errorf("test 4: expecting no keys, got %v", keys)
+	} else if err = set(s, "empty", ""); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if v, err := get(s, "empty"); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if v != "" {
+		t.Errorf("test 6: expecting empty value, got %q", v)
+	} else if err = set(s, "key", "Hello"); err != nil {
+		t.Errorf("test 7: unexpected error: %s", err)
+	} else if err = set(s, "key", "Hello, World!"); err != nil {
+		t.Errorf("test 8: unexpected error: %s", err)
+	} else if v, err = get(s, "key"); err != nil {
+		t.Errorf("test 9: unexpected error: %s", err)
+	} else if v != "Hello, World!" {
+		t.Errorf("test 9: expecting value %q, got %q", "Hello, World!", v)
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"empty", "key"}) {
+		t.Errorf("test 10: expecting keys [empty key], got %v", keys)
+	} else if err = s.Rename("key", "dir/key"); err != nil {
+		t.Errorf("test 11: unexpected error: %s", err)
+	} else if _, err = get(s, "key"); !errors.Is(err, keystore.ErrUnknownKey) {
+		t.Errorf("test 12: expecting ErrUnknownKey, got %v", err)
+	} else if v, err = get(s, "dir/key"); err != nil {
+		t.Errorf("test 13: unexpected error: %s", err)
+	} else if v != "Hello, World!" {
+		t.Errorf("test 13: expecting value %q, got %q", "Hello, World!", v)
+	} else if err = s.Remove("dir/key"); err != nil {
+		t.Errorf("test 14: unexpected error: %s", err)
+	} else if err = s.Remove("dir/key"); !errors.Is(err, keystore.ErrUnknownKey) {
+		t.Errorf("test 15: expecting ErrUnknownKey, got %v", err)
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"empty"}) {
+		t.Errorf("test 16: expecting keys [empty], got %v", keys)
+	}
+}
+
+var randomKeys = [...]string{"a", "b", "c", "dir/a", "dir/b", "other/c"}
+
+func randomValue(r *rand.Rand) string {
+	value := make([]byte, r.Intn(64))
+
+	r.Read(value)
+
+	return string(value)
+}
+
+func modelKeys(model map[string]string) []string {
+	keys := make([]string, 0, len(model))
+
+	for key := range model {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func testRandom(t *testing.T, s keystore.Store, seed int64) {
+	t.Helper()
+
+	r := rand.New(rand.NewSource(seed))
+	model := make(map[string]string)
+	exists, _ := s.(interface{ Exists(string) bool })
+
+	for n := 0; n < Operations; n++ {
+		key := randomKeys[r.Intn(len(randomKeys))]
+		expected, ok := model[key]
+		prefix := fmt.Sprintf("seed %d, op %d", seed, n+1)
+
+		switch r.Intn(5) {
+		case 0, 1:
+			value := randomValue(r)
+
+			if err := set(s, key, value); err != nil {
+				t.Errorf("%s: unexpected error setting key %q: %s", prefix, key, err)
+
+				return
+			}
+
+			model[key] = value
+		case 2:
+			err := s.Remove(key)
+			if !ok && !errors.Is(err, keystore.ErrUnknownKey) {
+				t.Errorf("%s: expecting ErrUnknownKey removing key %q, got %v", prefix, key, err)
+
+				return
+			} else if ok && err != nil {
+				t.Errorf("%s: unexpected error removing key %q: %s", prefix, key, err)
+
+				return
+			}
+
+			delete(model, key)
+		case 3:
+			newkey := randomKeys[r.Intn(len(randomKeys))]
+			if newkey == key {
+				continue
+			}
+
+			_, replace := model[newkey]
+
+			err := s.Rename(key, newkey)
+			if !ok {
+				if !errors.Is(err, keystore.ErrUnknownKey) {
+					t.Errorf("%s: expecting ErrUnknownKey renaming key %q, got %v", prefix, key, err)
+
+					return
+				}
+			} else if replace && errors.Is(err, keystore.ErrKeyExists) {
+				continue
+			} else if err != nil {
+				t.Errorf("%s: unexpected error renaming key %q to %q: %s", prefix, key, newkey, err)
+
+				return
+			} else {
+				model[newkey] = expected
+
+				delete(model, key)
+			}
+		case 4:
+			if keys, expectedKeys := s.Keys(), modelKeys(model); !reflect.DeepEqual(keys, expectedKeys) && (len(keys) != 0 || len(expectedKeys) != 0) {
+				t.Errorf("%s: expecting keys %q, got %q", prefix, expectedKeys, keys)
+
+				return
+			}
+		}
+
+		for _, key := range randomKeys {
+			expected, ok := model[key]
+
+			v, err := get(s, key)
+			if !ok && !errors.Is(err, keystore.ErrUnknownKey) {
+				t.Errorf("%s: expecting ErrUnknownKey getting key %q, got %v", prefix, key, err)
+
+				return
+			} else if ok && err != nil {
+				t.Errorf("%s: unexpected error getting key %q: %s", prefix, key, err)
+
+				return
+			} else if v != expected {
+				t.Errorf("%s: expecting value %q for key %q, got %q", prefix, expected, key, v)
+
+				return
+			} else if exists != nil && exists.Exists(key) != ok {
+				t.Errorf("%s: expecting Exists(%q) to return %v", prefix, key, ok)
+
+				return
+			}
+		}
+	}
+}
+
+func testConcurrent(t *testing.T, s keystore.Store) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+
+	for n := 0; n < Goroutines; n++ {
+		wg.Add(1)
+
+		go func(n int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("worker%d", n)
+			moved := "moved/" + key
+			shared := fmt.Sprintf("shared%d", n%2)
+			value := string(bytes.Repeat([]byte{byte(n)}, 32))
+
+			for i := 0; i < Iterations; i++ {
+				if err := set(s, key, value); err != nil {
+					t.Errorf("worker %d: unexpected error setting key: %s", n, err)
+
+					return
+				} else if v, err := get(s, key); err != nil {
+					t.Errorf("worker %d: unexpected error getting key: %s", n, err)
+
+					return
+				} else if v != value {
+					t.Errorf("worker %d: expecting value %q, got %q", n, value, v)
+
+					return
+				} else if err = s.Rename(key, moved); err != nil {
+					t.Errorf("worker %d: unexpected error renaming key: %s", n, err)
+
+					return
+				} else if v, err = get(s, moved); err != nil || v != value {
+					t.Errorf("worker %d: expecting value %q for renamed key, got %q (%v)", n, value, v, err)
+
+					return
+				} else if err = s.Remove(moved); err != nil {
+					t.Errorf("worker %d: unexpected error removing key: %s", n, err)
+
+					return
+				} else if err = set(s, shared, value); err != nil {
+					t.Errorf("worker %d: unexpected error setting shared key: %s", n, err)
+
+					return
+				} else if _, err = get(s, shared); err != nil {
+					t.Errorf("worker %d: unexpected error getting shared key: %s", n, err)
+
+					return
+				} else if keys := s.Keys(); !sort.StringsAreSorted(keys) {
+					t.Errorf("worker %d: expecting sorted keys, got %q", n, keys)
+
+					return
+				}
+			}
+		}(n)
+	}
+
+	wg.Wait()
+
+	for _, key := range s.Keys() {
+		if key != "shared0" && key != "shared1" {
+			t.Errorf("unexpected key remaining after concurrent test: %q", key)
+		}
+	}
+}
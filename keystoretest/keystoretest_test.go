@@ -0,0 +1,203 @@
+package keystoretest
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"vimagination.zapto.org/keystore"
+)
+
+func TestMemStore(t *testing.T) {
+	Run(t, func(*testing.T) keystore.Store {
+		return keystore.NewMemStore()
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	for _, test := range [...]struct {
+		Name    string
+		Mangler keystore.Mangler
+		Tmp     bool
+	}{
+		{"Base64", keystore.Base64Mangler, false},
+		{"Base64Tmp", keystore.Base64Mangler, true},
+		{"NoMangle", keystore.NoMangle, false},
+		{"NoMangleTmp", keystore.NoMangle, true},
+	} {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			Run(t, func(t *testing.T) keystore.Store {
+				var tmp string
+				if test.Tmp {
+					tmp = t.TempDir()
+				}
+				s, err := keystore.NewFileStore(t.TempDir(), tmp, test.Mangler)
+				if err != nil {
+					t.Fatalf("received unexpected error creating FileStore: %s", err)
+				}
+				return s
+			})
+		})
+	}
+}
+
+func TestFileBackedMemStore(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		s, err := keystore.NewFileBackedMemStore(t.TempDir(), t.TempDir(), keystore.NoMangle)
+		if err != nil {
+			t.Fatalf("received unexpected error creating FileBackedMemStore: %s", err)
+		}
+		return s
+	})
+}
+
+func TestLogStore(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		s, err := keystore.NewLogStore(t.TempDir(), 1024, 0)
+		if err != nil {
+			t.Fatalf("received unexpected error creating LogStore: %s", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestPersistentMemStore(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		s, err := keystore.NewPersistentMemStore(t.TempDir(), keystore.SyncNever, 0)
+		if err != nil {
+			t.Fatalf("received unexpected error creating PersistentMemStore: %s", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestBTreeStore(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		s, err := keystore.NewBTreeStore(filepath.Join(t.TempDir(), "btree"), keystore.SyncNever)
+		if err != nil {
+			t.Fatalf("received unexpected error creating BTreeStore: %s", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestNamespace(t *testing.T) {
+	Run(t, func(*testing.T) keystore.Store {
+		return keystore.NewMemStore().Sub("ns")
+	})
+}
+
+func TestFileStoreSub(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		s, err := keystore.NewFileStore(t.TempDir(), "", keystore.NoMangle)
+		if err != nil {
+			t.Fatalf("received unexpected error creating FileStore: %s", err)
+		}
+		return s.Sub("ns")
+	})
+}
+
+func TestInstrumented(t *testing.T) {
+	Run(t, func(*testing.T) keystore.Store {
+		return keystore.Instrumented(keystore.NewMemStore(), keystore.NewPrometheusRecorder(""))
+	})
+}
+
+func TestAudited(t *testing.T) {
+	Run(t, func(*testing.T) keystore.Store {
+		return keystore.Audited(context.Background(), keystore.NewMemStore(), keystore.NewAuditLog(io.Discard))
+	})
+}
+
+func TestVersionedStore(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		history, err := keystore.NewFileStore(t.TempDir(), "", nil)
+		if err != nil {
+			t.Fatalf("received unexpected error creating FileStore: %s", err)
+		}
+
+		vs, err := keystore.NewVersionedStore(keystore.NewMemStore(), history, keystore.VersionPolicy{MaxVersions: 3})
+		if err != nil {
+			t.Fatalf("received unexpected error creating VersionedStore: %s", err)
+		}
+
+		return vs
+	})
+}
+
+func TestDedupStore(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		blobs, err := keystore.NewFileStore(t.TempDir(), "", nil)
+		if err != nil {
+			t.Fatalf("received unexpected error creating FileStore: %s", err)
+		}
+
+		ds, err := keystore.NewDedupStore(keystore.NewMemStore(), blobs)
+		if err != nil {
+			t.Fatalf("received unexpected error creating DedupStore: %s", err)
+		}
+
+		return ds
+	})
+}
+
+func TestTiered(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		last, err := keystore.NewFileStore(t.TempDir(), "", nil)
+		if err != nil {
+			t.Fatalf("received unexpected error creating FileStore: %s", err)
+		}
+
+		ts := keystore.Tiered(keystore.NewMemStore(), keystore.NewMemStore(), last)
+
+		ts.SetCapacity(0, 256)
+		ts.SetCapacity(1, 1024)
+
+		return ts
+	})
+}
+
+func TestTieredWriteBack(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		ts := keystore.Tiered(keystore.NewMemStore(), keystore.NewMemStore(), keystore.NewMemStore())
+
+		ts.SetWriteBack(true)
+		ts.SetCapacity(0, 128)
+		ts.SetCapacity(1, 256)
+
+		return ts
+	})
+}
+
+func TestMirror(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		replica, err := keystore.NewFileStore(t.TempDir(), "", nil)
+		if err != nil {
+			t.Fatalf("received unexpected error creating FileStore: %s", err)
+		}
+
+		m := keystore.Mirror(keystore.NewMemStore(), replica, keystore.NewMemStore())
+
+		if err = m.SetMetadata(keystore.NewMemStore(), keystore.NewMemStore(), keystore.NewMemStore()); err != nil {
+			t.Fatalf("received unexpected error setting metadata: %s", err)
+		}
+
+		return m
+	})
+}
+
+func TestSharded(t *testing.T) {
+	Run(t, func(t *testing.T) keystore.Store {
+		shard, err := keystore.NewFileStore(t.TempDir(), "", nil)
+		if err != nil {
+			t.Fatalf("received unexpected error creating FileStore: %s", err)
+		}
+
+		return keystore.Sharded(keystore.NewMemStore(), shard, keystore.NewMemStore())
+	})
+}
@@ -0,0 +1,734 @@
+package keystore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+const (
+	recordSet uint8 = iota
+	recordRemove
+	recordRename
+	recordMerge
+)
+
+const (
+	segmentExt = ".seg"
+	hintExt    = ".hint"
+	mergeExt   = ".merge"
+
+	// DefaultMaxSegmentSize is the segment size used by NewLogStore when a
+	// non-positive size is given.
+	DefaultMaxSegmentSize = 64 << 20
+)
+
+type logEntry struct {
+	segment      uint64
+	offset, size int64
+}
+
+// LogStore implements the Store interface and keeps all values in append-only
+// segment files, with an in-memory index of key locations.
+type LogStore struct {
+	mu             sync.RWMutex
+	dir            string
+	maxSegmentSize int64
+	index          map[string]logEntry
+	segments       map[uint64]*os.File
+	active         uint64
+	activeSize     int64
+	merged         uint64
+	hasMerged      bool
+	validator      KeyValidator
+
+	mergeMu   sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewLogStore opens, or creates, a log-structured store in the given
+// directory, rebuilding the index from any existing hint and segment files.
+//
+// A new segment is started once the active segment grows beyond
+// maxSegmentSize. A positive mergeInterval starts a background goroutine that
+// calls Merge at that interval until the store is Closed.
+func NewLogStore(dir string, maxSegmentSize int64, mergeInterval time.Duration) (*LogStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating data dir: %w", err)
+	}
+
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultMaxSegmentSize
+	}
+
+	ls := &LogStore{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		index:          make(map[string]logEntry),
+		segments:       make(map[uint64]*os.File),
+		done:           make(chan struct{}),
+	}
+
+	if err := ls.load(); err != nil {
+		ls.closeSegments()
+
+		return nil, err
+	}
+
+	if mergeInterval > 0 {
+		ls.wg.Add(1)
+
+		go ls.mergeLoop(mergeInterval)
+	}
+
+	return ls, nil
+}
+
+func (ls *LogStore) segmentPath(id uint64, ext string) string {
+	return filepath.Join(ls.dir, fmt.Sprintf("%016x%s", id, ext))
+}
+
+func (ls *LogStore) load() error {
+	entries, err := os.ReadDir(ls.dir)
+	if err != nil {
+		return fmt.Errorf("error reading data dir: %w", err)
+	}
+
+	var ids []uint64
+
+	for _, e := range entries {
+		name := e.Name()
+
+		if strings.HasSuffix(name, mergeExt) {
+			os.Remove(filepath.Join(ls.dir, name))
+
+			continue
+		} else if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		if ls.isMerged(ids[i]) {
+			for _, id := range ids[:i] {
+				os.Remove(ls.segmentPath(id, segmentExt))
+				os.Remove(ls.segmentPath(id, hintExt))
+			}
+
+			ls.merged = ids[i]
+			ls.hasMerged = true
+			ids = ids[i:]
+
+			break
+		}
+	}
+
+	for n, id := range ids {
+		f, err := os.OpenFile(ls.segmentPath(id, segmentExt), os.O_RDWR, 0o600)
+		if err != nil {
+			return fmt.Errorf("error opening segment: %w", err)
+		}
+
+		ls.segments[id] = f
+
+		if ls.hasMerged && id == ls.merged && ls.loadHint(id, f) {
+			continue
+		}
+
+		size, err := ls.scanSegment(id, f)
+		if err != nil {
+			if n != len(ids)-1 {
+				return err
+			}
+
+			if err = f.Truncate(size); err != nil {
+				return fmt.Errorf("error truncating segment: %w", err)
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return ls.newSegment(0)
+	}
+
+	ls.active = ids[len(ids)-1]
+
+	fi, err := ls.segments[ls.active].Stat()
+	if err != nil {
+		return fmt.Errorf("error reading segment size: %w", err)
+	}
+
+	ls.activeSize = fi.Size()
+
+	return nil
+}
+
+func (ls *LogStore) isMerged(id uint64) bool {
+	f, err := os.Open(ls.segmentPath(id, segmentExt))
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	var buf [5]byte
+
+	if _, err = io.ReadFull(f, buf[:]); err != nil {
+		return false
+	}
+
+	return buf[4] == recordMerge && binary.LittleEndian.Uint32(buf[:4]) == crc32.ChecksumIEEE(buf[4:])
+}
+
+type crcReader struct {
+	io.Reader
+	hash hash.Hash32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+
+	c.hash.Write(p[:n])
+
+	return n, err
+}
+
+func (ls *LogStore) scanSegment(id uint64, f *os.File) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	cr := crcReader{Reader: bufio.NewReader(f), hash: crc32.NewIEEE()}
+	lr := byteio.StickyLittleEndianReader{Reader: &cr}
+
+	for {
+		start := lr.Count
+		crc := lr.ReadUint32()
+
+		if errors.Is(lr.Err, io.EOF) && lr.Count == start {
+			return start, nil
+		}
+
+		cr.hash.Reset()
+
+		var apply func()
+
+		switch lr.ReadUint8() {
+		case recordSet:
+			key := string(readBuffer(&lr, lr.ReadUintX()))
+			size := int64(lr.ReadUintX())
+			e := logEntry{segment: id, offset: lr.Count, size: size}
+
+			io.CopyN(io.Discard, &lr, size)
+
+			apply = func() { ls.index[key] = e }
+		case recordRemove:
+			key := string(readBuffer(&lr, lr.ReadUintX()))
+
+			apply = func() { delete(ls.index, key) }
+		case recordRename:
+			oldkey := string(readBuffer(&lr, lr.ReadUintX()))
+			newkey := string(readBuffer(&lr, lr.ReadUintX()))
+
+			apply = func() {
+				if e, ok := ls.index[oldkey]; ok {
+					ls.index[newkey] = e
+
+					delete(ls.index, oldkey)
+				}
+			}
+		case recordMerge:
+			apply = func() {}
+		default:
+			return start, fmt.Errorf("%w: unknown record type", ErrCorrupt)
+		}
+
+		if lr.Err != nil {
+			return start, fmt.Errorf("%w: %s", ErrCorrupt, lr.Err)
+		} else if cr.hash.Sum32() != crc {
+			return start, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+		}
+
+		apply()
+	}
+}
+
+func (ls *LogStore) loadHint(id uint64, f *os.File) bool {
+	h, err := os.Open(ls.segmentPath(id, hintExt))
+	if err != nil {
+		return false
+	}
+
+	defer h.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	lr := byteio.StickyLittleEndianReader{Reader: bufio.NewReader(h)}
+
+	if int64(lr.ReadUintX()) != fi.Size() {
+		return false
+	}
+
+	entries := make(map[string]logEntry)
+
+	for {
+		size := lr.ReadUintX()
+
+		if errors.Is(lr.Err, io.EOF) {
+			break
+		}
+
+		key := string(readBuffer(&lr, size))
+
+		entries[key] = logEntry{segment: id, offset: int64(lr.ReadUintX()), size: int64(lr.ReadUintX())}
+
+		if lr.Err != nil {
+			return false
+		}
+	}
+
+	for key, e := range entries {
+		ls.index[key] = e
+	}
+
+	return true
+}
+
+func (ls *LogStore) newSegment(id uint64) error {
+	f, err := os.OpenFile(ls.segmentPath(id, segmentExt), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating segment: %w", err)
+	}
+
+	ls.segments[id] = f
+	ls.active = id
+	ls.activeSize = 0
+
+	return nil
+}
+
+func encodeRecord(typ uint8, value []byte, keys ...string) []byte {
+	var buf memio.Buffer
+
+	lw := byteio.StickyLittleEndianWriter{Writer: &buf}
+
+	lw.WriteUint32(0)
+	lw.WriteUint8(typ)
+
+	for _, key := range keys {
+		lw.WriteStringX(key)
+	}
+
+	if typ == recordSet {
+		lw.WriteUintX(uint64(len(value)))
+		lw.Write(value)
+	}
+
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
+
+	return buf
+}
+
+func (ls *LogStore) write(record []byte) (int64, error) {
+	if ls.activeSize > 0 && ls.activeSize+int64(len(record)) > ls.maxSegmentSize {
+		if err := ls.segments[ls.active].Sync(); err != nil {
+			return 0, fmt.Errorf("error syncing segment: %w", err)
+		}
+
+		if err := ls.newSegment(ls.active + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	f := ls.segments[ls.active]
+	start := ls.activeSize
+
+	if _, err := f.WriteAt(record, start); err != nil {
+		f.Truncate(start)
+
+		return 0, fmt.Errorf("error writing to segment: %w", err)
+	}
+
+	ls.activeSize += int64(len(record))
+
+	return start, nil
+}
+
+// Get retrieves the key data from its segment file.
+func (ls *LogStore) Get(key string, r io.ReaderFrom) error {
+	if err := validateKeys(ls.validator, key); err != nil {
+		return err
+	}
+
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	e, ok := ls.index[key]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	_, err := r.ReadFrom(io.NewSectionReader(ls.segments[e.segment], e.offset, e.size))
+
+	return err
+}
+
+// Set appends the key data to the active segment.
+func (ls *LogStore) Set(key string, w io.WriterTo) error {
+	if err := validateKeys(ls.validator, key); err != nil {
+		return err
+	}
+
+	var buf memio.Buffer
+
+	if _, err := w.WriteTo(&buf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	record := encodeRecord(recordSet, buf, key)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	start, err := ls.write(record)
+	if err != nil {
+		return err
+	}
+
+	ls.index[key] = logEntry{
+		segment: ls.active,
+		offset:  start + int64(len(record)-len(buf)),
+		size:    int64(len(buf)),
+	}
+
+	return nil
+}
+
+// Remove appends a tombstone for the key to the active segment.
+func (ls *LogStore) Remove(key string) error {
+	if err := validateKeys(ls.validator, key); err != nil {
+		return err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if _, ok := ls.index[key]; !ok {
+		return ErrUnknownKey
+	}
+
+	if _, err := ls.write(encodeRecord(recordRemove, nil, key)); err != nil {
+		return err
+	}
+
+	delete(ls.index, key)
+
+	return nil
+}
+
+// Keys returns a sorted slice of all of the keys.
+func (ls *LogStore) Keys() []string {
+	ls.mu.RLock()
+
+	s := make([]string, 0, len(ls.index))
+
+	for key := range ls.index {
+		s = append(s, key)
+	}
+
+	ls.mu.RUnlock()
+
+	sort.Strings(s)
+
+	return s
+}
+
+// KeysErr returns a sorted slice of all of the keys. The error is always nil,
+// as the keys are held in memory.
+func (ls *LogStore) KeysErr() ([]string, error) {
+	return ls.Keys(), nil
+}
+
+// Exists returns true when the key exists within the store.
+func (ls *LogStore) Exists(key string) bool {
+	if validateKeys(ls.validator, key) != nil {
+		return false
+	}
+
+	ls.mu.RLock()
+	_, ok := ls.index[key]
+	ls.mu.RUnlock()
+
+	return ok
+}
+
+// Rename moves data from an existing key to a new, unused key.
+func (ls *LogStore) Rename(oldkey, newkey string) error {
+	if err := validateKeys(ls.validator, oldkey, newkey); err != nil {
+		return err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	e, ok := ls.index[oldkey]
+	if !ok {
+		return ErrUnknownKey
+	} else if _, ok = ls.index[newkey]; ok {
+		return ErrKeyExists
+	}
+
+	if _, err := ls.write(encodeRecord(recordRename, nil, oldkey, newkey)); err != nil {
+		return err
+	}
+
+	ls.index[newkey] = e
+
+	delete(ls.index, oldkey)
+
+	return nil
+}
+
+// Merge compacts all of the inactive segments into a single segment that
+// contains only live data, writing a hint file to speed up the next open.
+func (ls *LogStore) Merge() error {
+	ls.mergeMu.Lock()
+	defer ls.mergeMu.Unlock()
+
+	ls.mu.RLock()
+
+	var ids []uint64
+
+	for id := range ls.segments {
+		if id != ls.active {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 || len(ids) == 1 && ls.hasMerged && ids[0] == ls.merged {
+		ls.mu.RUnlock()
+
+		return nil
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	target := ids[len(ids)-1]
+	live := make(map[string]logEntry)
+	files := make(map[uint64]*os.File, len(ids))
+
+	for key, e := range ls.index {
+		if e.segment <= target {
+			live[key] = e
+		}
+	}
+
+	for _, id := range ids {
+		files[id] = ls.segments[id]
+	}
+
+	ls.mu.RUnlock()
+
+	moved, hint, err := ls.writeMerged(target, live, files)
+	if err != nil {
+		os.Remove(ls.segmentPath(target, mergeExt))
+
+		return err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if err = os.Rename(ls.segmentPath(target, mergeExt), ls.segmentPath(target, segmentExt)); err != nil {
+		os.Remove(ls.segmentPath(target, mergeExt))
+
+		return fmt.Errorf("error moving merged segment: %w", err)
+	}
+
+	f, err := os.OpenFile(ls.segmentPath(target, segmentExt), os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening merged segment: %w", err)
+	}
+
+	for key, e := range ls.index {
+		if e.segment <= target {
+			ls.index[key] = moved[e]
+		}
+	}
+
+	for _, id := range ids {
+		ls.segments[id].Close()
+
+		delete(ls.segments, id)
+
+		if id != target {
+			os.Remove(ls.segmentPath(id, segmentExt))
+			os.Remove(ls.segmentPath(id, hintExt))
+		}
+	}
+
+	ls.segments[target] = f
+	ls.merged = target
+	ls.hasMerged = true
+
+	return ls.writeHint(target, hint)
+}
+
+func (ls *LogStore) writeMerged(target uint64, live map[string]logEntry, files map[uint64]*os.File) (map[logEntry]logEntry, memio.Buffer, error) {
+	f, err := os.OpenFile(ls.segmentPath(target, mergeExt), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating merge segment: %w", err)
+	}
+
+	defer f.Close()
+
+	var (
+		hint memio.Buffer
+		size int64
+	)
+
+	moved := make(map[logEntry]logEntry, len(live))
+	bw := bufio.NewWriter(f)
+	hw := byteio.StickyLittleEndianWriter{Writer: &hint}
+	record := encodeRecord(recordMerge, nil)
+
+	bw.Write(record)
+
+	size += int64(len(record))
+
+	for key, e := range live {
+		value := make([]byte, e.size)
+
+		if _, err = files[e.segment].ReadAt(value, e.offset); err != nil {
+			return nil, nil, fmt.Errorf("error reading segment: %w", err)
+		}
+
+		record = encodeRecord(recordSet, value, key)
+		ne := logEntry{segment: target, offset: size + int64(len(record)) - e.size, size: e.size}
+		moved[e] = ne
+
+		if _, err = bw.Write(record); err != nil {
+			return nil, nil, fmt.Errorf("error writing merge segment: %w", err)
+		}
+
+		size += int64(len(record))
+
+		hw.WriteStringX(key)
+		hw.WriteUintX(uint64(ne.offset))
+		hw.WriteUintX(uint64(ne.size))
+	}
+
+	if err = bw.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("error writing merge segment: %w", err)
+	} else if err = f.Sync(); err != nil {
+		return nil, nil, fmt.Errorf("error syncing merge segment: %w", err)
+	}
+
+	var buf memio.Buffer
+
+	lw := byteio.StickyLittleEndianWriter{Writer: &buf}
+
+	lw.WriteUintX(uint64(size))
+	lw.Write(hint)
+
+	return moved, buf, nil
+}
+
+func (ls *LogStore) writeHint(id uint64, hint memio.Buffer) error {
+	tmp := ls.segmentPath(id, hintExt+mergeExt)
+
+	if err := os.WriteFile(tmp, hint, 0o600); err != nil {
+		os.Remove(tmp)
+
+		return fmt.Errorf("error writing hint file: %w", err)
+	}
+
+	if err := os.Rename(tmp, ls.segmentPath(id, hintExt)); err != nil {
+		os.Remove(tmp)
+
+		return fmt.Errorf("error moving hint file: %w", err)
+	}
+
+	return nil
+}
+
+func (ls *LogStore) mergeLoop(interval time.Duration) {
+	defer ls.wg.Done()
+
+	t := time.NewTicker(interval)
+
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			ls.Merge()
+		case <-ls.done:
+			return
+		}
+	}
+}
+
+func (ls *LogStore) closeSegments() error {
+	var err error
+
+	for id, f := range ls.segments {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+
+		delete(ls.segments, id)
+	}
+
+	return err
+}
+
+// Close stops any background merging and closes all segment files.
+// Subsequent calls return the result of the first.
+func (ls *LogStore) Close() error {
+	ls.closeOnce.Do(func() {
+		close(ls.done)
+		ls.wg.Wait()
+		ls.mergeMu.Lock()
+		defer ls.mergeMu.Unlock()
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+
+		if f, ok := ls.segments[ls.active]; ok {
+			f.Sync()
+		}
+
+		ls.closeErr = ls.closeSegments()
+	})
+
+	return ls.closeErr
+}
@@ -0,0 +1,136 @@
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+func TestLogStore(t *testing.T) {
+	s, err := NewLogStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Errorf("received unexpected error creating LogStore: %s", err)
+		return
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestLogStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLogStore(dir, 64, 0)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	s.Set("key1", data("data1"))
+	s.Set("key2", data("data2"))
+	s.Set("key3", data("data3"))
+	s.Set("key1", data("newData1"))
+	s.Remove("key2")
+	s.Rename("key3", "key4")
+	s.Close()
+	for n, merge := range [...]bool{false, true, false} {
+		s, err = NewLogStore(dir, 64, 0)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+2, err)
+			return
+		}
+		if merge {
+			if err = s.Merge(); err != nil {
+				t.Errorf("test %d: unexpected error merging: %s", n+2, err)
+			}
+		}
+		if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key4"}) {
+			t.Errorf("test %d: expecting keys [key1 key4], got %v", n+2, keys)
+		}
+		for key, val := range map[string]string{"key1": "newData1", "key4": "data3"} {
+			var buf memio.Buffer
+			if err = s.Get(key, &buf); err != nil {
+				t.Errorf("test %d: unexpected error getting %q: %s", n+2, key, err)
+			} else if string(buf) != val {
+				t.Errorf("test %d: expecting value %q for key %q, got %q", n+2, val, key, buf)
+			}
+		}
+		s.Close()
+	}
+	hints, _ := filepath.Glob(filepath.Join(dir, "*"+hintExt))
+	if len(hints) != 1 {
+		t.Errorf("test 5: expecting 1 hint file, got %d", len(hints))
+	}
+}
+
+func TestLogStoreTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLogStore(dir, 0, 0)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	s.Set("key1", data("data1"))
+	s.Set("key2", data("data2"))
+	s.Close()
+	path := s.segmentPath(0, segmentExt)
+	fi, _ := os.Stat(path)
+	os.Truncate(path, fi.Size()-2)
+	if s, err = NewLogStore(dir, 0, 0); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+		return
+	}
+	defer s.Close()
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("test 2: expecting keys [key1], got %v", keys)
+	} else if err = s.Set("key3", data("data3")); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if keys = s.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key3"}) {
+		t.Errorf("test 3: expecting keys [key1 key3], got %v", keys)
+	}
+}
+
+func TestLogStoreCorruptKey(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLogStore(dir, 0, 0)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	s.Set("key1", data("data1"))
+	if err = s.Close(); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = s.Close(); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	}
+	path := s.segmentPath(0, segmentExt)
+	fi, _ := os.Stat(path)
+	h, _ := os.Create(s.segmentPath(0, hintExt))
+	lw := byteio.StickyLittleEndianWriter{Writer: h}
+	lw.WriteUintX(uint64(fi.Size()))
+	lw.WriteUintX(1 << 62)
+	h.Close()
+	if s, err = NewLogStore(dir, 0, 0); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+		return
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("test 3: expecting keys [key1], got %v", keys)
+	}
+	s.Close()
+	os.Remove(s.segmentPath(0, hintExt))
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	lw = byteio.StickyLittleEndianWriter{Writer: f}
+	lw.WriteUint32(0)
+	lw.WriteUint8(recordSet)
+	lw.WriteUintX(1 << 62)
+	f.Close()
+	if s, err = NewLogStore(dir, 0, 0); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+		return
+	}
+	defer s.Close()
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("test 4: expecting keys [key1], got %v", keys)
+	}
+}
@@ -3,6 +3,7 @@ package keystore
 import (
 	"errors"
 	"io"
+	"math"
 	"sort"
 	"sync"
 
@@ -12,8 +13,10 @@ import (
 
 // MemStore implements Store and does so entirely in memory.
 type MemStore struct {
-	mu   sync.RWMutex
-	data map[string]memio.Buffer
+	mu        sync.RWMutex
+	data      map[string]memio.Buffer
+	quota     *quota
+	validator KeyValidator
 }
 
 // NewMemStore creates a new memory-backed key-value store.
@@ -27,10 +30,15 @@ func NewMemStore() *MemStore {
 
 func (ms *MemStore) init() {
 	ms.data = make(map[string]memio.Buffer)
+	ms.quota = new(quota)
 }
 
 // Get retrieves the key data from memory.
 func (ms *MemStore) Get(key string, r io.ReaderFrom) error {
+	if err := validateKeys(ms.validator, key); err != nil {
+		return err
+	}
+
 	d := ms.get(key)
 	if d == nil {
 		return ErrUnknownKey
@@ -46,6 +54,12 @@ func (ms *MemStore) Get(key string, r io.ReaderFrom) error {
 func (ms *MemStore) GetAll(data map[string]io.ReaderFrom) error {
 	var err error
 
+	for k := range data {
+		if err = validateKeys(ms.validator, k); err != nil {
+			return err
+		}
+	}
+
 	ms.mu.RLock()
 
 	for k, d := range data {
@@ -74,17 +88,45 @@ func (ms *MemStore) get(key string) memio.Buffer {
 
 // Set stores the key data in memory.
 func (ms *MemStore) Set(key string, w io.WriterTo) error {
+	if err := validateKeys(ms.validator, key); err != nil {
+		return err
+	}
+
+	res, err := ms.reserve(key)
+	if err != nil {
+		return err
+	}
+
 	d := make(memio.Buffer, 0)
 
-	if _, err := w.WriteTo(&d); err != nil && !errors.Is(err, io.EOF) {
+	if _, err := w.WriteTo(ms.quota.writer(&d, res)); err != nil && !errors.Is(err, io.EOF) {
+		ms.quota.cancel(res, false)
+
 		return err
 	}
 
-	ms.set(key, d)
+	ms.mu.Lock()
+	old, replaced := ms.data[key]
+	ms.data[key] = d
+	ms.mu.Unlock()
+
+	ms.quota.commit(res, replaced, int64(len(old)), int64(len(d)))
 
 	return nil
 }
 
+func (ms *MemStore) reserve(key string) (reservation, error) {
+	if !ms.quota.enabled() {
+		return ms.quota.reserve(key, false, 0, 0)
+	}
+
+	ms.mu.RLock()
+	old, exists := ms.data[key]
+	ms.mu.RUnlock()
+
+	return ms.quota.reserve(key, exists, int64(len(old)), 0)
+}
+
 // SetAll set data for all of the keys given. Useful to reduce locking.
 // Will return the first error found, so may not set all data.
 func (ms *MemStore) SetAll(data map[string]io.WriterTo) error {
@@ -93,13 +135,30 @@ func (ms *MemStore) SetAll(data map[string]io.WriterTo) error {
 	ms.mu.Lock()
 
 	for k, d := range data {
-		var buf memio.Buffer
+		var (
+			buf memio.Buffer
+			res reservation
+		)
+
+		if err = validateKeys(ms.validator, k); err != nil {
+			break
+		}
+
+		old, exists := ms.data[k]
+
+		if res, err = ms.quota.reserve(k, exists, int64(len(old)), 0); err != nil {
+			break
+		}
+
+		if _, err = d.WriteTo(ms.quota.writer(&buf, res)); err != nil {
+			ms.quota.cancel(res, false)
 
-		if _, err = d.WriteTo(&buf); err != nil {
 			break
 		}
 
 		ms.data[k] = buf
+
+		ms.quota.commit(res, exists, int64(len(old)), int64(len(buf)))
 	}
 
 	ms.mu.Unlock()
@@ -115,15 +174,20 @@ func (ms *MemStore) set(key string, d memio.Buffer) {
 
 // Remove deletes the key data from memory.
 func (ms *MemStore) Remove(key string) error {
+	if err := validateKeys(ms.validator, key); err != nil {
+		return err
+	}
+
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
-	_, ok := ms.data[key]
+	d, ok := ms.data[key]
 	if !ok {
 		return ErrUnknownKey
 	}
 
 	delete(ms.data, key)
+	ms.quota.remove(int64(len(d)))
 
 	return nil
 }
@@ -134,7 +198,10 @@ func (ms *MemStore) RemoveAll(keys ...string) {
 	ms.mu.Lock()
 
 	for _, key := range keys {
-		delete(ms.data, key)
+		if d, ok := ms.data[key]; ok {
+			delete(ms.data, key)
+			ms.quota.remove(int64(len(d)))
+		}
 	}
 
 	ms.mu.Unlock()
@@ -166,7 +233,7 @@ func (ms *MemStore) ReadFrom(r io.Reader) (int64, error) {
 	ms.mu.Lock()
 
 	for {
-		key := lr.ReadStringX()
+		size := lr.ReadUintX()
 
 		if errors.Is(lr.Err, io.EOF) {
 			lr.Err = nil
@@ -174,9 +241,8 @@ func (ms *MemStore) ReadFrom(r io.Reader) (int64, error) {
 			break
 		}
 
-		buf := make(memio.Buffer, lr.ReadUintX())
-
-		lr.Read(buf)
+		key := readBuffer(&lr, size)
+		buf := readBuffer(&lr, lr.ReadUintX())
 
 		if lr.Err != nil {
 			if errors.Is(lr.Err, io.EOF) {
@@ -186,14 +252,33 @@ func (ms *MemStore) ReadFrom(r io.Reader) (int64, error) {
 			break
 		}
 
-		ms.data[key] = buf
+		ms.data[string(key)] = buf
 	}
 
+	ms.quota.reset(ms.usage())
 	ms.mu.Unlock()
 
 	return lr.Count, lr.Err
 }
 
+// readBuffer reads size bytes from the reader without trusting size for the
+// initial allocation, so that corrupt input cannot cause a huge allocation.
+func readBuffer(lr *byteio.StickyLittleEndianReader, size uint64) memio.Buffer {
+	buf := make(memio.Buffer, 0)
+
+	if lr.Err != nil {
+		return buf
+	} else if size > math.MaxInt64 {
+		lr.Err = io.ErrUnexpectedEOF
+
+		return buf
+	}
+
+	io.CopyN(&buf, lr, int64(size))
+
+	return buf
+}
+
 // Keys returns a sorted slice of all of the keys.
 func (ms *MemStore) Keys() []string {
 	ms.mu.RLock()
@@ -211,8 +296,17 @@ func (ms *MemStore) Keys() []string {
 	return s
 }
 
+// KeysErr returns a sorted slice of all of the keys. The error is always nil.
+func (ms *MemStore) KeysErr() ([]string, error) {
+	return ms.Keys(), nil
+}
+
 // Exists returns true when the key exists within the store.
 func (ms *MemStore) Exists(key string) bool {
+	if validateKeys(ms.validator, key) != nil {
+		return false
+	}
+
 	ms.mu.RLock()
 	_, ok := ms.data[key]
 	ms.mu.RUnlock()
@@ -222,6 +316,10 @@ func (ms *MemStore) Exists(key string) bool {
 
 // Rename moves data from an existing key to a new, unused key.
 func (ms *MemStore) Rename(oldkey, newkey string) error {
+	if err := validateKeys(ms.validator, oldkey, newkey); err != nil {
+		return err
+	}
+
 	ms.mu.Lock()
 
 	var err error
@@ -230,7 +328,7 @@ func (ms *MemStore) Rename(oldkey, newkey string) error {
 		err = ErrUnknownKey
 	} else if _, ok = ms.data[newkey]; ok {
 		err = ErrKeyExists
-	} else {
+	} else if err = ms.quota.checkKey(newkey); err == nil {
 		ms.data[newkey] = d
 
 		delete(ms.data, oldkey)
@@ -1,6 +1,7 @@
 package keystore
 
 import (
+	"bytes"
 	"io"
 	"reflect"
 	"testing"
@@ -47,3 +48,40 @@ func TestMemStoreReadWrite(t *testing.T) {
 		}
 	}
 }
+
+func FuzzMemStoreReadFrom(f *testing.F) {
+	m := NewMemStore()
+	m.Set("key1", data("data1"))
+	m.Set("key2", data(""))
+	var buf memio.Buffer
+	m.WriteTo(&buf)
+	f.Add([]byte(buf))
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{1, 'a', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	f.Fuzz(func(t *testing.T, input []byte) {
+		m := NewMemStore()
+		if _, err := m.ReadFrom(bytes.NewReader(input)); err != nil {
+			return
+		}
+		var buf memio.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatalf("unexpected error writing store: %s", err)
+		}
+		n := NewMemStore()
+		if _, err := n.ReadFrom(&buf); err != nil {
+			t.Fatalf("unexpected error reading written store: %s", err)
+		}
+		if mKeys, nKeys := m.Keys(), n.Keys(); !reflect.DeepEqual(mKeys, nKeys) {
+			t.Fatalf("expecting keys %q, got %q", mKeys, nKeys)
+		}
+		for _, key := range m.Keys() {
+			var a, b memio.Buffer
+			m.Get(key, &a)
+			n.Get(key, &b)
+			if !bytes.Equal(a, b) {
+				t.Errorf("expecting value %q for key %q, got %q", a, key, b)
+			}
+		}
+	})
+}
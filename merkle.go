@@ -0,0 +1,497 @@
+package keystore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+const (
+	merkleFanout  = 16
+	merkleDepth   = 3
+	merkleBuckets = merkleFanout * merkleFanout * merkleFanout
+)
+
+type merkleHash = [sha256.Size]byte
+
+type merkleEntry struct {
+	key  string
+	hash merkleHash
+}
+
+// MerkleTree is a hash tree over the keys and values of a Store, allowing
+// the differences between two Stores to be found by comparing only the parts
+// of the trees that differ.
+type MerkleTree struct {
+	levels  [merkleDepth + 1][]merkleHash
+	buckets [][]merkleEntry
+}
+
+func merkleBucket(key string) int {
+	sum := sha256.Sum256([]byte(key))
+
+	return (int(sum[0])<<8 | int(sum[1])) % merkleBuckets
+}
+
+// NewMerkleTree builds a MerkleTree from the keys and values in the Store.
+//
+// When the Store has a Hash method, as DedupStore does, it is used instead of
+// reading each value.
+func NewMerkleTree(store Store) (*MerkleTree, error) {
+	keys, err := KeysErr(store)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys: %w", err)
+	}
+
+	hasher, _ := store.(interface{ Hash(string) (string, error) })
+	m := &MerkleTree{buckets: make([][]merkleEntry, merkleBuckets)}
+
+	for _, key := range keys {
+		var hash merkleHash
+
+		if hasher != nil {
+			h, err := hasher.Hash(key)
+			if err != nil {
+				return nil, fmt.Errorf("error hashing key %q: %w", key, err)
+			} else if _, err = hex.Decode(hash[:], []byte(h)); err != nil {
+				return nil, fmt.Errorf("error decoding hash for key %q: %w", key, err)
+			}
+		} else {
+			h := sha256.New()
+
+			if err := store.Get(key, hashReader{h}); errors.Is(err, ErrUnknownKey) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("error reading key %q: %w", key, err)
+			}
+
+			h.Sum(hash[:0])
+		}
+
+		b := merkleBucket(key)
+		m.buckets[b] = append(m.buckets[b], merkleEntry{key: key, hash: hash})
+	}
+
+	m.build()
+
+	return m, nil
+}
+
+type hashReader struct {
+	io.Writer
+}
+
+func (h hashReader) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(h.Writer, r)
+}
+
+func (m *MerkleTree) build() {
+	leaves := make([]merkleHash, merkleBuckets)
+
+	for n, bucket := range m.buckets {
+		sort.Slice(bucket, func(i, j int) bool {
+			return bucket[i].key < bucket[j].key
+		})
+
+		h := sha256.New()
+		lw := byteio.StickyLittleEndianWriter{Writer: h}
+
+		for _, e := range bucket {
+			lw.WriteStringX(e.key)
+			lw.Write(e.hash[:])
+		}
+
+		h.Sum(leaves[n][:0])
+	}
+
+	m.levels[merkleDepth] = leaves
+
+	for l := merkleDepth - 1; l >= 0; l-- {
+		children := m.levels[l+1]
+		nodes := make([]merkleHash, len(children)/merkleFanout)
+
+		for n := range nodes {
+			h := sha256.New()
+
+			for _, child := range children[n*merkleFanout : (n+1)*merkleFanout] {
+				h.Write(child[:])
+			}
+
+			h.Sum(nodes[n][:0])
+		}
+
+		m.levels[l] = nodes
+	}
+}
+
+// Root returns the hash of the whole tree, which is equal for two Stores
+// holding the same keys and values.
+func (m *MerkleTree) Root() [sha256.Size]byte {
+	return m.levels[0][0]
+}
+
+// Diff returns a sorted slice of the keys that are not in both trees with the
+// same value.
+func (m *MerkleTree) Diff(other *MerkleTree) []string {
+	var keys []string
+
+	for _, b := range m.diffBuckets(func(level int, nodes []int) [][]merkleHash {
+		children := make([][]merkleHash, len(nodes))
+
+		for n, node := range nodes {
+			children[n] = other.levels[level+1][node*merkleFanout : (node+1)*merkleFanout]
+		}
+
+		return children
+	}) {
+		fetch, remove := diffEntries(m.buckets[b], other.buckets[b])
+		keys = append(append(keys, fetch...), remove...)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// diffBuckets walks down the tree, using the given func to retrieve the
+// child hashes of the other tree, returning the buckets that differ.
+func (m *MerkleTree) diffBuckets(children func(level int, nodes []int) [][]merkleHash) []int {
+	nodes := []int{0}
+
+	for level := 0; level < merkleDepth && len(nodes) > 0; level++ {
+		var next []int
+
+		for n, hashes := range children(level, nodes) {
+			for c, hash := range hashes {
+				if child := nodes[n]*merkleFanout + c; hash != m.levels[level+1][child] {
+					next = append(next, child)
+				}
+			}
+		}
+
+		nodes = next
+	}
+
+	return nodes
+}
+
+// diffEntries returns the keys in the other bucket that are missing or
+// different in the local bucket, and the keys in the local bucket that are not
+// in the other bucket.
+func diffEntries(local, other []merkleEntry) (fetch, remove []string) {
+	hashes := make(map[string]merkleHash, len(local))
+
+	for _, e := range local {
+		hashes[e.key] = e.hash
+	}
+
+	for _, e := range other {
+		if hash, ok := hashes[e.key]; !ok || hash != e.hash {
+			fetch = append(fetch, e.key)
+		}
+
+		delete(hashes, e.key)
+	}
+
+	for key := range hashes {
+		remove = append(remove, key)
+	}
+
+	sort.Strings(remove)
+
+	return fetch, remove
+}
+
+// Sync message types.
+const (
+	syncRoot byte = iota
+	syncNodes
+	syncEntries
+	syncValues
+	syncDone
+)
+
+var errSyncProtocol = errors.New("invalid sync message")
+
+// Sync makes the Store match the Store served by ServeSync on the other end of
+// the ReadWriter, transferring only the keys that differ.
+//
+// Keys are compared using a MerkleTree built from each Store, so that only
+// the parts of the trees that differ are exchanged.
+//
+// Requests are written while their responses are read, so the ReadWriter
+// should be closed if an error is returned.
+func Sync(store Store, rw io.ReadWriter) error {
+	local, err := NewMerkleTree(store)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(rw)
+	c := &syncClient{
+		bw: bw,
+		lw: byteio.StickyLittleEndianWriter{Writer: bw},
+		lr: byteio.StickyLittleEndianReader{Reader: bufio.NewReader(rw)},
+	}
+
+	errc := c.send(func(lw *byteio.StickyLittleEndianWriter) {
+		lw.WriteUint8(syncRoot)
+	})
+
+	var root merkleHash
+
+	io.ReadFull(&c.lr, root[:])
+
+	if err = c.wait(errc); err != nil {
+		return err
+	}
+
+	var buckets []int
+
+	if root != local.Root() {
+		buckets = local.diffBuckets(func(level int, nodes []int) [][]merkleHash {
+			errc := c.send(func(lw *byteio.StickyLittleEndianWriter) {
+				lw.WriteUint8(syncNodes)
+				lw.WriteUintX(uint64(level))
+				lw.WriteUintX(uint64(len(nodes)))
+
+				for _, node := range nodes {
+					lw.WriteUintX(uint64(node))
+				}
+			})
+
+			children := make([][]merkleHash, len(nodes))
+
+			for n := range children {
+				children[n] = make([]merkleHash, merkleFanout)
+
+				for child := range children[n] {
+					io.ReadFull(&c.lr, children[n][child][:])
+				}
+			}
+
+			if err = c.wait(errc); err != nil {
+				return nil
+			}
+
+			return children
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = c.syncBuckets(store, local, buckets); err != nil {
+		return err
+	}
+
+	return c.wait(c.send(func(lw *byteio.StickyLittleEndianWriter) {
+		lw.WriteUint8(syncDone)
+	}))
+}
+
+type syncClient struct {
+	bw *bufio.Writer
+	lw byteio.StickyLittleEndianWriter
+	lr byteio.StickyLittleEndianReader
+}
+
+// send writes the request in a new goroutine, as the server may start writing
+// its response before it has read the whole request.
+func (c *syncClient) send(request func(*byteio.StickyLittleEndianWriter)) <-chan error {
+	errc := make(chan error, 1)
+
+	go func() {
+		request(&c.lw)
+
+		if c.lw.Err != nil {
+			errc <- c.lw.Err
+		} else {
+			errc <- c.bw.Flush()
+		}
+	}()
+
+	return errc
+}
+
+// wait returns any error from reading the response, or otherwise waits for
+// the request to have been written.
+func (c *syncClient) wait(errc <-chan error) error {
+	if c.lr.Err != nil {
+		return fmt.Errorf("error reading sync response: %w", c.lr.Err)
+	} else if err := <-errc; err != nil {
+		return fmt.Errorf("error sending sync request: %w", err)
+	}
+
+	return nil
+}
+
+func (c *syncClient) syncBuckets(store Store, local *MerkleTree, buckets []int) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	errc := c.send(func(lw *byteio.StickyLittleEndianWriter) {
+		lw.WriteUint8(syncEntries)
+		lw.WriteUintX(uint64(len(buckets)))
+
+		for _, b := range buckets {
+			lw.WriteUintX(uint64(b))
+		}
+	})
+
+	var fetch, remove []string
+
+	for _, b := range buckets {
+		var other []merkleEntry
+
+		for count := c.lr.ReadUintX(); count > 0 && c.lr.Err == nil; count-- {
+			e := merkleEntry{key: string(readBuffer(&c.lr, c.lr.ReadUintX()))}
+
+			io.ReadFull(&c.lr, e.hash[:])
+
+			other = append(other, e)
+		}
+
+		f, r := diffEntries(local.buckets[b], other)
+		fetch = append(fetch, f...)
+		remove = append(remove, r...)
+	}
+
+	if err := c.wait(errc); err != nil {
+		return err
+	}
+
+	if len(fetch) > 0 {
+		errc = c.send(func(lw *byteio.StickyLittleEndianWriter) {
+			lw.WriteUint8(syncValues)
+			lw.WriteUintX(uint64(len(fetch)))
+
+			for _, key := range fetch {
+				lw.WriteStringX(key)
+			}
+		})
+
+		for _, key := range fetch {
+			found := c.lr.ReadBool()
+			buf := readBuffer(&c.lr, c.lr.ReadUintX())
+
+			if c.lr.Err != nil {
+				break
+			} else if !found {
+				continue
+			}
+
+			if err := store.Set(key, &buf); err != nil {
+				return fmt.Errorf("error setting key %q: %w", key, err)
+			}
+		}
+
+		if err := c.wait(errc); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range remove {
+		if err := store.Remove(key); err != nil && !errors.Is(err, ErrUnknownKey) {
+			return fmt.Errorf("error removing key %q: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// ServeSync answers the requests of a Sync call on the other end of the
+// ReadWriter, until the Sync is complete.
+func ServeSync(store Store, rw io.ReadWriter) error {
+	tree, err := NewMerkleTree(store)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(rw)
+	lw := byteio.StickyLittleEndianWriter{Writer: bw}
+	lr := byteio.StickyLittleEndianReader{Reader: bufio.NewReader(rw)}
+
+	for {
+		typ := lr.ReadUint8()
+		if lr.Err != nil {
+			return fmt.Errorf("error reading sync request: %w", lr.Err)
+		}
+
+		switch typ {
+		case syncRoot:
+			root := tree.Root()
+
+			lw.Write(root[:])
+		case syncNodes:
+			level := lr.ReadUintX()
+			if level >= merkleDepth {
+				return errSyncProtocol
+			}
+
+			for count := lr.ReadUintX(); count > 0 && lr.Err == nil; count-- {
+				node := lr.ReadUintX()
+				if node >= uint64(len(tree.levels[level])) {
+					return errSyncProtocol
+				}
+
+				for _, child := range tree.levels[level+1][node*merkleFanout : (node+1)*merkleFanout] {
+					lw.Write(child[:])
+				}
+			}
+		case syncEntries:
+			for count := lr.ReadUintX(); count > 0 && lr.Err == nil; count-- {
+				b := lr.ReadUintX()
+				if b >= merkleBuckets {
+					return errSyncProtocol
+				}
+
+				lw.WriteUintX(uint64(len(tree.buckets[b])))
+
+				for _, e := range tree.buckets[b] {
+					lw.WriteStringX(e.key)
+					lw.Write(e.hash[:])
+				}
+			}
+		case syncValues:
+			for count := lr.ReadUintX(); count > 0 && lr.Err == nil; count-- {
+				key := string(readBuffer(&lr, lr.ReadUintX()))
+				buf := make(memio.Buffer, 0)
+
+				if err := store.Get(key, &buf); errors.Is(err, ErrUnknownKey) {
+					lw.WriteBool(false)
+					lw.WriteUintX(0)
+
+					continue
+				} else if err != nil {
+					return fmt.Errorf("error reading key %q: %w", key, err)
+				}
+
+				lw.WriteBool(true)
+				lw.WriteUintX(uint64(len(buf)))
+				lw.Write(buf)
+			}
+		case syncDone:
+			return nil
+		default:
+			return errSyncProtocol
+		}
+
+		if lr.Err != nil {
+			return fmt.Errorf("error reading sync request: %w", lr.Err)
+		} else if lw.Err != nil {
+			return fmt.Errorf("error writing sync response: %w", lw.Err)
+		} else if err = bw.Flush(); err != nil {
+			return fmt.Errorf("error writing sync response: %w", err)
+		}
+	}
+}
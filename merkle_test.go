@@ -0,0 +1,149 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+func fillStore(s Store, n int) {
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.Set(key, data("value "+key))
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	a, b := NewMemStore(), NewMemStore()
+	fillStore(a, 1000)
+	fillStore(b, 1000)
+	b.Set("key1", data("changed"))
+	b.Remove("key2")
+	b.Set("new", data("value"))
+	ta, err := NewMerkleTree(a)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	tb, err := NewMerkleTree(b)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	ds, _ := NewDedupStore(NewMemStore(), NewMemStore())
+	fillStore(ds, 1000)
+	td, err := NewMerkleTree(ds)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	if ta.Root() == tb.Root() {
+		t.Errorf("test 2: expecting different roots")
+	} else if ta.Root() != td.Root() {
+		t.Errorf("test 3: expecting equal roots for equal stores")
+	} else if diff := ta.Diff(tb); !reflect.DeepEqual(diff, []string{"key1", "key2", "new"}) {
+		t.Errorf("test 4: expecting diff [key1 key2 new], got %v", diff)
+	} else if diff = ta.Diff(td); len(diff) != 0 {
+		t.Errorf("test 5: expecting no diff, got %v", diff)
+	}
+}
+
+func syncStores(t *testing.T, src, dst Store) error {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ServeSync(src, c1)
+	}()
+	err := Sync(dst, c2)
+	if serr := <-errc; serr != nil {
+		t.Errorf("unexpected error from ServeSync: %s", serr)
+	}
+	return err
+}
+
+func writeRecords(records []record) []record {
+	var writes []record
+	for _, rec := range records {
+		if rec.Op&OpWrite != 0 {
+			writes = append(writes, rec)
+		}
+	}
+	return writes
+}
+
+func TestSync(t *testing.T) {
+	src, dst := NewMemStore(), NewMemStore()
+	fillStore(src, 500)
+	fillStore(dst, 500)
+	src.Set("key1", data("changed"))
+	src.Remove("key2")
+	src.Set("new", data("value"))
+	dst.Set("extra", data("value"))
+	var r testRecorder
+	if err := syncStores(t, src, Instrumented(dst, &r)); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	if writes := writeRecords(r.records); len(writes) != 4 {
+		t.Errorf("test 2: expecting 4 writes, got %v", writes)
+	} else if sk, dk := src.Keys(), dst.Keys(); !reflect.DeepEqual(sk, dk) {
+		t.Errorf("test 3: expecting keys to match")
+	}
+	for _, key := range src.Keys() {
+		var a, b memio.Buffer
+		src.Get(key, &a)
+		dst.Get(key, &b)
+		if !bytes.Equal(a, b) {
+			t.Errorf("test 4: expecting value %q for key %q, got %q", a, key, b)
+		}
+	}
+	r.records = r.records[:0]
+	if err := syncStores(t, src, Instrumented(dst, &r)); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if writes := writeRecords(r.records); len(writes) != 0 {
+		t.Errorf("test 6: expecting no writes, got %v", writes)
+	}
+}
+
+func TestSyncLarge(t *testing.T) {
+	src, dst := NewMemStore(), NewMemStore()
+	for n := 0; n < 2000; n++ {
+		key := fmt.Sprintf("%0100d", n)
+		src.Set(key, data(key))
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- syncStores(t, src, dst)
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("test 1: unexpected error: %s", err)
+		} else if sk, dk := src.Keys(), dst.Keys(); !reflect.DeepEqual(sk, dk) {
+			t.Errorf("test 2: expecting %d keys, got %d", len(sk), len(dk))
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("test 1: sync did not complete")
+	}
+}
+
+func TestServeSyncInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader([]byte{0xff}), &buf}
+	if err := ServeSync(NewMemStore(), rw); !errors.Is(err, errSyncProtocol) {
+		t.Errorf("expecting errSyncProtocol, got %v", err)
+	}
+}
@@ -0,0 +1,534 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+// MirrorStore is a Store that keeps the same keys in a number of member
+// Stores.
+//
+// Modifications are applied to every member, and are successful when they
+// succeed on at least the write quorum of members. Members that fail a
+// modification are marked as stale for the affected keys, and members that
+// fail with an unexpected error are marked unhealthy, until Resync is called.
+//
+// Stale keys are only tracked in memory unless metadata Stores are set with
+// SetMetadata.
+type MirrorStore struct {
+	mu      sync.RWMutex
+	members []Store
+	meta    []Store
+	version uint64
+	quorum  int
+	healthy []bool
+	stale   []map[string]struct{}
+}
+
+// Mirror creates a new MirrorStore from the primary and replica Stores.
+//
+// By default, the write quorum requires every member to succeed.
+func Mirror(primary Store, replicas ...Store) *MirrorStore {
+	members := append([]Store{primary}, replicas...)
+	m := &MirrorStore{
+		members: members,
+		quorum:  len(members),
+		healthy: make([]bool, len(members)),
+		stale:   make([]map[string]struct{}, len(members)),
+	}
+
+	for n := range members {
+		m.healthy[n] = true
+		m.stale[n] = make(map[string]struct{})
+	}
+
+	return m
+}
+
+// SetWriteQuorum sets the number of members on which a modification must
+// succeed. Values outside of the range 1 to the number of members are
+// clamped.
+//
+// This should be set before the MirrorStore is used.
+func (m *MirrorStore) SetWriteQuorum(quorum int) {
+	if quorum < 1 {
+		quorum = 1
+	} else if quorum > len(m.members) {
+		quorum = len(m.members)
+	}
+
+	m.quorum = quorum
+}
+
+// SetMetadata sets a Store for each member, primary first, in which the
+// version of each key held by that member is recorded. Resync prefers the
+// value with the latest version, so members that missed modifications are
+// corrected even after the MirrorStore is recreated.
+//
+// The metadata Stores should not be used for anything else, and should be set
+// before the MirrorStore is used.
+func (m *MirrorStore) SetMetadata(meta ...Store) error {
+	if len(meta) != len(m.members) {
+		return fmt.Errorf("expecting %d metadata stores, got %d", len(m.members), len(meta))
+	}
+
+	m.meta = meta
+
+	return nil
+}
+
+const mirrorVersionSize = 9
+
+type mirrorVersion struct {
+	version uint64
+	removed bool
+}
+
+func (m *MirrorStore) nextVersion() mirrorVersion {
+	v := uint64(time.Now().UnixNano())
+	if v <= m.version {
+		v = m.version + 1
+	}
+
+	m.version = v
+
+	return mirrorVersion{version: v}
+}
+
+// record stores the version of the key held by the given member.
+func (m *MirrorStore) record(n int, key string, v mirrorVersion) error {
+	if m.meta == nil {
+		return nil
+	}
+
+	buf := make(memio.Buffer, mirrorVersionSize)
+
+	binary.LittleEndian.PutUint64(buf, v.version)
+
+	if v.removed {
+		buf[8] = 1
+	}
+
+	return m.meta[n].Set(key, &buf)
+}
+
+// versionOf retrieves the version of the key held by the given member, which
+// is zero when no version has been recorded.
+func (m *MirrorStore) versionOf(n int, key string) (mirrorVersion, error) {
+	buf := make(memio.Buffer, 0, mirrorVersionSize)
+
+	if err := m.meta[n].Get(key, &buf); errors.Is(err, ErrUnknownKey) {
+		return mirrorVersion{}, nil
+	} else if err != nil {
+		return mirrorVersion{}, err
+	} else if len(buf) != mirrorVersionSize {
+		return mirrorVersion{}, fmt.Errorf("%w: invalid version for key %q", ErrCorrupt, key)
+	}
+
+	return mirrorVersion{version: binary.LittleEndian.Uint64(buf), removed: buf[8] == 1}, nil
+}
+
+// Healthy returns, for each member, primary first, whether it is currently
+// used for reads.
+func (m *MirrorStore) Healthy() []bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]bool(nil), m.healthy...)
+}
+
+func (m *MirrorStore) readable(n int, key string) bool {
+	_, stale := m.stale[n][key]
+
+	return m.healthy[n] && !stale
+}
+
+// Get retrieves the key from the first healthy member that is not stale for
+// the key.
+func (m *MirrorStore) Get(key string, r io.ReaderFrom) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	err := ErrUnknownKey
+
+	for n, member := range m.members {
+		if !m.readable(n, key) {
+			continue
+		}
+
+		buf := make(memio.Buffer, 0)
+
+		if err = member.Get(key, &buf); err == nil {
+			_, err = r.ReadFrom(&buf)
+
+			return err
+		} else if ErrorKind(err) != "other" {
+			return err
+		}
+	}
+
+	return err
+}
+
+// each runs the given func for every member concurrently, returning the
+// errors.
+func (m *MirrorStore) each(fn func(int, Store) error) []error {
+	var wg sync.WaitGroup
+
+	errs := make([]error, len(m.members))
+
+	for n, member := range m.members {
+		wg.Add(1)
+
+		go func(n int, member Store) {
+			defer wg.Done()
+
+			errs[n] = fn(n, member)
+		}(n, member)
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// result determines the outcome of a modification, marking any members that
+// failed as stale for the given keys.
+//
+// When every member that responded returned the same Store error, such as
+// ErrUnknownKey, that error is returned. Otherwise, when absentOK is true,
+// ErrUnknownKey is treated as a success.
+func (m *MirrorStore) result(errs []error, absentOK bool, keys ...string) error {
+	var (
+		agreed    error
+		disagreed bool
+	)
+
+	for _, err := range errs {
+		switch kind := ErrorKind(err); kind {
+		case "other":
+		case "":
+			disagreed = true
+		default:
+			if agreed == nil {
+				agreed = err
+			} else if ErrorKind(agreed) != kind {
+				disagreed = true
+			}
+		}
+	}
+
+	var (
+		successes int
+		firstErr  error
+	)
+
+	for n, err := range errs {
+		if ErrorKind(err) == "other" {
+			m.healthy[n] = false
+		}
+
+		if agreed != nil && !disagreed {
+			continue
+		} else if err == nil || absentOK && errors.Is(err, ErrUnknownKey) {
+			successes++
+
+			continue
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		for _, key := range keys {
+			m.stale[n][key] = struct{}{}
+		}
+	}
+
+	if agreed != nil && !disagreed {
+		return agreed
+	} else if successes < m.quorum {
+		return fmt.Errorf("%w: %d of %d members succeeded: %s", ErrQuorum, successes, len(errs), firstErr)
+	}
+
+	return nil
+}
+
+// Set stores the value in every member.
+func (m *MirrorStore) Set(key string, w io.WriterTo) error {
+	buf := make(memio.Buffer, 0)
+
+	if _, err := w.WriteTo(&buf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v := m.nextVersion()
+
+	return m.result(m.each(func(n int, member Store) error {
+		mbuf := buf
+
+		if err := member.Set(key, &mbuf); err != nil {
+			return err
+		}
+
+		return m.record(n, key, v)
+	}), false, key)
+}
+
+// Remove deletes the key from every member.
+func (m *MirrorStore) Remove(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v := m.nextVersion()
+	v.removed = true
+
+	return m.result(m.each(func(n int, member Store) error {
+		if err := member.Remove(key); err != nil {
+			return err
+		}
+
+		return m.record(n, key, v)
+	}), true, key)
+}
+
+// Keys returns a sorted slice of the keys in the first healthy member.
+func (m *MirrorStore) Keys() []string {
+	keys, _ := m.KeysErr()
+
+	return keys
+}
+
+// KeysErr returns a sorted slice of the keys in the first healthy member,
+// along with any error encountered retrieving them.
+func (m *MirrorStore) KeysErr() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for n, member := range m.members {
+		if m.healthy[n] {
+			return KeysErr(member)
+		}
+	}
+
+	return KeysErr(m.members[0])
+}
+
+// Rename moves the value from an existing key to a new key in every member,
+// replacing any value at the new key.
+func (m *MirrorStore) Rename(oldkey, newkey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if oldkey == newkey {
+		for n, member := range m.members {
+			if m.readable(n, oldkey) && exists(member, oldkey) {
+				return nil
+			}
+		}
+
+		return ErrUnknownKey
+	}
+
+	v := m.nextVersion()
+	removed := mirrorVersion{version: v.version, removed: true}
+
+	return m.result(m.each(func(n int, member Store) error {
+		if err := replace(member, oldkey, newkey); err != nil {
+			return err
+		} else if err = m.record(n, newkey, v); err != nil {
+			return err
+		}
+
+		return m.record(n, oldkey, removed)
+	}), false, oldkey, newkey)
+}
+
+// Resync reconciles the members, making them all hold the same keys and
+// values, and marks every member as healthy.
+//
+// For each key, the value held by the most members that are not stale for
+// the key is used, with ties resolved in favour of the earliest member. When
+// metadata Stores are set, only the members holding the latest recorded
+// version of the key are considered.
+func (m *MirrorStore) Resync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+
+	for n, member := range m.members {
+		mkeys, err := KeysErr(member)
+		if err != nil {
+			return fmt.Errorf("error reading keys from member %d: %w", n, err)
+		}
+
+		keys = append(keys, mkeys...)
+
+		if m.meta != nil {
+			if mkeys, err = KeysErr(m.meta[n]); err != nil {
+				return fmt.Errorf("error reading metadata from member %d: %w", n, err)
+			}
+
+			keys = append(keys, mkeys...)
+		}
+	}
+
+	for _, key := range uniqueKeys(keys) {
+		if err := m.resync(key); err != nil {
+			return err
+		}
+	}
+
+	for n := range m.members {
+		m.healthy[n] = true
+		m.stale[n] = make(map[string]struct{})
+	}
+
+	return nil
+}
+
+func (m *MirrorStore) resync(key string) error {
+	values := make([]memio.Buffer, len(m.members))
+	hashes := make([]string, len(m.members))
+
+	for n, member := range m.members {
+		buf := make(memio.Buffer, 0)
+
+		if err := member.Get(key, &buf); errors.Is(err, ErrUnknownKey) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading key %q from member %d: %w", key, n, err)
+		}
+
+		sum := sha256.Sum256(buf)
+		values[n] = buf
+		hashes[n] = string(sum[:])
+	}
+
+	eligible, latest, err := m.latest(key, values)
+	if err != nil {
+		return err
+	}
+
+	votes := make(map[string]int)
+	winner := 0
+
+	for n := len(m.members) - 1; n >= 0; n-- {
+		if !eligible[n] {
+			continue
+		}
+
+		if votes[hashes[n]]++; votes[hashes[n]] >= votes[hashes[winner]] {
+			winner = n
+		}
+	}
+
+	for n, member := range m.members {
+		if hashes[n] == hashes[winner] {
+			continue
+		}
+
+		var err error
+
+		if values[winner] == nil {
+			err = member.Remove(key)
+		} else {
+			buf := values[winner]
+			err = member.Set(key, &buf)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error updating key %q on member %d: %w", key, n, err)
+		}
+	}
+
+	return m.resyncVersions(key, latest, values[winner] == nil)
+}
+
+// latest determines which members may supply the value for the key: those
+// holding the latest recorded version or, without versions, those that are
+// not stale for the key.
+func (m *MirrorStore) latest(key string, values []memio.Buffer) ([]bool, uint64, error) {
+	eligible := make([]bool, len(m.members))
+
+	var latest uint64
+
+	if m.meta != nil {
+		versions := make([]mirrorVersion, len(m.members))
+
+		for n := range m.members {
+			v, err := m.versionOf(n, key)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error reading version of key %q from member %d: %w", key, n, err)
+			}
+
+			if v.removed != (values[n] == nil) {
+				continue
+			}
+
+			versions[n] = v
+
+			if v.version > latest {
+				latest = v.version
+			}
+		}
+
+		if latest > 0 {
+			for n, v := range versions {
+				eligible[n] = v.version == latest
+			}
+
+			return eligible, latest, nil
+		}
+	}
+
+	for n := range m.members {
+		_, stale := m.stale[n][key]
+		eligible[n] = !stale
+	}
+
+	return eligible, latest, nil
+}
+
+// resyncVersions records the same version of the key for every member,
+// removing the versions of keys that no member holds.
+func (m *MirrorStore) resyncVersions(key string, latest uint64, removed bool) error {
+	if m.meta == nil {
+		return nil
+	}
+
+	v := mirrorVersion{version: latest}
+
+	if latest == 0 {
+		v = m.nextVersion()
+	}
+
+	for n, meta := range m.meta {
+		var err error
+
+		if removed {
+			if err = meta.Remove(key); errors.Is(err, ErrUnknownKey) {
+				err = nil
+			}
+		} else {
+			err = m.record(n, key, v)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error updating version of key %q on member %d: %w", key, n, err)
+		}
+	}
+
+	return nil
+}
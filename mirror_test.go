@@ -0,0 +1,182 @@
+package keystore
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+var errOffline = errors.New("offline")
+
+type offlineStore struct {
+	Store
+	offline bool
+}
+
+func (o *offlineStore) Get(key string, r io.ReaderFrom) error {
+	if o.offline {
+		return errOffline
+	}
+
+	return o.Store.Get(key, r)
+}
+
+func (o *offlineStore) Set(key string, w io.WriterTo) error {
+	if o.offline {
+		return errOffline
+	}
+
+	return o.Store.Set(key, w)
+}
+
+func (o *offlineStore) Remove(key string) error {
+	if o.offline {
+		return errOffline
+	}
+
+	return o.Store.Remove(key)
+}
+
+func (o *offlineStore) Rename(oldkey, newkey string) error {
+	if o.offline {
+		return errOffline
+	}
+
+	return o.Store.Rename(oldkey, newkey)
+}
+
+func TestMirror(t *testing.T) {
+	testStore(t, Mirror(NewMemStore(), NewMemStore(), NewMemStore()))
+}
+
+func TestMirrorQuorum(t *testing.T) {
+	a, b, c := NewMemStore(), NewMemStore(), NewMemStore()
+	oa := &offlineStore{Store: a}
+	m := Mirror(oa, b, c)
+	var buf memio.Buffer
+	m.Set("key", data("one"))
+	oa.offline = true
+	if err := m.Set("key", data("two")); !errors.Is(err, ErrQuorum) {
+		t.Errorf("test 1: expecting ErrQuorum, got %v", err)
+	} else if healthy := m.Healthy(); !reflect.DeepEqual(healthy, []bool{false, true, true}) {
+		t.Errorf("test 2: expecting health [false true true], got %v", healthy)
+	}
+	m.SetWriteQuorum(2)
+	if err := m.Set("key", data("three")); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if err = m.Set("other", data("value")); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if err = m.Get("key", &buf); err != nil || string(buf) != "three" {
+		t.Errorf("test 5: expecting value %q, got %q (%v)", "three", buf, err)
+	} else if err = m.Remove("missing"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 6: expecting ErrUnknownKey, got %v", err)
+	}
+	oa.offline = false
+	if buf = buf[:0]; m.Get("key", &buf) != nil || string(buf) != "three" {
+		t.Errorf("test 7: expecting value %q from healthy member, got %q", "three", buf)
+	} else if err := m.Resync(); err != nil {
+		t.Errorf("test 8: unexpected error: %s", err)
+	} else if healthy := m.Healthy(); !reflect.DeepEqual(healthy, []bool{true, true, true}) {
+		t.Errorf("test 9: expecting all members healthy, got %v", healthy)
+	}
+	for n, s := range [...]*MemStore{a, b, c} {
+		buf = buf[:0]
+		if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key", "other"}) {
+			t.Errorf("test 10.%d: expecting keys [key other], got %v", n+1, keys)
+		} else if s.Get("key", &buf); string(buf) != "three" {
+			t.Errorf("test 11.%d: expecting value %q, got %q", n+1, "three", buf)
+		}
+	}
+}
+
+func TestMirrorResyncMajority(t *testing.T) {
+	a, b, c := NewMemStore(), NewMemStore(), NewMemStore()
+	a.Set("key", data("minority"))
+	b.Set("key", data("majority"))
+	c.Set("key", data("majority"))
+	b.Set("extra", data("value"))
+	c.Set("extra", data("value"))
+	a.Set("tie", data("primary"))
+	b.Set("tie", data("replica"))
+	if err := Mirror(a, b, c).Resync(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	for n, test := range [...]struct {
+		Key, Value string
+	}{
+		{"key", "majority"},
+		{"extra", "value"},
+		{"tie", "primary"},
+	} {
+		for m, s := range [...]*MemStore{a, b, c} {
+			var buf memio.Buffer
+			if err := s.Get(test.Key, &buf); err != nil || string(buf) != test.Value {
+				t.Errorf("test %d.%d: expecting value %q, got %q (%v)", n+1, m+1, test.Value, buf, err)
+			}
+		}
+	}
+}
+
+func TestMirrorResyncMetadata(t *testing.T) {
+	a, b, c := NewMemStore(), NewMemStore(), NewMemStore()
+	ma, mb, mc := NewMemStore(), NewMemStore(), NewMemStore()
+	ob, oc := &offlineStore{Store: b}, &offlineStore{Store: c}
+	m := Mirror(a, ob, oc)
+	if err := m.SetMetadata(ma, mb); err == nil {
+		t.Errorf("test 1: expecting error")
+	} else if err = m.SetMetadata(ma, mb, mc); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	}
+	m.Set("key", data("old"))
+	m.Set("gone", data("value"))
+	ob.offline, oc.offline = true, true
+	m.SetWriteQuorum(1)
+	if err := m.Set("key", data("new")); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if err = m.Remove("gone"); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	}
+	m = Mirror(a, b, c)
+	m.SetMetadata(ma, mb, mc)
+	if err := m.Resync(); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+		return
+	}
+	for n, s := range [...]*MemStore{a, b, c} {
+		var buf memio.Buffer
+		if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key"}) {
+			t.Errorf("test 5.%d: expecting keys [key], got %v", n+1, keys)
+		} else if s.Get("key", &buf); string(buf) != "new" {
+			t.Errorf("test 6.%d: expecting value %q, got %q", n+1, "new", buf)
+		}
+	}
+	for n, s := range [...]*MemStore{ma, mb, mc} {
+		if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key"}) {
+			t.Errorf("test 7.%d: expecting versions for [key], got %v", n+1, keys)
+		}
+	}
+}
+
+func TestMirrorRenameSelf(t *testing.T) {
+	a, b := NewMemStore(), NewMemStore()
+	m := Mirror(a, b)
+	m.SetMetadata(NewMemStore(), NewMemStore())
+	m.Set("key", data("value"))
+	if err := m.Rename("key", "key"); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = m.Rename("missing", "missing"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 2: expecting ErrUnknownKey, got %v", err)
+	} else if err = m.Resync(); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	}
+	for n, s := range [...]*MemStore{a, b} {
+		var buf memio.Buffer
+		if err := s.Get("key", &buf); err != nil || string(buf) != "value" {
+			t.Errorf("test 4.%d: expecting value %q, got %q (%v)", n+1, "value", buf, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package keystore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+)
+
+// SetMmapThreshold sets the size, in bytes, at or above which values are
+// memory-mapped by Get, View and GetBytes, rather than being read. A size of
+// zero, the default, disables mapping.
+//
+// Values are only mapped on platforms that support it, and when the FileStore
+// has a temporary directory, as values are then replaced, instead of being
+// truncated and rewritten, leaving existing mappings intact.
+//
+// The threshold should be set before the FileStore is used.
+func (fs *FileStore) SetMmapThreshold(size int64) {
+	fs.mmapThreshold = size
+}
+
+// mmap maps the file into memory, when enabled and possible.
+func (fs *FileStore) mmap(f *os.File) ([]byte, bool) {
+	if fs.mmapThreshold <= 0 || fs.tmpDir == "" {
+		return nil, false
+	}
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() < fs.mmapThreshold {
+		return nil, false
+	}
+
+	data, err := mmapFile(f, fi.Size())
+
+	return data, err == nil
+}
+
+// readMapped calls fn with the mapped data, turning any memory fault, such as
+// from the file being truncated by another process, into an error.
+func readMapped(data []byte, fn func([]byte) error) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			fault, ok := r.(interface{ Addr() uintptr })
+			if !ok {
+				panic(r)
+			}
+
+			err = fmt.Errorf("error reading mapped file: %v", fault)
+		}
+	}()
+
+	return fn(data)
+}
+
+// View calls fn with the value of the key, which is memory-mapped when
+// possible, and otherwise read into memory.
+//
+// The slice must not be modified, and is only valid until fn returns.
+func (fs *FileStore) View(key string, fn func([]byte) error) error {
+	return fs.view(key, func(data []byte, _ bool) error {
+		return fn(data)
+	})
+}
+
+// GetBytes returns the value of the key.
+func (fs *FileStore) GetBytes(key string) ([]byte, error) {
+	var value []byte
+
+	err := fs.view(key, func(data []byte, mapped bool) error {
+		if mapped {
+			value = append(make([]byte, 0, len(data)), data...)
+		} else {
+			value = data
+		}
+
+		return nil
+	})
+
+	return value, err
+}
+
+func (fs *FileStore) view(key string, fn func(data []byte, mapped bool) error) error {
+	if err := fs.validateKeys(key); err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(fs.baseDir, fs.mangleKey(key)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrUnknownKey
+		}
+
+		return fmt.Errorf("error opening key file: %w", err)
+	}
+
+	defer f.Close()
+
+	if data, ok := fs.mmap(f); ok {
+		defer munmapFile(data)
+
+		return readMapped(data, func(data []byte) error {
+			if fs.checksums {
+				if data, err = checksumData(data); err != nil {
+					return err
+				}
+			}
+
+			return fn(data, true)
+		})
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("error reading key file: %w", err)
+	}
+
+	if fs.checksums {
+		if data, err = checksumData(data); err != nil {
+			return err
+		}
+	}
+
+	return fn(data, false)
+}
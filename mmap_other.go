@@ -0,0 +1,18 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package keystore
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(*os.File, int64) ([]byte, error) {
+	return nil, errors.New("mmap not supported")
+}
+
+func munmapFile([]byte) error {
+	return nil
+}
@@ -0,0 +1,127 @@
+package keystore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestFileStoreView(t *testing.T) {
+	large := strings.Repeat("large value;", 1000)
+	errStop := errors.New("stop")
+	n := 0
+	for _, tmp := range [...]bool{false, true} {
+		for _, threshold := range [...]int64{0, 1, 1 << 20} {
+			for _, checksums := range [...]bool{false, true} {
+				n++
+				var tmpDir string
+				if tmp {
+					tmpDir = t.TempDir()
+				}
+				s, err := NewFileStore(t.TempDir(), tmpDir, nil)
+				if err != nil {
+					t.Errorf("test %d: received unexpected error creating FileStore: %s", n, err)
+					continue
+				}
+				s.SetChecksums(checksums)
+				s.SetMmapThreshold(threshold)
+				s.Set("large", data(large))
+				s.Set("empty", data(""))
+				expectMapped := tmp && threshold == 1 && mmapSupported
+				var buf memio.Buffer
+				if err = s.view("large", func(value []byte, mapped bool) error {
+					if string(value) != large {
+						t.Errorf("test %d: incorrect value from View", n)
+					} else if mapped != expectMapped {
+						t.Errorf("test %d: expecting mapped to be %v", n, expectMapped)
+					}
+					return nil
+				}); err != nil {
+					t.Errorf("test %d: unexpected error: %s", n, err)
+				} else if value, err := s.GetBytes("large"); err != nil || string(value) != large {
+					t.Errorf("test %d: incorrect value from GetBytes (%v)", n, err)
+				} else if value, err = s.GetBytes("empty"); err != nil || len(value) != 0 {
+					t.Errorf("test %d: expecting empty value, got %q (%v)", n, value, err)
+				} else if err = s.Get("large", &buf); err != nil || string(buf) != large {
+					t.Errorf("test %d: incorrect value from Get (%v)", n, err)
+				} else if _, err = s.GetBytes("none"); err != ErrUnknownKey {
+					t.Errorf("test %d: expecting ErrUnknownKey, got %v", n, err)
+				} else if err = s.View("large", func([]byte) error { return errStop }); err != errStop {
+					t.Errorf("test %d: expecting error from callback, got %v", n, err)
+				}
+			}
+		}
+	}
+}
+
+func TestFileStoreViewReplaced(t *testing.T) {
+	s, err := NewFileStore(t.TempDir(), t.TempDir(), nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	s.SetMmapThreshold(1)
+	s.Set("key", data("old value"))
+	if err = s.View("key", func(value []byte) error {
+		if err := s.Set("key", data("new value")); err != nil {
+			return err
+		} else if string(value) != "old value" {
+			t.Errorf("test 1: expecting value %q, got %q", "old value", value)
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if value, err := s.GetBytes("key"); err != nil || string(value) != "new value" {
+		t.Errorf("test 2: expecting value %q, got %q (%v)", "new value", value, err)
+	}
+}
+
+func TestFileStoreViewCorrupt(t *testing.T) {
+	for n, threshold := range [...]int64{0, 1} {
+		dir := t.TempDir()
+		s, err := NewFileStore(dir, t.TempDir(), NoMangle)
+		if err != nil {
+			t.Errorf("test %d: received unexpected error creating FileStore: %s", n+1, err)
+			continue
+		}
+		s.SetChecksums(true)
+		s.SetMmapThreshold(threshold)
+		s.Set("key", data("value"))
+		f, _ := os.OpenFile(filepath.Join(dir, "key"), os.O_RDWR, 0)
+		f.WriteAt([]byte("V"), int64(checksumHeaderSize))
+		f.Close()
+		var buf memio.Buffer
+		if _, err = s.GetBytes("key"); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("test %d: expecting ErrCorrupt from GetBytes, got %v", n+1, err)
+		} else if err = s.Get("key", &buf); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("test %d: expecting ErrCorrupt from Get, got %v", n+1, err)
+		}
+	}
+}
+
+func TestFileStoreViewTruncated(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap not supported")
+	}
+	dir := t.TempDir()
+	s, err := NewFileStore(dir, t.TempDir(), NoMangle)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	s.SetMmapThreshold(1)
+	s.Set("key", data(strings.Repeat("value", 10000)))
+	if err = s.View("key", func(value []byte) error {
+		os.Truncate(filepath.Join(dir, "key"), 0)
+		if value[len(value)-1] != 'e' {
+			return ErrCorrupt
+		}
+		return nil
+	}); err == nil || errors.Is(err, ErrCorrupt) {
+		t.Errorf("expecting fault reading truncated file, got %v", err)
+	}
+}
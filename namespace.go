@@ -0,0 +1,143 @@
+package keystore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NamespaceSeparator is appended to the name given to a Sub method to form
+// the prefix of the namespace.
+const NamespaceSeparator = "/"
+
+type namespace struct {
+	store  Store
+	prefix string
+}
+
+// Namespace wraps a Store so that all keys are transparently prefixed with the
+// given prefix. Keys returns only those keys with the prefix, with the prefix
+// removed.
+//
+// When the Store is a FileStore using the NoMangle Mangler, and the prefix
+// ends with the NamespaceSeparator, the returned Store is a FileStore rooted in
+// the corresponding subdirectory. If that directory cannot be created, the
+// prefixed wrapper is returned instead, and the error is reported on first use.
+func Namespace(store Store, prefix string) Store {
+	switch s := store.(type) {
+	case *FileStore:
+		if sub := s.subDir(prefix); sub != nil {
+			return sub
+		}
+	case *namespace:
+		return &namespace{store: s.store, prefix: s.prefix + prefix}
+	}
+
+	return &namespace{store: store, prefix: prefix}
+}
+
+func (n *namespace) Get(key string, r io.ReaderFrom) error {
+	return n.store.Get(n.prefix+key, r)
+}
+
+func (n *namespace) Set(key string, w io.WriterTo) error {
+	return n.store.Set(n.prefix+key, w)
+}
+
+func (n *namespace) Remove(key string) error {
+	return n.store.Remove(n.prefix + key)
+}
+
+func (n *namespace) Keys() []string {
+	keys, _ := n.KeysErr()
+
+	return keys
+}
+
+func (n *namespace) KeysErr() ([]string, error) {
+	var keys []string
+
+	all, err := KeysErr(n.store)
+
+	for _, key := range all {
+		if strings.HasPrefix(key, n.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, n.prefix))
+		}
+	}
+
+	return keys, err
+}
+
+func (n *namespace) Rename(oldkey, newkey string) error {
+	return n.store.Rename(n.prefix+oldkey, n.prefix+newkey)
+}
+
+// Sub returns a Store for the named namespace within this namespace.
+func (n *namespace) Sub(name string) Store {
+	return Namespace(n, name+NamespaceSeparator)
+}
+
+// Sub returns a Store containing only those keys within the named namespace.
+//
+// When using the NoMangle Mangler, the namespace is a subdirectory of the
+// base directory, which can be managed independently.
+func (fs *FileStore) Sub(name string) Store {
+	return Namespace(fs, name+NamespaceSeparator)
+}
+
+func (fs *FileStore) subDir(prefix string) *FileStore {
+	if fs.mangler != NoMangle {
+		return nil
+	}
+
+	dir := strings.TrimSuffix(prefix, NamespaceSeparator)
+	if dir == prefix {
+		return nil
+	}
+
+	dir = filepath.FromSlash(dir)
+
+	if fs.validateKeys(dir) != nil {
+		return nil
+	}
+
+	baseDir := filepath.Join(fs.baseDir, fs.mangleKey(dir))
+
+	if err := os.MkdirAll(baseDir, 0o700); err != nil {
+		return nil
+	}
+
+	return &FileStore{
+		baseDir:       baseDir,
+		rootDir:       fs.rootDir,
+		tmpDir:        fs.tmpDir,
+		mangler:       fs.mangler,
+		quota:         fs.quota,
+		mu:            fs.mu,
+		dirMu:         fs.dirMu,
+		checksums:     fs.checksums,
+		mmapThreshold: fs.mmapThreshold,
+		validator:     fs.validator,
+	}
+}
+
+// Sub returns a Store containing only those keys within the named namespace.
+func (ms *MemStore) Sub(name string) Store {
+	return Namespace(ms, name+NamespaceSeparator)
+}
+
+// Sub returns a Store containing only those keys within the named namespace.
+func (fs *FileBackedMemStore) Sub(name string) Store {
+	return Namespace(fs, name+NamespaceSeparator)
+}
+
+// Sub returns a Store containing only those keys within the named namespace.
+func (ls *LogStore) Sub(name string) Store {
+	return Namespace(ls, name+NamespaceSeparator)
+}
+
+// Sub returns a Store containing only those keys within the named namespace.
+func (ps *PersistentMemStore) Sub(name string) Store {
+	return Namespace(ps, name+NamespaceSeparator)
+}
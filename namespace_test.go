@@ -0,0 +1,77 @@
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	m := NewMemStore()
+	m.Set("other", data("data"))
+	testStore(t, Namespace(m, "ns/"))
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"ns/key1", "other"}) {
+		t.Errorf("expecting keys [ns/key1 other], got %v", keys)
+	}
+}
+
+func TestNamespaceSub(t *testing.T) {
+	m := NewMemStore()
+	s := m.Sub("a").(interface{ Sub(string) Store }).Sub("b")
+	s.Set("key", data("data"))
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"a/b/key"}) {
+		t.Errorf("expecting keys [a/b/key], got %v", keys)
+	}
+}
+
+func TestFileStoreSub(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir, "", NoMangle)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	s := fs.Sub("ns")
+	if _, ok := s.(*FileStore); !ok {
+		t.Errorf("test 1: expecting FileStore, got %T", s)
+		return
+	}
+	testStore(t, s)
+	if _, err = os.Stat(filepath.Join(dir, "ns", "key1")); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if keys := fs.Keys(); !reflect.DeepEqual(keys, []string{"ns/key1"}) {
+		t.Errorf("test 3: expecting keys [ns/key1], got %v", keys)
+	}
+	if fs, err = NewFileStore(t.TempDir(), "", nil); err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	s = fs.Sub("ns")
+	if _, ok := s.(*FileStore); ok {
+		t.Errorf("test 4: expecting namespace wrapper, got FileStore")
+	}
+	testStore(t, s)
+	if fs, err = NewFileStore(dir, "", NoMangle); err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dir, "file"), nil, 0o600); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if s = fs.Sub("file"); s == nil {
+		t.Errorf("test 5: expecting Store, got nil")
+	} else if _, ok := s.(*FileStore); ok {
+		t.Errorf("test 5: expecting namespace wrapper, got FileStore")
+	} else if err = s.Set("key", String("value")); err == nil {
+		t.Errorf("test 5: expecting error setting key")
+	}
+	if s = Namespace(fs, "a/b/"); s == nil {
+		t.Errorf("test 6: expecting Store, got nil")
+	} else if _, ok := s.(*FileStore); !ok {
+		t.Errorf("test 6: expecting FileStore, got %T", s)
+	} else if err = s.Set("key", String("value")); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if _, err = os.Stat(filepath.Join(dir, "a", "b", "key")); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,475 @@
+package keystore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+// SyncPolicy determines when a PersistentMemStore or BTreeStore flushes its
+// changes to stable storage.
+type SyncPolicy uint8
+
+// Sync Policies.
+const (
+	// SyncAlways syncs the log after every change.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic syncs the log, if needed, once every WALSyncInterval.
+	SyncPeriodic
+	// SyncNever leaves flushing the log to the operating system.
+	SyncNever
+)
+
+// WALSyncInterval is the interval at which the log is synced under the
+// SyncPeriodic policy.
+var WALSyncInterval = time.Second
+
+const (
+	walName       = "wal"
+	checkpointExt = ".checkpoint"
+	tmpExt        = ".tmp"
+)
+
+// PersistentMemStore is a MemStore that records every change in a write-ahead
+// log, periodically checkpointing the entire store to disk.
+type PersistentMemStore struct {
+	memStore MemStore
+
+	mu         sync.Mutex
+	dir        string
+	policy     SyncPolicy
+	wal        *os.File
+	generation uint64
+	dirty      bool
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewPersistentMemStore opens, or creates, a PersistentMemStore in the given
+// directory, loading the latest checkpoint and replaying the write-ahead log.
+//
+// A positive checkpointInterval starts a background goroutine that calls
+// Checkpoint at that interval until the store is Closed.
+func NewPersistentMemStore(dir string, policy SyncPolicy, checkpointInterval time.Duration) (*PersistentMemStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating data dir: %w", err)
+	}
+
+	ps := &PersistentMemStore{
+		dir:    dir,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	ps.memStore.init()
+
+	if err := ps.load(); err != nil {
+		if ps.wal != nil {
+			ps.wal.Close()
+		}
+
+		return nil, err
+	}
+
+	if checkpointInterval > 0 || policy == SyncPeriodic {
+		ps.wg.Add(1)
+
+		go ps.background(checkpointInterval)
+	}
+
+	return ps, nil
+}
+
+func (ps *PersistentMemStore) checkpointPath(generation uint64) string {
+	return filepath.Join(ps.dir, fmt.Sprintf("%016x%s", generation, checkpointExt))
+}
+
+func (ps *PersistentMemStore) load() error {
+	entries, err := os.ReadDir(ps.dir)
+	if err != nil {
+		return fmt.Errorf("error reading data dir: %w", err)
+	}
+
+	var generations []uint64
+
+	for _, e := range entries {
+		name := e.Name()
+
+		if strings.HasSuffix(name, checkpointExt+tmpExt) {
+			os.Remove(filepath.Join(ps.dir, name))
+
+			continue
+		} else if !strings.HasSuffix(name, checkpointExt) {
+			continue
+		}
+
+		gen, err := strconv.ParseUint(strings.TrimSuffix(name, checkpointExt), 16, 64)
+		if err != nil {
+			os.Remove(filepath.Join(ps.dir, name))
+
+			continue
+		}
+
+		generations = append(generations, gen)
+	}
+
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+
+	if len(generations) > 0 {
+		ps.generation = generations[len(generations)-1]
+
+		for _, gen := range generations[:len(generations)-1] {
+			os.Remove(ps.checkpointPath(gen))
+		}
+
+		f, err := os.Open(ps.checkpointPath(ps.generation))
+		if err != nil {
+			return fmt.Errorf("error opening checkpoint: %w", err)
+		}
+
+		_, err = ps.memStore.ReadFrom(bufio.NewReader(f))
+
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("error reading checkpoint: %w", err)
+		}
+	}
+
+	if ps.wal, err = os.OpenFile(filepath.Join(ps.dir, walName), os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return fmt.Errorf("error opening write-ahead log: %w", err)
+	}
+
+	return ps.replay()
+}
+
+func (ps *PersistentMemStore) replay() error {
+	cr := crcReader{Reader: bufio.NewReader(ps.wal), hash: crc32.NewIEEE()}
+	lr := byteio.StickyLittleEndianReader{Reader: &cr}
+
+	if gen := lr.ReadUint64(); lr.Err != nil || gen != ps.generation {
+		return ps.resetWAL()
+	}
+
+	for {
+		start := lr.Count
+		crc := lr.ReadUint32()
+
+		if errors.Is(lr.Err, io.EOF) && lr.Count == start {
+			break
+		}
+
+		cr.hash.Reset()
+
+		var apply func()
+
+		switch lr.ReadUint8() {
+		case recordSet:
+			key := string(readBuffer(&lr, lr.ReadUintX()))
+			buf := readBuffer(&lr, lr.ReadUintX())
+
+			apply = func() { ps.memStore.data[key] = buf }
+		case recordRemove:
+			key := string(readBuffer(&lr, lr.ReadUintX()))
+
+			apply = func() { delete(ps.memStore.data, key) }
+		case recordRename:
+			oldkey := string(readBuffer(&lr, lr.ReadUintX()))
+			newkey := string(readBuffer(&lr, lr.ReadUintX()))
+
+			apply = func() {
+				if d, ok := ps.memStore.data[oldkey]; ok {
+					ps.memStore.data[newkey] = d
+
+					delete(ps.memStore.data, oldkey)
+				}
+			}
+		default:
+			lr.Err = ErrCorrupt
+		}
+
+		if lr.Err != nil || cr.hash.Sum32() != crc {
+			if err := ps.wal.Truncate(start); err != nil {
+				return fmt.Errorf("error truncating write-ahead log: %w", err)
+			}
+
+			break
+		}
+
+		apply()
+	}
+
+	_, err := ps.wal.Seek(0, io.SeekEnd)
+
+	return err
+}
+
+func (ps *PersistentMemStore) resetWAL() error {
+	if err := ps.wal.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating write-ahead log: %w", err)
+	} else if _, err = ps.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error truncating write-ahead log: %w", err)
+	}
+
+	lw := byteio.StickyLittleEndianWriter{Writer: ps.wal}
+
+	lw.WriteUint64(ps.generation)
+
+	if lw.Err != nil {
+		return fmt.Errorf("error writing write-ahead log: %w", lw.Err)
+	}
+
+	return ps.wal.Sync()
+}
+
+func (ps *PersistentMemStore) log(record []byte) error {
+	start, err := ps.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("error writing write-ahead log: %w", err)
+	}
+
+	if _, err := ps.wal.Write(record); err != nil {
+		ps.wal.Truncate(start)
+		ps.wal.Seek(start, io.SeekStart)
+
+		return fmt.Errorf("error writing write-ahead log: %w", err)
+	}
+
+	if ps.policy == SyncAlways {
+		if err := ps.wal.Sync(); err != nil {
+			return fmt.Errorf("error syncing write-ahead log: %w", err)
+		}
+	} else {
+		ps.dirty = true
+	}
+
+	return nil
+}
+
+// Get retrieves the key data from memory.
+func (ps *PersistentMemStore) Get(key string, r io.ReaderFrom) error {
+	return ps.memStore.Get(key, r)
+}
+
+// GetAll retrieves data for all of the keys given. Useful to reduce locking.
+// Unknown Key errors are not returned, only errors from the ReaderFrom's.
+func (ps *PersistentMemStore) GetAll(data map[string]io.ReaderFrom) error {
+	return ps.memStore.GetAll(data)
+}
+
+// Set records the key data in the log and stores it in memory.
+func (ps *PersistentMemStore) Set(key string, w io.WriterTo) error {
+	if err := validateKeys(ps.memStore.validator, key); err != nil {
+		return err
+	}
+
+	d := make(memio.Buffer, 0)
+
+	if _, err := w.WriteTo(&d); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if err := ps.log(encodeRecord(recordSet, d, key)); err != nil {
+		return err
+	}
+
+	ps.memStore.set(key, d)
+
+	return nil
+}
+
+// Remove records the removal in the log and deletes the key data from memory.
+func (ps *PersistentMemStore) Remove(key string) error {
+	if err := validateKeys(ps.memStore.validator, key); err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.memStore.Exists(key) {
+		return ErrUnknownKey
+	}
+
+	if err := ps.log(encodeRecord(recordRemove, nil, key)); err != nil {
+		return err
+	}
+
+	return ps.memStore.Remove(key)
+}
+
+// Keys returns a sorted slice of all of the keys.
+func (ps *PersistentMemStore) Keys() []string {
+	return ps.memStore.Keys()
+}
+
+// KeysErr returns a sorted slice of all of the keys. The error is always nil.
+func (ps *PersistentMemStore) KeysErr() ([]string, error) {
+	return ps.memStore.KeysErr()
+}
+
+// Exists returns true when the key exists within the store.
+func (ps *PersistentMemStore) Exists(key string) bool {
+	return ps.memStore.Exists(key)
+}
+
+// Rename records the rename in the log and moves data from an existing key to
+// a new, unused key.
+func (ps *PersistentMemStore) Rename(oldkey, newkey string) error {
+	if err := validateKeys(ps.memStore.validator, oldkey, newkey); err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.memStore.Exists(oldkey) {
+		return ErrUnknownKey
+	} else if ps.memStore.Exists(newkey) {
+		return ErrKeyExists
+	}
+
+	if err := ps.log(encodeRecord(recordRename, nil, oldkey, newkey)); err != nil {
+		return err
+	}
+
+	return ps.memStore.Rename(oldkey, newkey)
+}
+
+// WriteTo implements the io.WriterTo interface, writing the store in the
+// MemStore format.
+func (ps *PersistentMemStore) WriteTo(w io.Writer) (int64, error) {
+	return ps.memStore.WriteTo(w)
+}
+
+// Checkpoint writes the entire store to disk and truncates the write-ahead
+// log.
+func (ps *PersistentMemStore) Checkpoint() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.checkpoint()
+}
+
+func (ps *PersistentMemStore) checkpoint() error {
+	gen := ps.generation + 1
+	tmp := ps.checkpointPath(gen) + tmpExt
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating checkpoint: %w", err)
+	}
+
+	bw := bufio.NewWriter(f)
+
+	if _, err = ps.memStore.WriteTo(bw); err == nil {
+		if err = bw.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, ps.checkpointPath(gen))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+
+	old := ps.generation
+	ps.generation = gen
+
+	if err = ps.resetWAL(); err != nil {
+		return err
+	}
+
+	ps.dirty = false
+
+	os.Remove(ps.checkpointPath(old))
+
+	return nil
+}
+
+func (ps *PersistentMemStore) background(checkpointInterval time.Duration) {
+	defer ps.wg.Done()
+
+	var checkpoint, sync <-chan time.Time
+
+	if checkpointInterval > 0 {
+		t := time.NewTicker(checkpointInterval)
+
+		defer t.Stop()
+
+		checkpoint = t.C
+	}
+
+	if ps.policy == SyncPeriodic {
+		t := time.NewTicker(WALSyncInterval)
+
+		defer t.Stop()
+
+		sync = t.C
+	}
+
+	for {
+		select {
+		case <-checkpoint:
+			ps.Checkpoint()
+		case <-sync:
+			ps.mu.Lock()
+
+			if ps.dirty {
+				ps.wal.Sync()
+
+				ps.dirty = false
+			}
+
+			ps.mu.Unlock()
+		case <-ps.done:
+			return
+		}
+	}
+}
+
+// Close stops any background processing, writes a final checkpoint, and
+// closes the write-ahead log. Subsequent calls return the result of the first.
+func (ps *PersistentMemStore) Close() error {
+	ps.closeOnce.Do(func() {
+		close(ps.done)
+		ps.wg.Wait()
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+
+		ps.closeErr = ps.checkpoint()
+
+		if err := ps.wal.Close(); ps.closeErr == nil {
+			ps.closeErr = err
+		}
+	})
+
+	return ps.closeErr
+}
@@ -0,0 +1,107 @@
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+func TestPersistentMemStore(t *testing.T) {
+	s, err := NewPersistentMemStore(t.TempDir(), SyncAlways, 0)
+	if err != nil {
+		t.Errorf("received unexpected error creating PersistentMemStore: %s", err)
+		return
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestPersistentMemStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	crash := func(s *PersistentMemStore) {
+		close(s.done)
+		s.wg.Wait()
+		s.wal.Close()
+	}
+	s, err := NewPersistentMemStore(dir, SyncNever, 0)
+	if err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+		return
+	}
+	s.Set("key1", data("data1"))
+	s.Set("key2", data("data2"))
+	s.Set("key3", data("data3"))
+	if err = s.Checkpoint(); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if fi, _ := os.Stat(filepath.Join(dir, walName)); fi.Size() != 8 {
+		t.Errorf("test 1: expecting truncated log, got size %d", fi.Size())
+	}
+	s.Remove("key2")
+	s.Rename("key3", "key4")
+	s.Set("key1", data("newData1"))
+	crash(s)
+	for n := 2; n < 4; n++ {
+		if s, err = NewPersistentMemStore(dir, SyncPeriodic, 0); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n, err)
+			return
+		}
+		if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key4"}) {
+			t.Errorf("test %d: expecting keys [key1 key4], got %v", n, keys)
+		}
+		for key, val := range map[string]string{"key1": "newData1", "key4": "data3"} {
+			var buf memio.Buffer
+			if err = s.Get(key, &buf); err != nil {
+				t.Errorf("test %d: unexpected error getting %q: %s", n, key, err)
+			} else if string(buf) != val {
+				t.Errorf("test %d: expecting value %q for key %q, got %q", n, val, key, buf)
+			}
+		}
+		if n == 2 {
+			crash(s)
+		} else {
+			s.Close()
+		}
+	}
+	if cps, _ := filepath.Glob(filepath.Join(dir, "*"+checkpointExt)); len(cps) != 1 {
+		t.Errorf("test 4: expecting 1 checkpoint, got %d", len(cps))
+	}
+	fi, _ := os.Stat(filepath.Join(dir, walName))
+	f, _ := os.OpenFile(filepath.Join(dir, walName), os.O_WRONLY|os.O_APPEND, 0o600)
+	lw := byteio.StickyLittleEndianWriter{Writer: f}
+	lw.WriteUint32(0)
+	lw.WriteUint8(recordSet)
+	lw.WriteStringX("key5")
+	lw.WriteUintX(1 << 62)
+	f.Close()
+	if s, err = NewPersistentMemStore(dir, SyncNever, 0); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+		return
+	}
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key4"}) {
+		t.Errorf("test 5: expecting keys [key1 key4], got %v", keys)
+	} else if nfi, _ := os.Stat(filepath.Join(dir, walName)); nfi.Size() != fi.Size() {
+		t.Errorf("test 5: expecting log size %d, got %d", fi.Size(), nfi.Size())
+	} else if err = s.Close(); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if err = s.Close(); err != nil {
+		t.Errorf("test 7: unexpected error: %s", err)
+	}
+	f, _ = os.OpenFile(filepath.Join(dir, walName), os.O_WRONLY|os.O_APPEND, 0o600)
+	lw = byteio.StickyLittleEndianWriter{Writer: f}
+	lw.WriteUint32(0)
+	lw.WriteUint8(recordRename)
+	lw.WriteUintX(1 << 62)
+	f.Close()
+	if s, err = NewPersistentMemStore(dir, SyncNever, 0); err != nil {
+		t.Errorf("test 8: unexpected error: %s", err)
+		return
+	}
+	defer s.Close()
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key4"}) {
+		t.Errorf("test 8: expecting keys [key1 key4], got %v", keys)
+	}
+}
@@ -0,0 +1,151 @@
+package keystore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency histogram
+// buckets used by a PrometheusRecorder.
+var DefaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type promOp struct {
+	count, bytes uint64
+	sum          float64
+	buckets      []uint64
+	errors       map[string]uint64
+}
+
+// PrometheusRecorder is a Recorder that keeps counters and a latency histogram
+// for each operation, which can be served in the Prometheus text format.
+type PrometheusRecorder struct {
+	namespace string
+	buckets   []float64
+
+	mu  sync.Mutex
+	ops map[Operation]*promOp
+}
+
+// NewPrometheusRecorder creates a PrometheusRecorder whose metric names begin
+// with the given namespace, or "keystore" if it is empty. Latencies are
+// recorded using the DefaultBuckets.
+func NewPrometheusRecorder(namespace string) *PrometheusRecorder {
+	if namespace == "" {
+		namespace = "keystore"
+	}
+
+	return &PrometheusRecorder{
+		namespace: namespace,
+		buckets:   DefaultBuckets,
+		ops:       make(map[Operation]*promOp),
+	}
+}
+
+// Record implements the Recorder interface.
+func (p *PrometheusRecorder) Record(op Operation, duration time.Duration, bytes int64, err error) {
+	seconds := duration.Seconds()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	o, ok := p.ops[op]
+	if !ok {
+		o = &promOp{
+			buckets: make([]uint64, len(p.buckets)),
+			errors:  make(map[string]uint64),
+		}
+		p.ops[op] = o
+	}
+
+	o.count++
+	o.bytes += uint64(bytes)
+	o.sum += seconds
+
+	for n, le := range p.buckets {
+		if seconds <= le {
+			o.buckets[n]++
+		}
+	}
+
+	if err != nil {
+		o.errors[ErrorKind(err)]++
+	}
+}
+
+// WriteTo writes the metrics to the Writer in the Prometheus text format.
+func (p *PrometheusRecorder) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ops := make([]Operation, 0, len(p.ops))
+
+	for op := range p.ops {
+		ops = append(ops, op)
+	}
+
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+
+	cw := countingWriter{Writer: w}
+	bw := bufio.NewWriter(&cw)
+	ns := p.namespace
+
+	fmt.Fprintf(bw, "# HELP %s_operations_total Number of operations performed.\n# TYPE %[1]s_operations_total counter\n", ns)
+
+	for _, op := range ops {
+		fmt.Fprintf(bw, "%s_operations_total{op=%q} %d\n", ns, op, p.ops[op].count)
+	}
+
+	fmt.Fprintf(bw, "# HELP %s_operation_errors_total Number of operations that returned an error.\n# TYPE %[1]s_operation_errors_total counter\n", ns)
+
+	for _, op := range ops {
+		o := p.ops[op]
+		kinds := make([]string, 0, len(o.errors))
+
+		for kind := range o.errors {
+			kinds = append(kinds, kind)
+		}
+
+		sort.Strings(kinds)
+
+		for _, kind := range kinds {
+			fmt.Fprintf(bw, "%s_operation_errors_total{op=%q,kind=%q} %d\n", ns, op, kind, o.errors[kind])
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP %s_operation_bytes_total Number of value bytes read or written.\n# TYPE %[1]s_operation_bytes_total counter\n", ns)
+
+	for _, op := range ops {
+		fmt.Fprintf(bw, "%s_operation_bytes_total{op=%q} %d\n", ns, op, p.ops[op].bytes)
+	}
+
+	fmt.Fprintf(bw, "# HELP %s_operation_duration_seconds Latency of operations.\n# TYPE %[1]s_operation_duration_seconds histogram\n", ns)
+
+	for _, op := range ops {
+		o := p.ops[op]
+
+		for n, le := range p.buckets {
+			fmt.Fprintf(bw, "%s_operation_duration_seconds_bucket{op=%q,le=%q} %d\n", ns, op, strconv.FormatFloat(le, 'g', -1, 64), o.buckets[n])
+		}
+
+		fmt.Fprintf(bw, "%s_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", ns, op, o.count)
+		fmt.Fprintf(bw, "%s_operation_duration_seconds_sum{op=%q} %s\n", ns, op, strconv.FormatFloat(o.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_operation_duration_seconds_count{op=%q} %d\n", ns, op, o.count)
+	}
+
+	err := bw.Flush()
+
+	return cw.count, err
+}
+
+// ServeHTTP implements the http.Handler interface, serving the metrics in the
+// Prometheus text format.
+func (p *PrometheusRecorder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
@@ -0,0 +1,41 @@
+package keystore
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusRecorder(t *testing.T) {
+	p := NewPrometheusRecorder("")
+	p.Record(OpGet, 2*time.Millisecond, 10, nil)
+	p.Record(OpGet, time.Second, 0, ErrUnknownKey)
+	p.Record(OpSet, time.Microsecond, 7, errors.New("disk full"))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	body := w.Body.String()
+	for n, line := range [...]string{
+		"# TYPE keystore_operations_total counter",
+		`keystore_operations_total{op="get"} 2`,
+		`keystore_operations_total{op="set"} 1`,
+		`keystore_operation_errors_total{op="get",kind="unknown_key"} 1`,
+		`keystore_operation_errors_total{op="set",kind="other"} 1`,
+		`keystore_operation_bytes_total{op="get"} 10`,
+		"# TYPE keystore_operation_duration_seconds histogram",
+		`keystore_operation_duration_seconds_bucket{op="get",le="0.001"} 0`,
+		`keystore_operation_duration_seconds_bucket{op="get",le="0.005"} 1`,
+		`keystore_operation_duration_seconds_bucket{op="get",le="1"} 2`,
+		`keystore_operation_duration_seconds_bucket{op="get",le="+Inf"} 2`,
+		`keystore_operation_duration_seconds_sum{op="get"} 1.002`,
+		`keystore_operation_duration_seconds_count{op="set"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("test %d: expecting line %q in output:\n%s", n+1, line, body)
+		}
+	}
+}
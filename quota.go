@@ -0,0 +1,267 @@
+package keystore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Limits contains the quotas that can be enforced on a Store. A zero value for
+// any limit means that it is not enforced.
+type Limits struct {
+	MaxValueSize int64
+	MaxKeyLength int
+	MaxKeys      int
+	MaxTotalSize int64
+}
+
+type quota struct {
+	Limits
+
+	mu                sync.Mutex
+	keys, pendingKeys int
+	size, pendingSize int64
+}
+
+type reservation struct {
+	limit, reserved, oldSize int64
+	newKey                   bool
+}
+
+func (q *quota) enabled() bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.Limits != (Limits{})
+}
+
+func (q *quota) valueLimit() int64 {
+	if q == nil {
+		return -1
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.MaxValueSize > 0 {
+		return q.MaxValueSize
+	}
+
+	return -1
+}
+
+func (q *quota) checkKey(key string) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.MaxKeyLength > 0 && len(key) > q.MaxKeyLength {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// reserve checks that the key can be set, returning a reservation that limits
+// the size of the value. The overhead is any additional space used to store the
+// value, which counts towards MaxTotalSize.
+func (q *quota) reserve(key string, exists bool, oldSize, overhead int64) (reservation, error) {
+	r := reservation{limit: -1, oldSize: oldSize, newKey: !exists}
+
+	if q == nil {
+		return r, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.MaxKeyLength > 0 && len(key) > q.MaxKeyLength {
+		return r, ErrQuotaExceeded
+	} else if r.newKey && q.MaxKeys > 0 && q.keys+q.pendingKeys >= q.MaxKeys {
+		return r, ErrQuotaExceeded
+	}
+
+	if q.MaxValueSize > 0 {
+		r.limit = q.MaxValueSize
+	}
+
+	if q.MaxTotalSize > 0 {
+		avail := q.MaxTotalSize - q.size - q.pendingSize + oldSize - overhead
+		if avail < 0 {
+			avail = 0
+		}
+
+		if r.limit < 0 || avail < r.limit {
+			r.limit = avail
+		}
+
+		r.reserved = r.limit
+		q.pendingSize += r.reserved
+	}
+
+	if r.newKey {
+		q.pendingKeys++
+	}
+
+	return r, nil
+}
+
+func (q *quota) release(r reservation) {
+	q.pendingSize -= r.reserved
+
+	if r.newKey {
+		q.pendingKeys--
+	}
+}
+
+func (q *quota) commit(r reservation, replaced bool, oldSize, size int64) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	q.release(r)
+
+	q.size += size - oldSize
+
+	if !replaced {
+		q.keys++
+	}
+
+	q.mu.Unlock()
+}
+
+func (q *quota) cancel(r reservation, removed bool) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	q.release(r)
+
+	if removed && !r.newKey {
+		q.size -= r.oldSize
+		q.keys--
+	}
+
+	q.mu.Unlock()
+}
+
+func (q *quota) set(limits Limits, keys int, size int64) {
+	q.mu.Lock()
+	q.Limits = limits
+	q.mu.Unlock()
+	q.reset(keys, size)
+}
+
+func (q *quota) reset(keys int, size int64) {
+	q.mu.Lock()
+	q.keys = keys
+	q.size = size
+	q.mu.Unlock()
+}
+
+func (q *quota) remove(size int64) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	q.size -= size
+	q.keys--
+	q.mu.Unlock()
+}
+
+func (q *quota) writer(w io.Writer, r reservation) *limitWriter {
+	return &limitWriter{Writer: w, limit: r.limit}
+}
+
+type limitWriter struct {
+	io.Writer
+	limit, count int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.limit >= 0 && l.count+int64(len(p)) > l.limit {
+		return 0, ErrQuotaExceeded
+	}
+
+	n, err := l.Writer.Write(p)
+
+	l.count += int64(n)
+
+	return n, err
+}
+
+// SetLimits sets the quotas enforced by the FileStore, calculating the current
+// usage from the files in the base directory. Keys that are set in excess of
+// the limits return ErrQuotaExceeded and are not stored.
+//
+// The limits are shared with any stores returned by Sub, and apply to the
+// FileStore as a whole. When checksums are enabled, the checksum header of each
+// value counts towards MaxTotalSize.
+func (fs *FileStore) SetLimits(limits Limits) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	keys, size, err := fs.usage()
+	if err != nil {
+		return err
+	}
+
+	fs.quota.set(limits, keys, size)
+
+	return nil
+}
+
+func (fs *FileStore) usage() (int, int64, error) {
+	var (
+		keys int
+		size int64
+	)
+
+	err := filepath.Walk(fs.rootDir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			keys++
+			size += fi.Size()
+		}
+
+		return nil
+	})
+
+	return keys, size, err
+}
+
+// SetLimits sets the quotas enforced by the MemStore. Keys that are set in
+// excess of the limits return ErrQuotaExceeded and are not stored.
+func (ms *MemStore) SetLimits(limits Limits) {
+	ms.mu.Lock()
+
+	keys, size := ms.usage()
+
+	ms.quota.set(limits, keys, size)
+
+	ms.mu.Unlock()
+}
+
+func (ms *MemStore) usage() (int, int64) {
+	var size int64
+
+	for _, d := range ms.data {
+		size += int64(len(d))
+	}
+
+	return len(ms.data), size
+}
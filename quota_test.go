@@ -0,0 +1,173 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+type limitedStore interface {
+	Store
+	SetLimits(Limits) error
+}
+
+type memLimits struct {
+	*MemStore
+}
+
+func (m memLimits) SetLimits(l Limits) error {
+	m.MemStore.SetLimits(l)
+
+	return nil
+}
+
+func testLimits(t *testing.T, s limitedStore) {
+	s.Set("key1", data("12345"))
+	if err := s.SetLimits(Limits{MaxValueSize: 10, MaxKeyLength: 4, MaxKeys: 3, MaxTotalSize: 20}); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = s.Set("key2", data("12345678901")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 2: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = s.Set("key22", data("1")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 3: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = s.Set("key2", data("1234567890")); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if err = s.Set("key3", data("123456")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 5: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = s.Set("key3", data("12345")); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if err = s.Set("key4", data("")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 7: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = s.Set("key1", data("")); err != nil {
+		t.Errorf("test 8: unexpected error: %s", err)
+	} else if err = s.Remove("key3"); err != nil {
+		t.Errorf("test 9: unexpected error: %s", err)
+	} else if err = s.Set("key4", data("1234567890")); err != nil {
+		t.Errorf("test 10: unexpected error: %s", err)
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key2", "key4"}) {
+		t.Errorf("test 11: expecting keys [key1 key2 key4], got %v", keys)
+	}
+}
+
+func TestMemStoreLimits(t *testing.T) {
+	testLimits(t, memLimits{NewMemStore()})
+}
+
+func TestMemStoreLimitsConcurrent(t *testing.T) {
+	ms := NewMemStore()
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				ms.Set(fmt.Sprintf("key%d-%d", n, i), data("1"))
+			}
+		}(n)
+	}
+	for i := 0; i < 100; i++ {
+		ms.SetLimits(Limits{MaxKeys: 1000})
+	}
+	wg.Wait()
+	ms.SetLimits(Limits{MaxKeys: 800})
+	if err := ms.Set("extra", data("1")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 1: expecting ErrQuotaExceeded, got %v", err)
+	}
+	var buf memio.Buffer
+	src := NewMemStore()
+	src.Set("a", data("1"))
+	src.Set("b", data("1"))
+	src.WriteTo(&buf)
+	ms = NewMemStore()
+	ms.SetLimits(Limits{MaxKeys: 2})
+	if _, err := ms.ReadFrom(&buf); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if err = ms.Set("c", data("1")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 3: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = ms.Set("a", data("2")); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	}
+}
+
+func TestFileStoreLimits(t *testing.T) {
+	tmp := t.TempDir()
+	s, err := NewFileStore(t.TempDir(), tmp, nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	testLimits(t, s)
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("expecting no temp files, got %d", len(files))
+	}
+}
+
+func TestFileMemStoreLimits(t *testing.T) {
+	s, err := NewFileBackedMemStore(t.TempDir(), "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	testLimits(t, s)
+}
+
+func TestFileStoreLimitsShared(t *testing.T) {
+	fs, err := NewFileStore(t.TempDir(), "", NoMangle)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	sub := fs.Sub("ns")
+	if err = fs.SetLimits(Limits{MaxValueSize: 2, MaxKeys: 2}); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = sub.Set("key", data("123")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 2: expecting ErrQuotaExceeded, got %v", err)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sub.Set("key", data("12")); err != nil {
+				t.Errorf("test 3: unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err = fs.Set("key", data("1")); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if err = fs.Set("key2", data("1")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 5: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = sub.(*FileStore).SetLimits(Limits{MaxKeys: 3}); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if err = fs.Set("key2", data("1")); err != nil {
+		t.Errorf("test 7: unexpected error: %s", err)
+	} else if err = fs.Set("key3", data("1")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 8: expecting ErrQuotaExceeded, got %v", err)
+	}
+}
+
+func TestFileStoreLimitsRenameSelf(t *testing.T) {
+	fs, err := NewFileStore(t.TempDir(), "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	if err = fs.SetLimits(Limits{MaxKeys: 1}); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = fs.Set("a", data("1")); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if err = fs.Rename("a", "a"); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if !fs.Exists("a") {
+		t.Errorf("test 4: expecting key to exist")
+	} else if err = fs.Set("b", data("1")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("test 5: expecting ErrQuotaExceeded, got %v", err)
+	} else if err = fs.Rename("c", "c"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 6: expecting ErrUnknownKey, got %v", err)
+	}
+}
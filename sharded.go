@@ -0,0 +1,320 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"vimagination.zapto.org/memio"
+)
+
+type shard struct {
+	name  string
+	store Store
+}
+
+// ShardedStore is a Store that distributes keys between a number of Stores
+// using rendezvous hashing, so that adding or removing a shard only moves the
+// keys belonging to that shard.
+type ShardedStore struct {
+	mu     sync.RWMutex
+	shards []shard
+}
+
+// Sharded creates a new ShardedStore from the given Stores, which are named
+// by their position, starting from "0".
+//
+// As keys are assigned to shards by name, the Stores must be given in the
+// same order each time. Once shards have been added or removed, the names no
+// longer match the positions, so NamedSharded should be used instead.
+func Sharded(first Store, others ...Store) *ShardedStore {
+	s := &ShardedStore{
+		shards: make([]shard, 0, len(others)+1),
+	}
+
+	for n, store := range append([]Store{first}, others...) {
+		s.shards = append(s.shards, shard{name: strconv.Itoa(n), store: store})
+	}
+
+	return s
+}
+
+// NamedSharded creates a new ShardedStore from the given Stores, keyed by the
+// name of their shard. At least one Store must be given, or ErrNoShards is
+// returned.
+//
+// As keys are assigned to shards by name, each Store must be given the same
+// name each time; the names returned by Shards should be kept, along with any
+// used with AddShard.
+func NamedSharded(shards map[string]Store) (*ShardedStore, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+
+	s := &ShardedStore{
+		shards: make([]shard, 0, len(shards)),
+	}
+
+	for name, store := range shards {
+		s.shards = append(s.shards, shard{name: name, store: store})
+	}
+
+	sort.Slice(s.shards, func(i, j int) bool { return s.shards[i].name < s.shards[j].name })
+
+	return s, nil
+}
+
+func shardScore(name, key string) uint64 {
+	h := fnv.New64a()
+
+	io.WriteString(h, name)
+	h.Write([]byte{0})
+	io.WriteString(h, key)
+
+	x := h.Sum64()
+
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+func owner(shards []shard, key string) int {
+	best, bestScore := 0, uint64(0)
+
+	for n, s := range shards {
+		if score := shardScore(s.name, key); n == 0 || score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+
+	return best
+}
+
+func (s *ShardedStore) store(key string) Store {
+	return s.shards[owner(s.shards, key)].store
+}
+
+// Shards returns the names of the shards.
+func (s *ShardedStore) Shards() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, len(s.shards))
+
+	for n, sh := range s.shards {
+		names[n] = sh.name
+	}
+
+	return names
+}
+
+// Shard returns the name of the shard that holds the given key.
+func (s *ShardedStore) Shard(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.shards[owner(s.shards, key)].name
+}
+
+// Get retrieves the key from its shard.
+func (s *ShardedStore) Get(key string, r io.ReaderFrom) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store(key).Get(key, r)
+}
+
+// Set stores the key in its shard.
+func (s *ShardedStore) Set(key string, w io.WriterTo) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store(key).Set(key, w)
+}
+
+// Remove deletes the key from its shard.
+func (s *ShardedStore) Remove(key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store(key).Remove(key)
+}
+
+// Keys returns a sorted slice of the keys in all of the shards.
+func (s *ShardedStore) Keys() []string {
+	keys, _ := s.KeysErr()
+
+	return keys
+}
+
+// KeysErr returns a sorted slice of the keys in all of the shards, along with
+// any error encountered retrieving them.
+func (s *ShardedStore) KeysErr() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		keys     []string
+		firstErr error
+	)
+
+	for _, sh := range s.shards {
+		skeys, err := KeysErr(sh.store)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		keys = append(keys, skeys...)
+	}
+
+	return uniqueKeys(keys), firstErr
+}
+
+// Rename moves the value from an existing key to a new key, replacing any
+// value at the new key. When the keys are on different shards, the value is
+// copied to the new shard before being removed from the old one.
+func (s *ShardedStore) Rename(oldkey, newkey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, to := owner(s.shards, oldkey), owner(s.shards, newkey)
+
+	if oldkey == newkey {
+		if !exists(s.shards[from].store, oldkey) {
+			return ErrUnknownKey
+		}
+
+		return nil
+	} else if from == to {
+		return replace(s.shards[from].store, oldkey, newkey)
+	}
+
+	return move(s.shards[from].store, s.shards[to].store, oldkey, newkey)
+}
+
+// move copies a key from one Store to another, and then removes it from the
+// first.
+func move(from, to Store, oldkey, newkey string) error {
+	buf := make(memio.Buffer, 0)
+
+	if err := from.Get(oldkey, &buf); err != nil {
+		return err
+	} else if err = to.Set(newkey, &buf); err != nil {
+		return err
+	}
+
+	return from.Remove(oldkey)
+}
+
+// AddShard adds a new, named shard to the store, moving into it any keys in
+// the other shards that now belong to it.
+func (s *ShardedStore) AddShard(name string, store Store) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sh := range s.shards {
+		if sh.name == name {
+			return ErrShardExists
+		}
+	}
+
+	shards := append(s.shards[:len(s.shards):len(s.shards)], shard{name: name, store: store})
+	last := len(shards) - 1
+
+	var moved [][]string
+
+	for _, sh := range s.shards {
+		keys, err := KeysErr(sh.store)
+		if err != nil {
+			return fmt.Errorf("error reading keys from shard %q: %w", sh.name, err)
+		}
+
+		var owned []string
+
+		for _, key := range keys {
+			if owner(shards, key) == last {
+				if err := copyKey(sh.store, store, key); err != nil {
+					return fmt.Errorf("error copying key %q from shard %q: %w", key, sh.name, err)
+				}
+
+				owned = append(owned, key)
+			}
+		}
+
+		moved = append(moved, owned)
+	}
+
+	old := s.shards
+	s.shards = shards
+
+	for n, keys := range moved {
+		for _, key := range keys {
+			if err := old[n].store.Remove(key); err != nil && !errors.Is(err, ErrUnknownKey) {
+				return fmt.Errorf("error removing key %q from shard %q: %w", key, old[n].name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func copyKey(from, to Store, key string) error {
+	buf := make(memio.Buffer, 0)
+
+	if err := from.Get(key, &buf); err != nil {
+		return err
+	}
+
+	return to.Set(key, &buf)
+}
+
+// RemoveShard removes the named shard from the store, first copying its keys
+// to the remaining shards. The data in the removed Store is left in place.
+//
+// The last shard cannot be removed, returning ErrNoShards.
+func (s *ShardedStore) RemoveShard(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pos := -1
+
+	for n, sh := range s.shards {
+		if sh.name == name {
+			pos = n
+
+			break
+		}
+	}
+
+	if pos == -1 {
+		return ErrUnknownShard
+	} else if len(s.shards) == 1 {
+		return ErrNoShards
+	}
+
+	removed := s.shards[pos].store
+	shards := append(append(make([]shard, 0, len(s.shards)-1), s.shards[:pos]...), s.shards[pos+1:]...)
+
+	keys, err := KeysErr(removed)
+	if err != nil {
+		return fmt.Errorf("error reading keys from shard %q: %w", name, err)
+	}
+
+	for _, key := range keys {
+		if err := copyKey(removed, shards[owner(shards, key)].store, key); err != nil {
+			return fmt.Errorf("error copying key %q from shard %q: %w", key, name, err)
+		}
+	}
+
+	s.shards = shards
+
+	return nil
+}
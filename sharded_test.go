@@ -0,0 +1,119 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestSharded(t *testing.T) {
+	testStore(t, Sharded(NewMemStore(), NewMemStore(), NewMemStore()))
+}
+
+func TestShardedRebalance(t *testing.T) {
+	stores := []*MemStore{NewMemStore(), NewMemStore(), NewMemStore()}
+	s := Sharded(stores[0], stores[1])
+	var keys []string
+	for n := 0; n < 200; n++ {
+		key := fmt.Sprintf("key%03d", n)
+		keys = append(keys, key)
+		s.Set(key, data(key))
+	}
+	if got := s.Keys(); !reflect.DeepEqual(got, keys) {
+		t.Errorf("test 1: expecting all keys, got %v", got)
+	} else if n0, n1 := len(stores[0].Keys()), len(stores[1].Keys()); n0 < 50 || n1 < 50 {
+		t.Errorf("test 2: expecting keys to be distributed, got %d and %d", n0, n1)
+	}
+	before := make(map[string]string)
+	for _, key := range keys {
+		before[key] = s.Shard(key)
+	}
+	if err := s.AddShard("new", stores[2]); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if err = s.AddShard("new", NewMemStore()); !errors.Is(err, ErrShardExists) {
+		t.Errorf("test 4: expecting ErrShardExists, got %v", err)
+	} else if n := len(stores[2].Keys()); n < 30 {
+		t.Errorf("test 5: expecting keys to be moved to new shard, got %d", n)
+	} else if got := s.Keys(); !reflect.DeepEqual(got, keys) {
+		t.Errorf("test 6: expecting all keys, got %v", got)
+	}
+	for _, key := range keys {
+		if shard := s.Shard(key); shard != before[key] && shard != "new" {
+			t.Errorf("test 7: key %q moved from shard %q to %q", key, before[key], shard)
+		}
+		var buf memio.Buffer
+		if err := s.Get(key, &buf); err != nil || string(buf) != key {
+			t.Errorf("test 8: expecting value %q, got %q (%v)", key, buf, err)
+		}
+	}
+	if err := s.RemoveShard("0"); err != nil {
+		t.Errorf("test 9: unexpected error: %s", err)
+	} else if err = s.RemoveShard("0"); !errors.Is(err, ErrUnknownShard) {
+		t.Errorf("test 10: expecting ErrUnknownShard, got %v", err)
+	} else if shards := s.Shards(); !reflect.DeepEqual(shards, []string{"1", "new"}) {
+		t.Errorf("test 11: expecting shards [1 new], got %v", shards)
+	} else if n := len(stores[1].Keys()) + len(stores[2].Keys()); n != len(keys) {
+		t.Errorf("test 12: expecting %d keys in remaining shards, got %d", len(keys), n)
+	}
+	for _, key := range keys {
+		var buf memio.Buffer
+		if err := s.Get(key, &buf); err != nil || string(buf) != key {
+			t.Errorf("test 13: expecting value %q, got %q (%v)", key, buf, err)
+		}
+	}
+	r, err := NamedSharded(map[string]Store{"new": stores[2], "1": stores[1]})
+	if err != nil {
+		t.Errorf("test 14: unexpected error: %s", err)
+		return
+	}
+	for _, key := range keys {
+		if shard := r.Shard(key); shard != s.Shard(key) {
+			t.Errorf("test 15: expecting key %q in shard %q after reopen, got %q", key, s.Shard(key), shard)
+		}
+		var buf memio.Buffer
+		if err := r.Get(key, &buf); err != nil || string(buf) != key {
+			t.Errorf("test 16: expecting value %q, got %q (%v)", key, buf, err)
+		}
+	}
+	if err = r.RemoveShard("1"); err != nil {
+		t.Errorf("test 17: unexpected error: %s", err)
+	} else if err = r.RemoveShard("new"); !errors.Is(err, ErrNoShards) {
+		t.Errorf("test 18: expecting ErrNoShards, got %v", err)
+	} else if _, err = NamedSharded(nil); !errors.Is(err, ErrNoShards) {
+		t.Errorf("test 19: expecting ErrNoShards, got %v", err)
+	}
+}
+
+func TestShardedRename(t *testing.T) {
+	a, b := NewMemStore(), NewMemStore()
+	s := Sharded(a, b)
+	var from, to string
+	for n := 0; to == ""; n++ {
+		key := fmt.Sprintf("key%d", n)
+		if from == "" {
+			from = key
+		} else if s.Shard(key) != s.Shard(from) {
+			to = key
+		}
+	}
+	var buf memio.Buffer
+	s.Set(from, data("value"))
+	if err := s.Rename(from, to); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = s.Get(to, &buf); err != nil || string(buf) != "value" {
+		t.Errorf("test 2: expecting value %q, got %q (%v)", "value", buf, err)
+	} else if keys := s.Keys(); !reflect.DeepEqual(keys, []string{to}) {
+		t.Errorf("test 3: expecting keys [%s], got %v", to, keys)
+	} else if err = s.Rename(from, to); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 4: expecting ErrUnknownKey, got %v", err)
+	} else if err = s.Rename(to, to); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if buf = buf[:0]; s.Get(to, &buf) != nil || string(buf) != "value" {
+		t.Errorf("test 6: expecting value %q, got %q", "value", buf)
+	} else if err = s.Rename(from, from); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 7: expecting ErrUnknownKey, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const restoreExt = ".restore"
+
+// ErrSnapshotExists is returned when the destination of a snapshot already
+// exists.
+var ErrSnapshotExists = errors.New("snapshot destination exists")
+
+// Snapshot creates a consistent, point-in-time copy of the store in the dst
+// directory, which must not already exist.
+//
+// When the FileStore has a tmpDir, Set always replaces files by renaming, so
+// files are hard linked into the snapshot where possible. Otherwise, files are
+// copied.
+func (fs *FileStore) Snapshot(dst string) error {
+	return fs.SnapshotIncremental(dst, "")
+}
+
+// SnapshotIncremental acts like Snapshot, but any file whose size and
+// modification time match the corresponding file in the base snapshot is hard
+// linked from the base snapshot instead of being taken from the store.
+//
+// This allows cheap, repeated snapshots to a different filesystem, where only
+// changed files need to be copied.
+func (fs *FileStore) SnapshotIncremental(dst, base string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return ErrSnapshotExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return fmt.Errorf("error creating snapshot dir: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".snapshot")
+	if err != nil {
+		return fmt.Errorf("error creating snapshot dir: %w", err)
+	}
+
+	fs.mu.Lock()
+	err = fs.snapshot(tmp, base)
+	fs.mu.Unlock()
+
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+
+	if err != nil {
+		os.RemoveAll(tmp)
+
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (fs *FileStore) snapshot(dst, base string) error {
+	link := fs.tmpDir != ""
+
+	return filepath.Walk(fs.baseDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(fs.baseDir, path)
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+
+		if fi.IsDir() {
+			return os.Mkdir(target, 0o700)
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		if base != "" {
+			bpath := filepath.Join(base, rel)
+
+			if bfi, err := os.Stat(bpath); err == nil && bfi.Mode().IsRegular() && bfi.Size() == fi.Size() && bfi.ModTime().Equal(fi.ModTime()) {
+				if os.Link(bpath, target) == nil {
+					return nil
+				}
+			}
+		}
+
+		if link && os.Link(path, target) == nil {
+			return nil
+		}
+
+		return copyFile(path, target, fi)
+	})
+}
+
+func copyFile(src, dst string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+
+		return err
+	} else if err = out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// Restore replaces the contents of the store with the contents of the given
+// snapshot directory. Files are copied, so that the snapshot is unaffected by
+// later changes to the store.
+func (fs *FileStore) Restore(snapshot string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	keep := make(map[string]struct{})
+
+	if err := filepath.Walk(snapshot, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(snapshot, path)
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+
+		keep[rel] = struct{}{}
+		target := filepath.Join(fs.baseDir, rel)
+
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0o700)
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		tmp := target + restoreExt
+
+		os.Remove(tmp)
+
+		if err := copyFile(path, tmp, fi); err != nil {
+			os.Remove(tmp)
+
+			return err
+		}
+
+		return os.Rename(tmp, target)
+	}); err != nil {
+		return fmt.Errorf("error restoring snapshot: %w", err)
+	}
+
+	var remove []string
+
+	filepath.Walk(fs.baseDir, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fs.baseDir, path)
+		if err == nil && rel != "." {
+			if _, ok := keep[rel]; !ok {
+				remove = append(remove, path)
+			}
+		}
+
+		return nil
+	})
+
+	for n := len(remove) - 1; n >= 0; n-- {
+		if err := os.RemoveAll(remove[n]); err != nil {
+			return fmt.Errorf("error removing file: %w", err)
+		}
+	}
+
+	if fs.quota.enabled() {
+		keys, size, err := fs.usage()
+		if err != nil {
+			return err
+		}
+
+		fs.quota.reset(keys, size)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestSnapshot(t *testing.T) {
+	for n, tmp := range [...]string{"", t.TempDir()} {
+		dir := t.TempDir()
+		snaps := t.TempDir()
+		fs, err := NewFileStore(dir, tmp, NoMangle)
+		if err != nil {
+			t.Errorf("test %d: received unexpected error creating FileStore: %s", n+1, err)
+			continue
+		}
+		fs.Set("key1", data("data1"))
+		fs.Set("key2", data("data2"))
+		snap1 := filepath.Join(snaps, "1")
+		if err = fs.Snapshot(snap1); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+			continue
+		} else if err = fs.Snapshot(snap1); err != ErrSnapshotExists {
+			t.Errorf("test %d: expecting ErrSnapshotExists, got %v", n+1, err)
+		}
+		fs.Set("key1", data("newData1"))
+		fs.Set("key3", data("data3"))
+		snap2 := filepath.Join(snaps, "2")
+		if err = fs.SnapshotIncremental(snap2, snap1); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+			continue
+		}
+		a, _ := os.Stat(filepath.Join(snap1, "key2"))
+		b, _ := os.Stat(filepath.Join(snap2, "key2"))
+		if !os.SameFile(a, b) {
+			t.Errorf("test %d: expecting unchanged file to be linked from base snapshot", n+1)
+		}
+		if err = fs.Restore(snap1); err != nil {
+			t.Errorf("test %d: unexpected error restoring: %s", n+1, err)
+			continue
+		}
+		var buf memio.Buffer
+		if keys := fs.Keys(); !reflect.DeepEqual(keys, []string{"key1", "key2"}) {
+			t.Errorf("test %d: expecting keys [key1 key2], got %v", n+1, keys)
+		} else if fs.Get("key1", &buf); string(buf) != "data1" {
+			t.Errorf("test %d: expecting value %q, got %q", n+1, "data1", buf)
+		}
+		fs.Set("key1", data("changed"))
+		buf = buf[:0]
+		if d, _ := os.ReadFile(filepath.Join(snap1, "key1")); string(d) != "data1" {
+			t.Errorf("test %d: snapshot modified by store: got %q", n+1, d)
+		} else if d, _ = os.ReadFile(filepath.Join(snap2, "key1")); string(d) != "newData1" {
+			t.Errorf("test %d: expecting value %q in snapshot, got %q", n+1, "newData1", d)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package keystore
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"vimagination.zapto.org/memio"
+)
+
+type tierEntry struct {
+	key   string
+	size  int64
+	dirty bool
+}
+
+type tierCache struct {
+	capacity int64
+	size     int64
+	lru      list.List
+	entries  map[string]*list.Element
+}
+
+func (t *tierCache) touch(key string) {
+	if e, ok := t.entries[key]; ok {
+		t.lru.MoveToFront(e)
+	}
+}
+
+func (t *tierCache) add(key string, size int64, dirty bool) {
+	t.remove(key)
+
+	t.entries[key] = t.lru.PushFront(&tierEntry{key: key, size: size, dirty: dirty})
+	t.size += size
+}
+
+func (t *tierCache) remove(key string) *tierEntry {
+	e, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := t.lru.Remove(e).(*tierEntry)
+
+	delete(t.entries, key)
+
+	t.size -= entry.size
+
+	return entry
+}
+
+func (t *tierCache) dirty() []string {
+	var keys []string
+
+	for key, e := range t.entries {
+		if e.Value.(*tierEntry).dirty {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// TieredStore combines a number of Stores, with each Store acting as a cache
+// for those after it, and the last Store holding every key.
+//
+// Values found in a lower tier are promoted to the tiers above, and values
+// evicted from a full tier that have not yet been written to a lower tier are
+// demoted to the next tier.
+//
+// Only the values stored by the TieredStore are counted towards the capacity
+// of a tier; the cache tiers should start empty.
+type TieredStore struct {
+	mu        sync.Mutex
+	gen       uint64
+	tiers     []Store
+	caches    []tierCache
+	writeBack bool
+	noPromote bool
+}
+
+// Tiered creates a new TieredStore from the given Stores, fastest first.
+//
+// By default, writes go through to every tier, values are promoted on read,
+// and the tiers are not limited in size.
+func Tiered(first Store, lower ...Store) *TieredStore {
+	t := &TieredStore{
+		tiers:  append([]Store{first}, lower...),
+		caches: make([]tierCache, len(lower)),
+	}
+
+	for n := range t.caches {
+		t.caches[n].entries = make(map[string]*list.Element)
+	}
+
+	return t
+}
+
+// SetCapacity limits the total size of the values stored in the given cache
+// tier, in bytes, evicting the least recently used values when full. A
+// capacity of zero removes the limit.
+//
+// The last tier cannot be limited, and the capacity should be set before the
+// TieredStore is used.
+func (t *TieredStore) SetCapacity(tier int, capacity int64) {
+	if tier >= 0 && tier < len(t.caches) {
+		t.caches[tier].capacity = capacity
+	}
+}
+
+// SetWriteBack sets whether values are written only to the first tier,
+// reaching the lower tiers when evicted or when Flush is called, instead of
+// being written to every tier.
+//
+// This should be set before the TieredStore is used.
+func (t *TieredStore) SetWriteBack(writeBack bool) {
+	t.writeBack = writeBack
+}
+
+// SetPromote sets whether values read from a lower tier are copied into the
+// tiers above it. Promotion is enabled by default.
+//
+// This should be set before the TieredStore is used.
+func (t *TieredStore) SetPromote(promote bool) {
+	t.noPromote = !promote
+}
+
+// Get retrieves the value from the first tier that contains the key.
+//
+// The tiers are read without holding the lock used by modifying methods, so
+// a value read from a lower tier is only promoted when the TieredStore has not
+// been modified during the read.
+func (t *TieredStore) Get(key string, r io.ReaderFrom) error {
+	t.mu.Lock()
+	gen := t.gen
+	t.mu.Unlock()
+
+	for n, tier := range t.tiers {
+		if n == 0 || t.noPromote {
+			err := tier.Get(key, r)
+			if errors.Is(err, ErrUnknownKey) {
+				continue
+			} else if err == nil {
+				t.touch(n, key)
+			}
+
+			return err
+		}
+
+		buf := make(memio.Buffer, 0)
+
+		if err := tier.Get(key, &buf); errors.Is(err, ErrUnknownKey) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := t.promote(n, key, buf, gen); err != nil {
+			return fmt.Errorf("error promoting value: %w", err)
+		}
+
+		_, err := r.ReadFrom(&buf)
+
+		return err
+	}
+
+	return ErrUnknownKey
+}
+
+func (t *TieredStore) touch(n int, key string) {
+	if n < len(t.caches) {
+		t.mu.Lock()
+		t.caches[n].touch(key)
+		t.mu.Unlock()
+	}
+}
+
+// promote copies a value read from the given tier into the tiers above it.
+func (t *TieredStore) promote(n int, key string, buf memio.Buffer, gen uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n < len(t.caches) {
+		t.caches[n].touch(key)
+	}
+
+	if gen != t.gen {
+		return nil
+	}
+
+	for m := n - 1; m >= 0; m-- {
+		if err := t.put(m, key, buf, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// put stores the value in the given tier, evicting other values as needed.
+func (t *TieredStore) put(n int, key string, buf memio.Buffer, dirty bool) error {
+	if n == len(t.caches) {
+		return t.tiers[n].Set(key, &buf)
+	}
+
+	cache := &t.caches[n]
+	size := int64(len(buf))
+
+	if cache.capacity > 0 && size > cache.capacity {
+		if err := t.discard(n, key); err != nil {
+			return err
+		} else if dirty {
+			return t.put(n+1, key, buf, n+1 < len(t.caches))
+		}
+
+		return nil
+	}
+
+	if err := t.tiers[n].Set(key, &buf); err != nil {
+		return err
+	}
+
+	cache.add(key, size, dirty)
+
+	return t.evict(n)
+}
+
+func (t *TieredStore) discard(n int, key string) error {
+	t.caches[n].remove(key)
+
+	if err := t.tiers[n].Remove(key); err != nil && !errors.Is(err, ErrUnknownKey) {
+		return err
+	}
+
+	return nil
+}
+
+func (t *TieredStore) evict(n int) error {
+	cache := &t.caches[n]
+
+	for cache.capacity > 0 && cache.size > cache.capacity {
+		entry := cache.remove(cache.lru.Back().Value.(*tierEntry).key)
+
+		if entry.dirty {
+			buf := make(memio.Buffer, 0)
+
+			if err := t.tiers[n].Get(entry.key, &buf); err != nil {
+				return fmt.Errorf("error reading value to demote: %w", err)
+			} else if err = t.put(n+1, entry.key, buf, n+1 < len(t.caches)); err != nil {
+				return fmt.Errorf("error demoting value: %w", err)
+			}
+		}
+
+		if err := t.tiers[n].Remove(entry.key); err != nil && !errors.Is(err, ErrUnknownKey) {
+			return fmt.Errorf("error evicting value: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Set stores the value in every tier or, when using write-back, only in the
+// first tier.
+func (t *TieredStore) Set(key string, w io.WriterTo) error {
+	buf := make(memio.Buffer, 0)
+
+	if _, err := w.WriteTo(&buf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gen++
+
+	if t.writeBack {
+		return t.put(0, key, buf, len(t.caches) > 0)
+	}
+
+	for n := len(t.tiers) - 1; n >= 0; n-- {
+		if err := t.put(n, key, buf, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove deletes the key from every tier.
+func (t *TieredStore) Remove(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gen++
+
+	err := ErrUnknownKey
+
+	for n, tier := range t.tiers {
+		if n < len(t.caches) {
+			t.caches[n].remove(key)
+		}
+
+		if terr := tier.Remove(key); terr == nil {
+			if errors.Is(err, ErrUnknownKey) {
+				err = nil
+			}
+		} else if !errors.Is(terr, ErrUnknownKey) {
+			err = terr
+		}
+	}
+
+	return err
+}
+
+// Keys returns a sorted slice of all of the keys in any tier.
+func (t *TieredStore) Keys() []string {
+	keys, _ := t.KeysErr()
+
+	return keys
+}
+
+// KeysErr returns a sorted slice of all of the keys in any tier, along with
+// any error encountered retrieving them.
+func (t *TieredStore) KeysErr() ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var (
+		keys     []string
+		firstErr error
+	)
+
+	for _, tier := range t.tiers {
+		tkeys, err := KeysErr(tier)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		keys = append(keys, tkeys...)
+	}
+
+	return uniqueKeys(keys), firstErr
+}
+
+func uniqueKeys(keys []string) []string {
+	sort.Strings(keys)
+
+	j := 0
+
+	for n, key := range keys {
+		if n == 0 || key != keys[n-1] {
+			keys[j] = key
+			j++
+		}
+	}
+
+	return keys[:j]
+}
+
+// replace renames a key, removing any existing value at the new key for Stores
+// that do not replace it on Rename.
+//
+// The removal and rename are not atomic; should the second rename fail, the
+// value at the new key will already have been lost. The keys must differ.
+func replace(store Store, oldkey, newkey string) error {
+	err := store.Rename(oldkey, newkey)
+	if errors.Is(err, ErrKeyExists) {
+		if err = store.Remove(newkey); err == nil {
+			err = store.Rename(oldkey, newkey)
+		}
+	}
+
+	return err
+}
+
+// Rename moves the value from an existing key to a new key in every tier,
+// replacing any value at the new key.
+func (t *TieredStore) Rename(oldkey, newkey string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gen++
+
+	found := false
+
+	for _, tier := range t.tiers {
+		if exists(tier, oldkey) {
+			found = true
+
+			break
+		}
+	}
+
+	if !found {
+		return ErrUnknownKey
+	} else if oldkey == newkey {
+		return nil
+	}
+
+	for n, tier := range t.tiers {
+		if err := replace(tier, oldkey, newkey); errors.Is(err, ErrUnknownKey) {
+			if err = tier.Remove(newkey); err != nil && !errors.Is(err, ErrUnknownKey) {
+				return err
+			}
+
+			if n < len(t.caches) {
+				t.caches[n].remove(newkey)
+			}
+
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if n < len(t.caches) {
+			t.caches[n].remove(newkey)
+
+			if entry := t.caches[n].remove(oldkey); entry != nil {
+				t.caches[n].add(newkey, entry.size, entry.dirty)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Flush writes every value that has only been written to a cache tier, when
+// using write-back, to the lower tiers.
+func (t *TieredStore) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for n := range t.caches {
+		for _, key := range t.caches[n].dirty() {
+			buf := make(memio.Buffer, 0)
+
+			if err := t.tiers[n].Get(key, &buf); err != nil {
+				return fmt.Errorf("error reading value to flush: %w", err)
+			}
+
+			for m := len(t.tiers) - 1; m > n; m-- {
+				if err := t.put(m, key, buf, false); err != nil {
+					return fmt.Errorf("error flushing value: %w", err)
+				}
+			}
+
+			if e, ok := t.caches[n].entries[key]; ok {
+				e.Value.(*tierEntry).dirty = false
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package keystore
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestTiered(t *testing.T) {
+	testStore(t, Tiered(NewMemStore(), NewMemStore(), NewMemStore()))
+}
+
+func TestTieredPromotion(t *testing.T) {
+	a, b, c := NewMemStore(), NewMemStore(), NewMemStore()
+	ts := Tiered(a, b, c)
+	ts.SetCapacity(0, 10)
+	var buf memio.Buffer
+	ts.Set("one", data("12345"))
+	ts.Set("two", data("12345"))
+	ts.Set("three", data("12345"))
+	if keys := a.Keys(); !reflect.DeepEqual(keys, []string{"three", "two"}) {
+		t.Errorf("test 1: expecting keys [three two] in first tier, got %v", keys)
+	} else if keys := c.Keys(); len(keys) != 3 {
+		t.Errorf("test 2: expecting 3 keys in last tier, got %v", keys)
+	} else if err := ts.Get("one", &buf); err != nil || string(buf) != "12345" {
+		t.Errorf("test 3: expecting value %q, got %q (%v)", "12345", buf, err)
+	} else if keys := a.Keys(); !reflect.DeepEqual(keys, []string{"one", "three"}) {
+		t.Errorf("test 4: expecting keys [one three] in first tier, got %v", keys)
+	} else if ts.Set("big", data("12345678901")); a.Exists("big") || !b.Exists("big") || !c.Exists("big") {
+		t.Errorf("test 5: expecting large value to skip the first tier")
+	}
+	ts.SetPromote(false)
+	b.Remove("two")
+	if buf = buf[:0]; ts.Get("two", &buf) != nil || string(buf) != "12345" {
+		t.Errorf("test 6: expecting value %q, got %q", "12345", buf)
+	} else if a.Exists("two") || b.Exists("two") {
+		t.Errorf("test 7: expecting value to not be promoted")
+	}
+}
+
+func TestTieredWriteBack(t *testing.T) {
+	a, b, c := NewMemStore(), NewMemStore(), NewMemStore()
+	ts := Tiered(a, b, c)
+	ts.SetWriteBack(true)
+	ts.SetCapacity(0, 10)
+	ts.SetCapacity(1, 10)
+	ts.Set("one", data("11111"))
+	ts.Set("two", data("22222"))
+	if len(b.Keys()) != 0 || len(c.Keys()) != 0 {
+		t.Errorf("test 1: expecting values only in the first tier, got %v and %v", b.Keys(), c.Keys())
+	} else if ts.Set("three", data("33333")); !reflect.DeepEqual(b.Keys(), []string{"one"}) || len(c.Keys()) != 0 {
+		t.Errorf("test 2: expecting evicted value to be demoted to the second tier, got %v and %v", b.Keys(), c.Keys())
+	} else if keys := ts.Keys(); !reflect.DeepEqual(keys, []string{"one", "three", "two"}) {
+		t.Errorf("test 3: expecting keys [one three two], got %v", keys)
+	} else if err := ts.Flush(); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if keys := c.Keys(); !reflect.DeepEqual(keys, []string{"one", "three", "two"}) {
+		t.Errorf("test 5: expecting all keys in last tier, got %v", keys)
+	} else if err = ts.Rename("three", "four"); err != nil {
+		t.Errorf("test 6: unexpected error: %s", err)
+	} else if a.Exists("three") || c.Exists("three") || !a.Exists("four") || !c.Exists("four") {
+		t.Errorf("test 7: expecting key to be renamed in every tier")
+	} else if err = ts.Remove("four"); err != nil {
+		t.Errorf("test 8: unexpected error: %s", err)
+	} else if a.Exists("four") || b.Exists("four") || c.Exists("four") {
+		t.Errorf("test 9: expecting key to be removed from every tier")
+	}
+}
+
+func TestTieredRenameSelf(t *testing.T) {
+	a, b := NewMemStore(), NewMemStore()
+	ts := Tiered(a, b)
+	ts.Set("key", data("value"))
+	var buf memio.Buffer
+	if err := ts.Rename("key", "key"); err != nil {
+		t.Errorf("test 1: unexpected error: %s", err)
+	} else if err = ts.Get("key", &buf); err != nil || string(buf) != "value" {
+		t.Errorf("test 2: expecting value %q, got %q (%v)", "value", buf, err)
+	} else if !a.Exists("key") || !b.Exists("key") {
+		t.Errorf("test 3: expecting key to remain in every tier")
+	} else if err = ts.Rename("missing", "missing"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("test 4: expecting ErrUnknownKey, got %v", err)
+	}
+}
+
+type blockingStore struct {
+	Store
+	started, release chan struct{}
+}
+
+func (b *blockingStore) Get(key string, r io.ReaderFrom) error {
+	close(b.started)
+	<-b.release
+	return b.Store.Get(key, r)
+}
+
+func TestTieredConcurrentGet(t *testing.T) {
+	a := NewMemStore()
+	b := &blockingStore{Store: NewMemStore(), started: make(chan struct{}), release: make(chan struct{})}
+	b.Store.Set("key", data("old"))
+	ts := Tiered(a, b)
+	ts.SetWriteBack(true)
+	done := make(chan error)
+	go func() {
+		var buf memio.Buffer
+		done <- ts.Get("key", &buf)
+	}()
+	<-b.started
+	set := make(chan error)
+	go func() { set <- ts.Set("key", data("new")) }()
+	select {
+	case err := <-set:
+		if err != nil {
+			t.Errorf("test 1: unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("test 1: expecting Set to not wait for Get")
+		close(b.release)
+		<-done
+		<-set
+		return
+	}
+	close(b.release)
+	var buf memio.Buffer
+	if err := <-done; err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if err = a.Get("key", &buf); err != nil || string(buf) != "new" {
+		t.Errorf("test 3: expecting value %q in first tier, got %q (%v)", "new", buf, err)
+	}
+}
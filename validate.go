@@ -0,0 +1,192 @@
+package keystore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// KeyValidator checks that a key is acceptable to a Store.
+//
+// ValidateKey should return an error wrapping ErrInvalidKey for any key that is
+// not valid.
+type KeyValidator interface {
+	ValidateKey(string) error
+}
+
+// KeyValidatorFunc is a func that implements KeyValidator.
+type KeyValidatorFunc func(string) error
+
+// ValidateKey calls the underlying func.
+func (k KeyValidatorFunc) ValidateKey(key string) error {
+	return k(key)
+}
+
+type keyValidators []KeyValidator
+
+func (k keyValidators) ValidateKey(key string) error {
+	for _, v := range k {
+		if err := v.ValidateKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// KeyValidators combines multiple KeyValidators into one, which requires keys
+// to be accepted by all of them.
+func KeyValidators(validators ...KeyValidator) KeyValidator {
+	return keyValidators(validators)
+}
+
+// MaxKeyLength returns a KeyValidator that rejects keys longer than the given
+// number of bytes.
+func MaxKeyLength(length int) KeyValidator {
+	return KeyValidatorFunc(func(key string) error {
+		if len(key) > length {
+			return fmt.Errorf("%w: key longer than %d bytes", ErrInvalidKey, length)
+		}
+
+		return nil
+	})
+}
+
+// Charset returns a KeyValidator that rejects keys containing any character
+// not in the given set.
+func Charset(chars string) KeyValidator {
+	return KeyValidatorFunc(func(key string) error {
+		for _, c := range key {
+			if !strings.ContainsRune(chars, c) {
+				return fmt.Errorf("%w: invalid character %q", ErrInvalidKey, c)
+			}
+		}
+
+		return nil
+	})
+}
+
+// UTF8Keys is a KeyValidator that rejects empty keys and keys that are not
+// valid UTF-8.
+var UTF8Keys KeyValidator = KeyValidatorFunc(func(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	} else if !utf8.ValidString(key) {
+		return fmt.Errorf("%w: key is not valid UTF-8", ErrInvalidKey)
+	}
+
+	return nil
+})
+
+// maxFilenameLength is the common limit on the length of a single filename.
+const maxFilenameLength = 255
+
+// PathKeys is a KeyValidator that only accepts keys that are relative paths,
+// separated by the filepath.Separator, without any empty, '.' or '..'
+// elements, elements longer than 255 bytes, or NUL characters.
+//
+// This is the validation used for the NoMangle Mangler, ensuring that each
+// key maps to a distinct file within the base directory.
+var PathKeys KeyValidator = KeyValidatorFunc(func(key string) error {
+	if strings.ContainsRune(key, 0) {
+		return fmt.Errorf("%w: key contains NUL", ErrInvalidKey)
+	}
+
+	for _, part := range strings.Split(key, string(filepath.Separator)) {
+		switch part {
+		case "":
+			return fmt.Errorf("%w: empty path element", ErrInvalidKey)
+		case ".", "..":
+			return fmt.Errorf("%w: relative path element %q", ErrInvalidKey, part)
+		}
+
+		if len(part) > maxFilenameLength {
+			return fmt.Errorf("%w: path element longer than %d bytes", ErrInvalidKey, maxFilenameLength)
+		} else if filepath.Separator != '/' && strings.ContainsRune(part, '/') {
+			return fmt.Errorf("%w: key contains '/'", ErrInvalidKey)
+		}
+	}
+
+	return nil
+})
+
+func validateKeys(v KeyValidator, keys ...string) error {
+	if v == nil {
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := v.ValidateKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetKeyValidator sets a KeyValidator that is used to check the keys given to
+// every method of the MemStore. A nil KeyValidator disables validation.
+//
+// The KeyValidator should be set before the MemStore is used.
+func (ms *MemStore) SetKeyValidator(v KeyValidator) {
+	ms.validator = v
+}
+
+// SetKeyValidator sets a KeyValidator that is used to check the keys given to
+// every method of the FileStore. A nil KeyValidator disables validation.
+//
+// When the Mangler is itself a KeyValidator, as NoMangle is, it is always
+// applied in addition to the set KeyValidator.
+//
+// The KeyValidator should be set before the FileStore is used.
+func (fs *FileStore) SetKeyValidator(v KeyValidator) {
+	fs.validator = v
+}
+
+func (fs *FileStore) validateKeys(keys ...string) error {
+	if err := validateKeys(fs.validator, keys...); err != nil {
+		return err
+	} else if v, ok := fs.mangler.(KeyValidator); ok {
+		return validateKeys(v, keys...)
+	}
+
+	return nil
+}
+
+// SetKeyValidator sets a KeyValidator that is used to check the keys given to
+// every method of the LogStore. A nil KeyValidator disables validation.
+//
+// The KeyValidator should be set before the LogStore is used. Keys already
+// stored in the log are not checked.
+func (ls *LogStore) SetKeyValidator(v KeyValidator) {
+	ls.validator = v
+}
+
+// SetKeyValidator sets a KeyValidator that is used to check the keys given to
+// every method of the PersistentMemStore. A nil KeyValidator disables
+// validation.
+//
+// The KeyValidator should be set before the PersistentMemStore is used. Keys
+// already stored in the log are not checked.
+func (ps *PersistentMemStore) SetKeyValidator(v KeyValidator) {
+	ps.memStore.SetKeyValidator(v)
+}
+
+// SetKeyValidator sets a KeyValidator that is used to check the keys given to
+// every method of the BTreeStore. A nil KeyValidator disables validation.
+//
+// Keys longer than MaxBTreeKeyLength are always rejected.
+//
+// The KeyValidator should be set before the BTreeStore is used.
+func (bs *BTreeStore) SetKeyValidator(v KeyValidator) {
+	bs.validator = v
+}
+
+func (bs *BTreeStore) validateKeys(keys ...string) error {
+	if err := validateKeys(btreeKeyLength, keys...); err != nil {
+		return err
+	}
+
+	return validateKeys(bs.validator, keys...)
+}
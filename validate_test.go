@@ -0,0 +1,249 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"vimagination.zapto.org/memio"
+)
+
+func TestKeyValidators(t *testing.T) {
+	sep := string(filepath.Separator)
+	for n, test := range [...]struct {
+		Validator KeyValidator
+		Key       string
+		Valid     bool
+	}{
+		{MaxKeyLength(3), "abc", true},
+		{MaxKeyLength(3), "abcd", false},
+		{Charset("abc"), "cab", true},
+		{Charset("abc"), "cad", false},
+		{UTF8Keys, "ключ", true},
+		{UTF8Keys, "\xff", false},
+		{UTF8Keys, "", false},
+		{PathKeys, "a" + sep + "b", true},
+		{PathKeys, "a..b", true},
+		{PathKeys, "", false},
+		{PathKeys, sep + "a", false},
+		{PathKeys, "a" + sep, false},
+		{PathKeys, "a" + sep + sep + "b", false},
+		{PathKeys, "a" + sep + "." + sep + "b", false},
+		{PathKeys, ".." + sep + "a", false},
+		{PathKeys, "a\x00b", false},
+		{KeyValidators(MaxKeyLength(4), Charset("ab")), "abab", true},
+		{KeyValidators(MaxKeyLength(4), Charset("ab")), "ababa", false},
+		{KeyValidators(MaxKeyLength(4), Charset("ab")), "abc", false},
+	} {
+		if err := test.Validator.ValidateKey(test.Key); test.Valid && err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !test.Valid && !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("test %d: expecting ErrInvalidKey, got %v", n+1, err)
+		}
+	}
+}
+
+func TestStoreKeyValidation(t *testing.T) {
+	validator := Charset("abcdefghijklmnopqrstuvwxyz")
+	ms := NewMemStore()
+	ms.SetKeyValidator(validator)
+	fs, err := NewFileStore(t.TempDir(), "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	fs.SetKeyValidator(validator)
+	fms, err := NewFileBackedMemStore(t.TempDir(), t.TempDir(), nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileBackedMemStore: %s", err)
+		return
+	}
+	fms.SetKeyValidator(validator)
+	ls, err := NewLogStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Errorf("received unexpected error creating LogStore: %s", err)
+		return
+	}
+	defer ls.Close()
+	ls.SetKeyValidator(validator)
+	ps, err := NewPersistentMemStore(t.TempDir(), SyncNever, 0)
+	if err != nil {
+		t.Errorf("received unexpected error creating PersistentMemStore: %s", err)
+		return
+	}
+	defer ps.Close()
+	ps.SetKeyValidator(validator)
+	for n, s := range [...]interface {
+		Store
+		Exists(string) bool
+	}{ms, fs, fms, ls, ps} {
+		var buf memio.Buffer
+		if err := s.Set("valid", data("value")); err != nil {
+			t.Errorf("test %d: unexpected error setting valid key: %s", n+1, err)
+		} else if err = s.Set("in-valid", data("value")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("test %d: expecting ErrInvalidKey from Set, got %v", n+1, err)
+		} else if err = s.Get("in-valid", &buf); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("test %d: expecting ErrInvalidKey from Get, got %v", n+1, err)
+		} else if err = s.Remove("in-valid"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("test %d: expecting ErrInvalidKey from Remove, got %v", n+1, err)
+		} else if err = s.Rename("valid", "in-valid"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("test %d: expecting ErrInvalidKey from Rename, got %v", n+1, err)
+		} else if err = s.Rename("in-valid", "valid"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("test %d: expecting ErrInvalidKey from Rename, got %v", n+1, err)
+		} else if s.Exists("in-valid") {
+			t.Errorf("test %d: expecting invalid key to not exist", n+1)
+		} else if keys := s.Keys(); len(keys) != 1 || keys[0] != "valid" {
+			t.Errorf("test %d: expecting keys [valid], got %v", n+1, keys)
+		}
+	}
+}
+
+func TestNoMangleValidation(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(filepath.Join(dir, "store"), "", NoMangle)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	sep := string(filepath.Separator)
+	for n, key := range [...]string{"", ".." + sep + "escape", sep + "abs", "a" + sep + sep + "b", "a" + sep + "." + sep + "b", "a" + sep} {
+		if err = fs.Set(key, data("value")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("test %d: expecting ErrInvalidKey setting key %q, got %v", n+1, key, err)
+		}
+	}
+	if keys := fs.Keys(); len(keys) != 0 {
+		t.Errorf("expecting no keys, got %v", keys)
+	}
+}
+
+const fuzzChars = "ab.-_/\\\x00é\xff"
+
+func fuzzKey(r *rand.Rand) string {
+	var sb strings.Builder
+	for l := r.Intn(12); l > 0; l-- {
+		if r.Intn(20) == 0 {
+			sb.WriteString(strings.Repeat("a", r.Intn(300)))
+		} else {
+			sb.WriteByte(fuzzChars[r.Intn(len(fuzzChars))])
+		}
+	}
+	return sb.String()
+}
+
+func checkMangledKey(m Mangler, key string) error {
+	parts := m.Encode(key)
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || len(part) > maxFilenameLength || strings.ContainsAny(part, string(filepath.Separator)+"\x00") {
+			return fmt.Errorf("key %q encoded to invalid filename %q", key, part)
+		}
+	}
+	path := filepath.Join(parts...)
+	if decoded, err := m.Decode(strings.Split(path, string(filepath.Separator))); err != nil {
+		return fmt.Errorf("unexpected error decoding key %q: %w", key, err)
+	} else if decoded != key {
+		return fmt.Errorf("expecting key %q to decode to itself, got %q", key, decoded)
+	}
+	return nil
+}
+
+func TestManglerFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, test := range [...]struct {
+		Name    string
+		Mangler Mangler
+	}{
+		{"Base64Mangler", Base64Mangler},
+		{"NoMangle", NoMangle},
+	} {
+		v, _ := test.Mangler.(KeyValidator)
+		paths := make(map[string]string)
+		for n := 0; n < 10000; n++ {
+			key := fuzzKey(r)
+			if validateKeys(v, key) != nil {
+				continue
+			} else if err := checkMangledKey(test.Mangler, key); err != nil {
+				t.Errorf("%s: %s", test.Name, err)
+				continue
+			}
+			path := filepath.Join(test.Mangler.Encode(key)...)
+			if other, ok := paths[path]; ok && other != key {
+				t.Errorf("%s: keys %q and %q both encode to %q", test.Name, key, other, path)
+			}
+			paths[path] = key
+		}
+	}
+}
+
+func fuzzMangler(f *testing.F, m Mangler) {
+	for _, key := range [...]string{"a", "a/b", "../a", "/a", "a//b", "a/./b", "\x00", "\xff", strings.Repeat("a", 256)} {
+		f.Add(key)
+	}
+	f.Fuzz(func(t *testing.T, key string) {
+		if err := m.(KeyValidator).ValidateKey(key); err != nil {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("expecting ErrInvalidKey, got %v", err)
+			}
+			return
+		}
+		if err := checkMangledKey(m, key); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func FuzzBase64Mangler(f *testing.F) {
+	fuzzMangler(f, Base64Mangler)
+}
+
+func FuzzNoMangle(f *testing.F) {
+	fuzzMangler(f, NoMangle)
+}
+
+func TestFileStoreFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for _, m := range [...]Mangler{Base64Mangler, NoMangle} {
+		fs, err := NewFileStore(t.TempDir(), "", m)
+		if err != nil {
+			t.Errorf("received unexpected error creating FileStore: %s", err)
+			return
+		}
+		var keys []string
+		for n := 0; n < 200; n++ {
+			key := fuzzKey(r)
+			err := fs.Set(key, data(key))
+			if errors.Is(err, ErrInvalidKey) {
+				continue
+			} else if err != nil {
+				if fs.Exists(key) {
+					t.Errorf("unexpected error setting key %q: %s", key, err)
+				}
+				continue
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		j := 0
+		for n, key := range keys {
+			if n == 0 || key != keys[n-1] {
+				keys[j] = key
+				j++
+			}
+		}
+		keys = keys[:j]
+		if got := fs.Keys(); strings.Join(got, "\x00") != strings.Join(keys, "\x00") {
+			t.Errorf("expecting keys %q, got %q", keys, got)
+		}
+		for _, key := range keys {
+			var buf memio.Buffer
+			if err := fs.Get(key, &buf); err != nil {
+				t.Errorf("unexpected error getting key %q: %s", key, err)
+			} else if string(buf) != key {
+				t.Errorf("expecting value %q for key %q, got %q", key, key, buf)
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+// Version describes a single stored version of a key.
+type Version struct {
+	Version uint64
+	Time    time.Time
+}
+
+// VersionPolicy determines which old versions are kept by a VersionedStore.
+//
+// A zero value for either field disables that limit. The newest version of
+// each key is never pruned.
+type VersionPolicy struct {
+	// MaxVersions is the number of versions kept for each key.
+	MaxVersions int
+	// MaxAge is the length of time for which a version is kept after it has
+	// been replaced.
+	MaxAge time.Duration
+}
+
+// VersionedStore wraps a Store, keeping a copy of each value Set in a
+// separate history Store so that previous values can be retrieved and
+// restored.
+//
+// Versions are numbered from 1 for each key. Removing a key keeps its history,
+// so a removed key can be restored with Revert.
+type VersionedStore struct {
+	mu       sync.RWMutex
+	store    Store
+	versions Store
+	policy   VersionPolicy
+	index    map[string][]Version
+	now      func() time.Time
+}
+
+// NewVersionedStore creates a VersionedStore which keeps current values in
+// the store and versions in the history Store, which should not be used for
+// anything else.
+//
+// Any versions already in the history Store are loaded.
+func NewVersionedStore(store, history Store, policy VersionPolicy) (*VersionedStore, error) {
+	keys, err := KeysErr(history)
+	if err != nil {
+		return nil, fmt.Errorf("error reading versions: %w", err)
+	}
+
+	vs := &VersionedStore{
+		store:    store,
+		versions: history,
+		policy:   policy,
+		index:    make(map[string][]Version),
+		now:      time.Now,
+	}
+
+	for _, vkey := range keys {
+		key, version, err := parseVersionKey(vkey)
+		if err != nil {
+			return nil, err
+		}
+
+		vs.index[key] = append(vs.index[key], version)
+	}
+
+	for _, versions := range vs.index {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Version < versions[j].Version
+		})
+	}
+
+	return vs, nil
+}
+
+func versionKey(key string, version Version) string {
+	return fmt.Sprintf("%016x-%016x/%s", version.Version, version.Time.UnixNano(), key)
+}
+
+func parseVersionKey(vkey string) (string, Version, error) {
+	if len(vkey) < 34 || vkey[16] != '-' || vkey[33] != '/' {
+		return "", Version{}, fmt.Errorf("%w: invalid version key %q", ErrCorrupt, vkey)
+	}
+
+	v, err := strconv.ParseUint(vkey[:16], 16, 64)
+	if err != nil {
+		return "", Version{}, fmt.Errorf("%w: invalid version key %q", ErrCorrupt, vkey)
+	}
+
+	t, err := strconv.ParseUint(vkey[17:33], 16, 64)
+	if err != nil {
+		return "", Version{}, fmt.Errorf("%w: invalid version key %q", ErrCorrupt, vkey)
+	}
+
+	return vkey[34:], Version{Version: v, Time: time.Unix(0, int64(t))}, nil
+}
+
+// Get retrieves the current value of a key.
+func (vs *VersionedStore) Get(key string, r io.ReaderFrom) error {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	return vs.store.Get(key, r)
+}
+
+// Set stores a new value for the key, and records it as a new version.
+func (vs *VersionedStore) Set(key string, w io.WriterTo) error {
+	buf := make(memio.Buffer, 0)
+
+	if _, err := w.WriteTo(&buf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	return vs.set(key, buf)
+}
+
+func (vs *VersionedStore) set(key string, buf memio.Buffer) error {
+	versions := vs.index[key]
+	version := Version{Version: 1, Time: vs.now()}
+
+	if len(versions) > 0 {
+		version.Version = versions[len(versions)-1].Version + 1
+	}
+
+	vkey := versionKey(key, version)
+	vbuf := buf
+
+	if err := vs.versions.Set(vkey, &vbuf); err != nil {
+		return fmt.Errorf("error storing version: %w", err)
+	}
+
+	if err := vs.store.Set(key, &buf); err != nil {
+		vs.versions.Remove(vkey)
+
+		return err
+	}
+
+	vs.index[key] = append(versions, version)
+
+	return vs.prune(key)
+}
+
+// Remove deletes the current value of a key, keeping its history.
+func (vs *VersionedStore) Remove(key string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	return vs.store.Remove(key)
+}
+
+// Keys returns a sorted slice of the keys that currently have a value.
+func (vs *VersionedStore) Keys() []string {
+	keys, _ := vs.KeysErr()
+
+	return keys
+}
+
+// KeysErr returns a sorted slice of the keys that currently have a value,
+// along with any error encountered retrieving them.
+func (vs *VersionedStore) KeysErr() ([]string, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	return KeysErr(vs.store)
+}
+
+// Rename moves the current value of a key to a new key, recording it as a new
+// version of the new key. The history of the old key is kept.
+func (vs *VersionedStore) Rename(oldkey, newkey string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if err := vs.store.Rename(oldkey, newkey); err != nil {
+		return err
+	}
+
+	buf := make(memio.Buffer, 0)
+
+	if err := vs.store.Get(newkey, &buf); err != nil {
+		return err
+	}
+
+	return vs.set(newkey, buf)
+}
+
+// History returns the stored versions of a key, oldest first.
+func (vs *VersionedStore) History(key string) []Version {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	return append([]Version(nil), vs.index[key]...)
+}
+
+func (vs *VersionedStore) lookup(key string, version uint64) (Version, error) {
+	for _, v := range vs.index[key] {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+
+	return Version{}, ErrUnknownVersion
+}
+
+// GetVersion retrieves the value of a key at the given version.
+func (vs *VersionedStore) GetVersion(key string, version uint64, r io.ReaderFrom) error {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	v, err := vs.lookup(key, version)
+	if err != nil {
+		return err
+	}
+
+	return vs.versions.Get(versionKey(key, v), r)
+}
+
+// Revert sets the value of a key to that of the given version, recording it
+// as a new version.
+func (vs *VersionedStore) Revert(key string, version uint64) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	v, err := vs.lookup(key, version)
+	if err != nil {
+		return err
+	}
+
+	buf := make(memio.Buffer, 0)
+
+	if err = vs.versions.Get(versionKey(key, v), &buf); err != nil {
+		return fmt.Errorf("error reading version: %w", err)
+	}
+
+	return vs.set(key, buf)
+}
+
+// Prune removes the versions of all keys that are no longer kept by the
+// VersionPolicy.
+//
+// Versions are pruned whenever a key is Set, but Prune is needed to remove
+// versions that have exceeded MaxAge since.
+func (vs *VersionedStore) Prune() error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	keys := make([]string, 0, len(vs.index))
+
+	for key := range vs.index {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := vs.prune(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vs *VersionedStore) prune(key string) error {
+	versions := vs.index[key]
+	drop := 0
+
+	if vs.policy.MaxVersions > 0 && len(versions) > vs.policy.MaxVersions {
+		drop = len(versions) - vs.policy.MaxVersions
+	}
+
+	if vs.policy.MaxAge > 0 {
+		cutoff := vs.now().Add(-vs.policy.MaxAge)
+
+		for drop < len(versions)-1 && !versions[drop+1].Time.After(cutoff) {
+			drop++
+		}
+	}
+
+	for n, v := range versions[:drop] {
+		if err := vs.versions.Remove(versionKey(key, v)); err != nil && !errors.Is(err, ErrUnknownKey) {
+			vs.index[key] = versions[n:]
+
+			return fmt.Errorf("error pruning version: %w", err)
+		}
+	}
+
+	vs.index[key] = versions[drop:]
+
+	return nil
+}
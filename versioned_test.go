@@ -0,0 +1,109 @@
+package keystore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+func versionNumbers(versions []Version) []uint64 {
+	numbers := make([]uint64, len(versions))
+	for n, v := range versions {
+		numbers[n] = v.Version
+	}
+	return numbers
+}
+
+func TestVersionedStore(t *testing.T) {
+	vs, err := NewVersionedStore(NewMemStore(), NewMemStore(), VersionPolicy{})
+	if err != nil {
+		t.Errorf("received unexpected error creating VersionedStore: %s", err)
+		return
+	}
+	testStore(t, vs)
+}
+
+func TestVersionedStoreHistory(t *testing.T) {
+	dir := t.TempDir()
+	history, err := NewFileStore(dir, "", nil)
+	if err != nil {
+		t.Errorf("received unexpected error creating FileStore: %s", err)
+		return
+	}
+	ms := NewMemStore()
+	vs, err := NewVersionedStore(ms, history, VersionPolicy{})
+	if err != nil {
+		t.Errorf("received unexpected error creating VersionedStore: %s", err)
+		return
+	}
+	var buf memio.Buffer
+	vs.Set("key", data("one"))
+	vs.Set("key", data("two"))
+	vs.Set("key", data("three"))
+	if got := versionNumbers(vs.History("key")); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Errorf("test 1: expecting versions [1 2 3], got %v", got)
+	} else if err = vs.GetVersion("key", 2, &buf); err != nil {
+		t.Errorf("test 2: unexpected error: %s", err)
+	} else if string(buf) != "two" {
+		t.Errorf("test 2: expecting value %q, got %q", "two", buf)
+	} else if err = vs.GetVersion("key", 4, &buf); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("test 3: expecting ErrUnknownVersion, got %v", err)
+	} else if err = vs.Remove("key"); err != nil {
+		t.Errorf("test 4: unexpected error: %s", err)
+	} else if err = vs.Revert("key", 1); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if buf = buf[:0]; vs.Get("key", &buf) != nil || string(buf) != "one" {
+		t.Errorf("test 6: expecting value %q, got %q", "one", buf)
+	} else if err = vs.Rename("key", "other"); err != nil {
+		t.Errorf("test 7: unexpected error: %s", err)
+	} else if got := versionNumbers(vs.History("other")); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Errorf("test 8: expecting versions [1], got %v", got)
+	}
+	reopened, err := NewVersionedStore(ms, history, VersionPolicy{})
+	if err != nil {
+		t.Errorf("test 9: unexpected error: %s", err)
+	} else if got, expected := reopened.History("key"), vs.History("key"); !reflect.DeepEqual(versionNumbers(got), versionNumbers(expected)) {
+		t.Errorf("test 9: expecting versions %v, got %v", expected, got)
+	} else if !got[0].Time.Equal(expected[0].Time) {
+		t.Errorf("test 10: expecting time %s, got %s", expected[0].Time, got[0].Time)
+	}
+	history.Set("bad", data(""))
+	if _, err = NewVersionedStore(ms, history, VersionPolicy{}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("test 11: expecting ErrCorrupt, got %v", err)
+	}
+}
+
+func TestVersionedStorePrune(t *testing.T) {
+	now := time.Unix(1000, 0)
+	history := NewMemStore()
+	vs, err := NewVersionedStore(NewMemStore(), history, VersionPolicy{MaxVersions: 3, MaxAge: time.Hour})
+	if err != nil {
+		t.Errorf("received unexpected error creating VersionedStore: %s", err)
+		return
+	}
+	vs.now = func() time.Time { return now }
+	for n := 0; n < 5; n++ {
+		vs.Set("key", data("value"))
+		now = now.Add(time.Minute)
+	}
+	if got := versionNumbers(vs.History("key")); !reflect.DeepEqual(got, []uint64{3, 4, 5}) {
+		t.Errorf("test 1: expecting versions [3 4 5], got %v", got)
+	} else if keys := history.Keys(); len(keys) != 3 {
+		t.Errorf("test 2: expecting 3 stored versions, got %v", keys)
+	}
+	now = now.Add(time.Hour)
+	if err = vs.Prune(); err != nil {
+		t.Errorf("test 3: unexpected error: %s", err)
+	} else if got := versionNumbers(vs.History("key")); !reflect.DeepEqual(got, []uint64{5}) {
+		t.Errorf("test 3: expecting versions [5], got %v", got)
+	} else if keys := history.Keys(); len(keys) != 1 {
+		t.Errorf("test 4: expecting 1 stored version, got %v", keys)
+	} else if err = vs.Set("key", data("new")); err != nil {
+		t.Errorf("test 5: unexpected error: %s", err)
+	} else if got := versionNumbers(vs.History("key")); !reflect.DeepEqual(got, []uint64{5, 6}) {
+		t.Errorf("test 5: expecting versions [5 6], got %v", got)
+	}
+}